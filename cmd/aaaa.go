@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// suppressAAAA returns the SUPPRESS_AAAA mode: "rpz" to keep AAAA answers out of the
+// rewrites for intercepted domains, "all" to also filter AAAA answers from recursion
+// for every name and client, or an empty string when disabled.
+func suppressAAAA() (string, error) {
+	switch v := strings.ToLower(os.Getenv("SUPPRESS_AAAA")); v {
+	case "", "false":
+		return "", nil
+	case "true", "rpz":
+		return "rpz", nil
+	case "all":
+		return "all", nil
+	default:
+		return "", fmt.Errorf("SUPPRESS_AAAA must be true, rpz or all, not %s", v)
+	}
+}
+
+// cacheAddresses returns the cache IPs intercepted domains are steered to, dropping IPv6
+// addresses when AAAA answers are suppressed so that intercepted domains answer NODATA
+// for AAAA queries and dual-stack clients stay on the cache.
+func cacheAddresses(ips []string) ([]string, error) {
+	mode, err := suppressAAAA()
+	if err != nil || mode == "" {
+		return ips, err
+	}
+
+	v4 := make([]string, 0, len(ips))
+
+	for _, ip := range ips {
+		if addressRRType(ip) == "A" {
+			v4 = append(v4, ip)
+		}
+	}
+
+	if len(v4) == 0 {
+		return nil, fmt.Errorf("SUPPRESS_AAAA is set but none of %s are IPv4 addresses", strings.Join(ips, ", "))
+	}
+
+	return v4, nil
+}
+
+// filterAAAAConfiguration returns the filter-aaaa plugin statement when SUPPRESS_AAAA is
+// all. The plugin cannot be limited to some names, so it drops the AAAA records of every
+// name that also has an A record, for every client and not only intercepted domains,
+// taking IPv6 away from all traffic resolved through lancache-dns. SUPPRESS_AAAA=rpz
+// keeps to the intercepted domains.
+func filterAAAAConfiguration() (string, error) {
+	mode, err := suppressAAAA()
+	if err != nil || mode != "all" {
+		return "", err
+	}
+
+	log.Warn("SUPPRESS_AAAA=all filters AAAA answers for every domain and client, not only intercepted ones; use SUPPRESS_AAAA=rpz to limit it to intercepted domains", "phase", "config")
+
+	return fmtFilterAAAA, nil
+}
@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"dnstool/pkg/dnsgen"
+)
+
+func init() {
+	httpMux.HandleFunc("GET /api/state", apiAuth(handleAPIState))
+	httpMux.HandleFunc("POST /api/regenerate", apiAuth(handleAPIRegenerate))
+	httpMux.HandleFunc("POST /api/services/{service}/enable", apiAuth(handleAPIServiceEnable))
+	httpMux.HandleFunc("POST /api/services/{service}/disable", apiAuth(handleAPIServiceDisable))
+	httpMux.HandleFunc("POST /api/services/{service}/approve", apiAuth(handleAPIServiceApprove))
+	httpMux.HandleFunc("PUT /api/services/{service}/ip", apiAuth(handleAPIServiceIP))
+	httpMux.HandleFunc("DELETE /api/services/{service}", apiAuth(handleAPIServiceReset))
+	httpMux.HandleFunc("POST /api/domains", apiAuth(handleAPIDomainAdd))
+	httpMux.HandleFunc("DELETE /api/domains/{domain}", apiAuth(handleAPIDomainRemove))
+}
+
+// apiState is the response body of GET /api/state.
+type apiState struct {
+	Generation generationStatus `json:"generation"`
+	Runtime    runtimeConfig    `json:"runtime"`
+}
+
+// apiServiceRequest is the optional body accepted by the service endpoints.
+type apiServiceRequest struct {
+	IP string `json:"ip"`
+}
+
+// apiDomainRequest is the body of POST /api/domains.
+type apiDomainRequest struct {
+	Domain  string `json:"domain"`
+	Service string `json:"service"`
+}
+
+// apiAuth requires a bearer token matching API_TOKEN. The API is disabled when no
+// token is configured.
+func apiAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv("API_TOKEN")
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Failed to write API response", "error", err)
+	}
+}
+
+// saveState persists runtime changes, reporting failures to the client.
+func saveState(w http.ResponseWriter) bool {
+	if err := saveRuntimeState(); err != nil {
+		log.Error("Failed to save runtime state", "file", stateFile(), "error", err)
+		http.Error(w, "failed to save state: "+err.Error(), http.StatusInternalServerError)
+
+		return false
+	}
+
+	return true
+}
+
+func handleAPIState(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, apiState{Generation: currentStatus(), Runtime: runtimeSnapshot()})
+}
+
+func handleAPIRegenerate(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("fetch") == "true" {
+		requestRefresh("api")
+	} else {
+		requestRegeneration("api")
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// checkEnableIP validates the caches a service is enabled at through the API, which
+// must be private addresses. Without any, the service falls back to <SERVICE>CACHE_IP or
+// LANCACHE_IP, one of which has to be configured.
+func checkEnableIP(service, ip string) error {
+	if ip != "" {
+		ips, _, err := dnsgen.WeightedAddresses(ip)
+		if err == nil {
+			err = isPrivateIP(ips)
+		}
+
+		return err
+	}
+
+	if os.Getenv(strings.ToUpper(service)+"CACHE_IP") == "" && os.Getenv("LANCACHE_IP") == "" {
+		return fmt.Errorf("an ip is required as no cache ip is configured for this service")
+	}
+
+	return nil
+}
+
+// checkAPIService answers 404 and returns false when the service of the request is not
+// in cache_domains, so that a mistyped name is not saved to the state file.
+func checkAPIService(w http.ResponseWriter, r *http.Request) bool {
+	if _, err := cacheService(r.PathValue("service")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+func handleAPIServiceEnable(w http.ResponseWriter, r *http.Request) {
+	if !checkAPIService(w, r) {
+		return
+	}
+
+	var req apiServiceRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := checkEnableIP(r.PathValue("service"), req.IP); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	enabled := true
+	setServiceOverride(r.PathValue("service"), serviceOverride{Enabled: &enabled, IP: req.IP})
+	clearPendingService(r.PathValue("service"))
+	if !saveState(w) {
+		return
+	}
+
+	requestRegeneration("api: enable " + r.PathValue("service"))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleAPIServiceDisable(w http.ResponseWriter, r *http.Request) {
+	if !checkAPIService(w, r) {
+		return
+	}
+
+	enabled := false
+	setServiceOverride(r.PathValue("service"), serviceOverride{Enabled: &enabled})
+	clearPendingService(r.PathValue("service"))
+	if !saveState(w) {
+		return
+	}
+
+	requestRegeneration("api: disable " + r.PathValue("service"))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleAPIServiceApprove releases a new service held back by
+// AUTO_ENABLE_NEW_SERVICES=approve, leaving it to the environment configuration.
+func handleAPIServiceApprove(w http.ResponseWriter, r *http.Request) {
+	if !clearPendingService(r.PathValue("service")) {
+		http.Error(w, "service is not awaiting approval", http.StatusNotFound)
+		return
+	}
+
+	if !saveState(w) {
+		return
+	}
+
+	requestRegeneration("api: approve " + r.PathValue("service"))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleAPIServiceIP(w http.ResponseWriter, r *http.Request) {
+	if !checkAPIService(w, r) {
+		return
+	}
+
+	var req apiServiceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ips, _, err := dnsgen.WeightedAddresses(req.IP)
+	if err == nil {
+		err = isPrivateIP(ips)
+	}
+
+	if err != nil || req.IP == "" {
+		http.Error(w, "a valid private ip is required", http.StatusBadRequest)
+		return
+	}
+
+	o, _ := serviceOverrideFor(r.PathValue("service"))
+	o.IP = req.IP
+	setServiceOverride(r.PathValue("service"), o)
+	if !saveState(w) {
+		return
+	}
+
+	requestRegeneration("api: set ip for " + r.PathValue("service"))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleAPIServiceReset(w http.ResponseWriter, r *http.Request) {
+	if !checkAPIService(w, r) {
+		return
+	}
+
+	clearServiceOverride(r.PathValue("service"))
+	if !saveState(w) {
+		return
+	}
+
+	requestRegeneration("api: reset " + r.PathValue("service"))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleAPIDomainAdd(w http.ResponseWriter, r *http.Request) {
+	var req apiDomainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Domain == "" || req.Service == "" {
+		http.Error(w, "domain and service are required", http.StatusBadRequest)
+		return
+	}
+
+	if !validDomainName(req.Domain) {
+		http.Error(w, req.Domain+" is not a valid domain name", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := cacheService(req.Service); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	addCustomDomain(req.Domain, req.Service)
+	if !saveState(w) {
+		return
+	}
+
+	requestRegeneration("api: add domain " + req.Domain)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func handleAPIDomainRemove(w http.ResponseWriter, r *http.Request) {
+	if !removeCustomDomain(r.PathValue("domain")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !saveState(w) {
+		return
+	}
+
+	requestRegeneration("api: remove domain " + r.PathValue("domain"))
+
+	w.WriteHeader(http.StatusAccepted)
+}
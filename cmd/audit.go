@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configVariables are the variables configuring dnstool that the configuration hash of
+// the audit log covers. Secrets, such as API_TOKEN or TSIG_KEY_SECRET, are left out.
+var configVariables = []string{
+	"AUTO_ENABLE_NEW_SERVICES", "BIND_LAYOUT", "BIND_LISTEN", "BIND_LISTEN_V6",
+	"BIND_MAX_CACHE_SIZE", "BIND_MAX_STALE_TTL", "BIND_MINIMAL_ANY", "BIND_MINIMAL_RESPONSES",
+	"BIND_OPTIONS", "BIND_OPTIONS_FILE", "BIND_PORT", "BIND_PREFETCH", "BIND_QUERY_SOURCE",
+	"BIND_QUERY_SOURCE_V6", "BIND_SERVE_STALE", "BIND_STALE_ANSWER_TTL", "BIND_STATISTICS",
+	"BIND_STATISTICS_ALLOW", "BIND_STATISTICS_LISTEN", "BIND_STATISTICS_PORT", "BIND_VERSION",
+	"BLOCK_DOH_CANARY", "BLOCK_DOH_PROVIDERS", "CACHE_CONF", "CACHE_DOMAINS_BRANCH",
+	"CACHE_DOMAINS_DIR", "CACHE_DOMAINS_REPO", "CACHE_DOMAINS_VERIFY", "CACHE_RECORD_TTL",
+	"CACHE_ZONE_DNSSEC", "CANARY_CLIENTS", "CATALOG_ZONE", "CATALOG_ZONE_NAME", "CONF_D_DIR",
+	"CONF_D_GENERATED", "DNS64_CLIENTS", "DNS64_EXCLUDE", "DNS64_PREFIX",
+	"DNSSEC_EXCEPT_INTERCEPTED", "DNSSEC_KEY_DIR", "DNSSEC_NEGATIVE_TRUST_ANCHORS",
+	"DNSSEC_POLICY", "DNSSEC_TRUST_ANCHORS_FILE", "DNSSEC_VALIDATION", "DOCKER_DISCOVERY",
+	"DOCKER_DISCOVERY_IPV6", "DOH_BLOCKLIST_FILE", "DOH_CANARY_DOMAINS",
+	"ENABLE_DNSSEC_VALIDATION", "FORWARD_ZONES_FILE", "HTTPS_RECORDS", "LANCACHE_DNSDOMAIN",
+	"LANCACHE_DNS_IP", "LANCACHE_DNS_NS", "LANCACHE_IP", "LAN_SUBNETS", "NAMED_CONF_OPTIONS",
+	"NOFETCH", "PASSTHRU_IPS", "RPZ_BREAK_DNSSEC", "RPZ_FLATTEN", "RPZ_LOG", "RPZ_LOG_FILE",
+	"RPZ_LOG_SIZE", "RPZ_LOG_VERSIONS", "RPZ_MAX_POLICY_TTL", "RPZ_PER_SERVICE",
+	"RPZ_QNAME_WAIT_RECURSE", "RPZ_TTL", "SECONDARY_DNS_SERVERS", "SERIAL_FORMAT", "SITE_MAP",
+	"SUPPRESS_AAAA", "TSIG_ALGORITHM", "TSIG_KEY_NAME", "UPSTREAM_DNS", "UPSTREAM_DOH",
+	"UPSTREAM_MODE", "USE_GENERIC_CACHE", "VIEWS", "ZONE_MAX_RECORDS", "ZONE_MAX_SIZE",
+	"ZONE_PATH", "ZONE_SPLIT",
+}
+
+// configVariable matches the per-service, per-view and SOA variables, whose names
+// depend on cache_domains and VIEWS.
+var configVariable = regexp.MustCompile(`^((DISABLE|BLOCK|PASSTHRU|FORWARD|SCHEDULE)_.+|.+CACHE_IP|([A-Z]+_)?SOA_[A-Z]+|VIEW_.+_INTERCEPT)$`)
+
+// auditRecord is appended to AUDIT_LOG as a JSON line for every generation.
+type auditRecord struct {
+	Time             time.Time `json:"time"`
+	Reason           string    `json:"reason"`
+	Commit           string    `json:"commit"`
+	ConfigHash       string    `json:"config_hash"`
+	Result           string    `json:"result"`
+	Error            string    `json:"error,omitempty"`
+	ChangedFiles     []string  `json:"changed_files"`
+	EnabledServices  []string  `json:"enabled_services,omitempty"`
+	DisabledServices []string  `json:"disabled_services,omitempty"`
+	RecordDelta      int       `json:"record_delta"`
+}
+
+// writeAudit appends a record describing how the current generation differs from the
+// last successful one, as recorded in the state file so that it survives restarts.
+func writeAudit(reason string, current generationStatus, changed []string, genErr error) {
+	path := os.Getenv("AUDIT_LOG")
+	if path == "" {
+		return
+	}
+
+	record := auditRecord{
+		Time:         current.Time,
+		Reason:       reason,
+		Commit:       current.Revision,
+		ConfigHash:   configHash(),
+		Result:       "success",
+		ChangedFiles: changed,
+	}
+
+	if genErr != nil {
+		record.Result = "failure"
+		record.Error = genErr.Error()
+	}
+
+	was := lastEnabledServices()
+	now := enabledServices(current)
+
+	for name, domains := range now {
+		if _, ok := was[name]; !ok {
+			record.EnabledServices = append(record.EnabledServices, name)
+		}
+
+		record.RecordDelta += domains
+	}
+
+	for name, domains := range was {
+		if _, ok := now[name]; !ok {
+			record.DisabledServices = append(record.DisabledServices, name)
+		}
+
+		record.RecordDelta -= domains
+	}
+
+	sort.Strings(record.EnabledServices)
+	sort.Strings(record.DisabledServices)
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Error("Failed to encode audit record", "error", err)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Error("Failed to open audit log", "file", path, "error", err)
+		return
+	}
+
+	defer func(f *os.File) {
+		if err = f.Close(); err != nil {
+			log.Fatalf("error while closing resource %s: %v", f.Name(), err)
+		}
+	}(f)
+
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		log.Error("Failed to write audit log", "file", path, "error", err)
+	}
+}
+
+// enabledServices returns the enabled services of a generation with their number of
+// domains.
+func enabledServices(status generationStatus) map[string]int {
+	services := map[string]int{}
+
+	for _, s := range status.Services {
+		if s.Enabled {
+			services[s.Name] = s.Domains
+		}
+	}
+
+	return services
+}
+
+// rememberEnabledServices records the services enabled by a successful generation in
+// the state file, for the next audit record to be compared against.
+func rememberEnabledServices(status generationStatus) {
+	if !setLastEnabledServices(enabledServices(status)) {
+		return
+	}
+
+	if err := saveRuntimeState(); err != nil {
+		log.Warn("Failed to record the enabled services", "phase", "generate", "file", stateFile(), "error", err)
+	}
+}
+
+// configHash fingerprints the configuration the generation ran with, the sorted
+// configVariables and configVariable variables set, without recording any of the
+// values themselves.
+func configHash() string {
+	env := make([]string, 0)
+
+	for _, e := range os.Environ() {
+		key, _, _ := strings.Cut(e, "=")
+		if slices.Contains(configVariables, key) || configVariable.MatchString(key) {
+			env = append(env, e)
+		}
+	}
+
+	sort.Strings(env)
+
+	h := sha256.New()
+	for _, e := range env {
+		h.Write([]byte(e + "\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
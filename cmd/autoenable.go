@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// newServicePolicy returns AUTO_ENABLE_NEW_SERVICES: true, the default, enables services
+// appearing in cache_domains along with the rest under USE_GENERIC_CACHE; false leaves
+// them disabled; approve holds them back until they are approved through the API.
+func newServicePolicy() (string, error) {
+	policy := strings.ToLower(os.Getenv("AUTO_ENABLE_NEW_SERVICES"))
+
+	switch policy {
+	case "":
+		return "true", nil
+	case "true", "false", "approve":
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("AUTO_ENABLE_NEW_SERVICES must be true, false or approve, not %s", os.Getenv("AUTO_ENABLE_NEW_SERVICES"))
+}
+
+// holdNewServices applies AUTO_ENABLE_NEW_SERVICES to the services that were not in
+// cache_domains at the previous generation, recording the outcome in the state file so
+// that it outlasts the first generation to see them. A service left disabled gets a
+// disabled override, which enabling it through the API replaces. Services with an
+// override of their own are left alone, as is every service at the first generation.
+func holdNewServices(genericCache string, services []string) error {
+	policy, err := newServicePolicy()
+	if err != nil {
+		return err
+	}
+
+	known := knownServices()
+	if policy == "true" || genericCache != "true" || known == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(known))
+	for _, name := range known {
+		seen[name] = true
+	}
+
+	held := false
+
+	for _, service := range services {
+		service = strings.ToLower(service)
+
+		if _, overridden := serviceOverrideFor(service); seen[service] || overridden || isPendingService(service) {
+			continue
+		}
+
+		if policy == "approve" {
+			log.Info("Holding back new service until it is approved", "phase", "generate", "service", service)
+			addPendingService(service)
+		} else {
+			log.Info("Leaving new service disabled", "phase", "generate", "service", service)
+
+			enabled := false
+			setServiceOverride(service, serviceOverride{Enabled: &enabled})
+		}
+
+		held = true
+	}
+
+	if !held {
+		return nil
+	}
+
+	return saveRuntimeState()
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const defaultBenchmarkUncached = "example.com wikipedia.org github.com debian.org mozilla.org"
+
+var (
+	benchmarkServer      string
+	benchmarkDomain      string
+	benchmarkQPS         int
+	benchmarkDuration    time.Duration
+	benchmarkConcurrency int
+	benchmarkMix         float64
+	benchmarkUncached    string
+	benchmarkTimeout     time.Duration
+	benchmarkJSON        bool
+)
+
+var benchmarkCmd = &cobra.Command{
+	Use:   "benchmark",
+	Short: "Benchmark the resolver with cached and uncached lookups",
+	Long:  `Send lookups for domains intercepted for the caches and for other domains to the resolver at a fixed rate, reporting latency percentiles and whether every intercepted domain was answered with its cache, to size hardware before an event`,
+	Run: func(_ *cobra.Command, _ []string) {
+		report, err := runBenchmark()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if benchmarkJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err = enc.Encode(report); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+
+		report.print()
+	},
+}
+
+func init() {
+	benchmarkCmd.Flags().StringVar(&benchmarkServer, "server", "", "Resolver to benchmark, defaulting to 127.0.0.1 on BIND_PORT")
+	benchmarkCmd.Flags().StringVar(&benchmarkDomain, "domain", "", "Cache domain the resolver serves, defaulting to LANCACHE_DNSDOMAIN")
+	benchmarkCmd.Flags().IntVar(&benchmarkQPS, "qps", 200, "Lookups sent per second")
+	benchmarkCmd.Flags().DurationVar(&benchmarkDuration, "duration", 10*time.Second, "How long to send lookups for")
+	benchmarkCmd.Flags().IntVar(&benchmarkConcurrency, "concurrency", 256, "Most lookups awaiting an answer at once, further lookups are skipped")
+	benchmarkCmd.Flags().Float64Var(&benchmarkMix, "mix", 0.8, "Fraction of lookups for intercepted domains")
+	benchmarkCmd.Flags().StringVar(&benchmarkUncached, "uncached", defaultBenchmarkUncached, "Domains not intercepted for the caches to look up")
+	benchmarkCmd.Flags().DurationVar(&benchmarkTimeout, "timeout", 2*time.Second, "Time to wait for each answer")
+	benchmarkCmd.Flags().BoolVar(&benchmarkJSON, "json", false, "Output as JSON")
+}
+
+// latencyReport summarises the lookups of one kind.
+type latencyReport struct {
+	Sent     int     `json:"sent"`
+	Answered int     `json:"answered"`
+	Failed   int     `json:"failed"`
+	Correct  int     `json:"correct"`
+	Wrong    int     `json:"wrong"`
+	P50      float64 `json:"p50_ms"`
+	P90      float64 `json:"p90_ms"`
+	P99      float64 `json:"p99_ms"`
+	Max      float64 `json:"max_ms"`
+
+	latencies []time.Duration
+}
+
+// benchmarkReport is the outcome of a benchmark run.
+type benchmarkReport struct {
+	Server   string        `json:"server"`
+	Duration float64       `json:"duration_seconds"`
+	QPS      float64       `json:"qps"`
+	Skipped  int           `json:"skipped"`
+	Cached   latencyReport `json:"cached"`
+	Uncached latencyReport `json:"uncached"`
+	// Wrong lists up to ten names that were answered incorrectly.
+	Wrong []string `json:"wrong,omitempty"`
+}
+
+func runBenchmark() (benchmarkReport, error) {
+	if benchmarkQPS < 1 || benchmarkConcurrency < 1 || benchmarkMix < 0 || benchmarkMix > 1 {
+		return benchmarkReport{}, fmt.Errorf("--qps and --concurrency must be positive and --mix between 0 and 1")
+	}
+
+	server, err := resolverTarget(benchmarkServer)
+	if err != nil {
+		return benchmarkReport{}, err
+	}
+
+	domain := servedDomain(benchmarkDomain)
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		return benchmarkReport{}, err
+	}
+
+	cached, expected := interceptedNames(server, domain, services)
+	if len(cached) == 0 && benchmarkMix > 0 {
+		return benchmarkReport{}, fmt.Errorf("No service is answered with a cache by %s, check --domain", server.address())
+	}
+
+	uncached := make([]interceptedName, 0)
+	for _, name := range cleanIP(strings.ReplaceAll(benchmarkUncached, ",", " ")) {
+		uncached = append(uncached, interceptedName{name: name})
+	}
+
+	if len(uncached) == 0 && benchmarkMix < 1 {
+		return benchmarkReport{}, fmt.Errorf("--uncached must list at least one domain unless --mix is 1")
+	}
+
+	cacheIPs := map[string]bool{}
+	for _, ips := range expected {
+		for ip := range ips {
+			cacheIPs[ip] = true
+		}
+	}
+
+	log.Info("Benchmarking", "phase", "benchmark", "server", server.address(), "qps", benchmarkQPS, "duration", benchmarkDuration, "cached", len(cached), "uncached", len(uncached))
+
+	report := benchmarkReport{Server: server.address()}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+
+	slots := make(chan struct{}, benchmarkConcurrency)
+
+	lookup := func() {
+		isCached := rand.Float64() < benchmarkMix
+
+		var n interceptedName
+		if isCached {
+			n = cached[rand.IntN(len(cached))]
+		} else {
+			n = uncached[rand.IntN(len(uncached))]
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			mu.Lock()
+			report.Skipped++
+			mu.Unlock()
+
+			return
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			sent := time.Now()
+			answer, err := queryDNS(server, dnsQuery{Name: n.name, Type: dnsmessage.TypeA, Timeout: benchmarkTimeout})
+			latency := time.Since(sent)
+
+			correct := err == nil
+			if correct && isCached {
+				correct = answer.RCode == dnsmessage.RCodeSuccess && len(answer.Addrs) > 0
+
+				for _, a := range answer.Addrs {
+					correct = correct && expected[n.service][a]
+				}
+			} else if correct {
+				for _, a := range answer.Addrs {
+					correct = correct && !cacheIPs[a]
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			r := &report.Uncached
+			if isCached {
+				r = &report.Cached
+			}
+
+			r.Sent++
+
+			switch {
+			case err != nil:
+				r.Failed++
+			case correct:
+				r.Answered++
+				r.Correct++
+			default:
+				r.Answered++
+				r.Wrong++
+
+				if len(report.Wrong) < 10 && !slices.Contains(report.Wrong, n.name) {
+					report.Wrong = append(report.Wrong, n.name)
+				}
+			}
+
+			if err == nil {
+				r.latencies = append(r.latencies, latency)
+			}
+		}()
+	}
+
+	// Lookups are sent in batches every 10ms, each catching up with the rate so that
+	// late ticks don't lower it.
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	start := time.Now()
+	due := 0
+
+	for now := range ticker.C {
+		elapsed := min(now.Sub(start), benchmarkDuration)
+
+		for target := int(elapsed.Seconds() * float64(benchmarkQPS)); due < target; due++ {
+			lookup()
+		}
+
+		if elapsed == benchmarkDuration {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	report.Duration = elapsed.Seconds()
+	report.QPS = float64(report.Cached.Sent+report.Uncached.Sent) / elapsed.Seconds()
+	report.Cached.summarise()
+	report.Uncached.summarise()
+
+	return report, nil
+}
+
+// summarise computes the latency percentiles, in milliseconds.
+func (r *latencyReport) summarise() {
+	if len(r.latencies) == 0 {
+		return
+	}
+
+	slices.Sort(r.latencies)
+
+	at := func(p float64) float64 {
+		i := min(int(p*float64(len(r.latencies))), len(r.latencies)-1)
+		return float64(r.latencies[i].Microseconds()) / 1000
+	}
+
+	r.P50, r.P90, r.P99, r.Max = at(0.50), at(0.90), at(0.99), at(1)
+}
+
+func (r benchmarkReport) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Server:\t%s\n", r.Server)
+	fmt.Fprintf(w, "Rate:\t%.0f lookups/s over %.1fs\n", r.QPS, r.Duration)
+	fmt.Fprintf(w, "Skipped:\t%d\n", r.Skipped)
+
+	fmt.Fprintf(w, "\nLOOKUPS\tSENT\tFAILED\tCORRECT\tWRONG\tP50\tP90\tP99\tMAX\n")
+
+	for _, row := range []struct {
+		name string
+		r    latencyReport
+	}{{"cached", r.Cached}, {"uncached", r.Uncached}} {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.1fms\t%.1fms\t%.1fms\t%.1fms\n", row.name, row.r.Sent, row.r.Failed, row.r.Correct, row.r.Wrong, row.r.P50, row.r.P90, row.r.P99, row.r.Max)
+	}
+
+	if len(r.Wrong) > 0 {
+		fmt.Fprintf(w, "\nAnswered wrongly:\t%s\n", strings.Join(r.Wrong, ", "))
+	}
+
+	_ = w.Flush()
+}
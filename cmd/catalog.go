@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+const defaultCatalogZone = "catalog.lancache"
+
+// catalogZoneName returns the name of the catalog zone when CATALOG_ZONE is enabled.
+func catalogZoneName() string {
+	if os.Getenv("CATALOG_ZONE") != "true" {
+		return ""
+	}
+
+	if os.Getenv("CATALOG_ZONE_NAME") != "" {
+		return os.Getenv("CATALOG_ZONE_NAME")
+	}
+
+	return defaultCatalogZone
+}
+
+// catalogZoneFile returns the path of the catalog zone file.
+func catalogZoneFile() string {
+	return zonePath + catalogZoneName() + ".db"
+}
+
+// catalogZoneConfiguration returns the cache.conf stanza serving the catalog zone.
+func catalogZoneConfiguration(transfer string) string {
+	name := catalogZoneName()
+	if name == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(fmtUnqueriedZoneConf, name, catalogZoneFile(), transfer)
+}
+
+// generateCatalogZone writes a version 2 catalog zone (RFC 9432) listing the generated
+// zones, so secondaries configured with catalog-zones provision them automatically.
+func generateCatalogZone(members []string) error {
+	name := catalogZoneName()
+	if name == "" {
+		return nil
+	}
+
+	path := catalogZoneFile()
+
+	serial, err := nextSerial(path, time.Now())
+	if err != nil {
+		return err
+	}
+
+	f := createZoneFile(path)
+
+	if _, err = fmt.Fprintf(f, fmtCatalogZone, name, serial); err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		sum := sha1.Sum([]byte(member))
+		if _, err = fmt.Fprintf(f, "%s.zones IN PTR %s.\n", hex.EncodeToString(sum[:]), member); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
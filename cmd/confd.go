@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The fragments of confDir owned by dnstool, written with CONF_D_GENERATED=true and
+// never included as local configuration.
+const (
+	zonesFragment   = "dnstool-zones.conf"
+	optionsFragment = "dnstool-options.conf"
+)
+
+// confDir returns the directory holding local configuration fragments, from CONF_D_DIR
+// or conf.d within the layout's configuration directory.
+func confDir() string {
+	if os.Getenv("CONF_D_DIR") != "" {
+		return os.Getenv("CONF_D_DIR")
+	}
+
+	return filepath.Join(layout.ConfDir, "conf.d")
+}
+
+// confDGenerated reports whether generation writes its zone statements and options as
+// fragments owned by dnstool under confDir, from CONF_D_GENERATED, leaving CACHE_CONF to
+// include them and named.conf.options with just an include of the options fragment.
+func confDGenerated() bool {
+	return os.Getenv("CONF_D_GENERATED") == "true"
+}
+
+// zonesConf returns the file generation writes the zone statements to.
+func zonesConf() string {
+	if confDGenerated() {
+		return filepath.Join(confDir(), zonesFragment)
+	}
+
+	return cacheConf
+}
+
+// optionsConf returns the file generation writes the options statements to.
+func optionsConf() string {
+	if confDGenerated() {
+		return filepath.Join(confDir(), optionsFragment)
+	}
+
+	return namedConf
+}
+
+// confDIncludes returns include statements for each *.conf fragment in confDir other
+// than those owned by dnstool. The local fragments are never written by dnstool, so
+// local zones, ACLs and the like survive regeneration.
+func confDIncludes() (string, error) {
+	files, err := filepath.Glob(filepath.Join(confDir(), "*.conf"))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+
+	for _, file := range files {
+		if name := filepath.Base(file); name == zonesFragment || name == optionsFragment {
+			continue
+		}
+
+		fmt.Fprintf(&b, "\tinclude \"%s\";\n", file)
+	}
+
+	return b.String(), nil
+}
+
+// rawOptions returns the statements from BIND_OPTIONS, BIND_OPTIONS_FILE and any
+// *.options fragment in confDir, in that order, as name/value pairs merged into the
+// options block after everything dnstool sets so that they take precedence.
+func rawOptions() ([][2]string, error) {
+	snippets := []string{os.Getenv("BIND_OPTIONS")}
+
+	files, err := filepath.Glob(filepath.Join(confDir(), "*.options"))
+	if err != nil {
+		return nil, err
+	}
+
+	if path := os.Getenv("BIND_OPTIONS_FILE"); path != "" {
+		files = append([]string{path}, files...)
+	}
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		snippets = append(snippets, string(b))
+	}
+
+	options := make([][2]string, 0)
+
+	for _, snippet := range snippets {
+		statements, err := namedStatements(snippet, 0, len(snippet))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range statements {
+			value := strings.TrimSpace(strings.TrimSuffix(snippet[s.start+len(s.keyword):s.end], ";"))
+			if value == "" {
+				return nil, fmt.Errorf("Option %s has no value", s.keyword)
+			}
+
+			options = append(options, [2]string{s.keyword, value})
+		}
+	}
+
+	return options, nil
+}
+
+// writeOptionsFragment writes the options dnstool sets to the options fragment, then
+// removes them from the options block of conf, named.conf.options after substituting the
+// template's placeholders, and includes the fragment in their place. As when they are
+// set in place, a later pair of the same name replaces an earlier one, so that raw
+// options take precedence.
+func writeOptionsFragment(conf string, options [][2]string) error {
+	names := make([]string, 0, len(options))
+	values := map[string]string{}
+
+	for _, o := range options {
+		if _, ok := values[o[0]]; !ok {
+			names = append(names, o[0])
+		}
+
+		values[o[0]] = o[1]
+	}
+
+	var b strings.Builder
+
+	owned := make([][2]string, 0, len(names))
+
+	for _, name := range names {
+		if values[name] != "" {
+			fmt.Fprintf(&b, "%s %s;\n", name, values[name])
+		}
+
+		owned = append(owned, [2]string{name, ""})
+	}
+
+	if err := os.WriteFile(optionsConf(), []byte(b.String()), 0644); err != nil {
+		return err
+	}
+
+	conf, err := setNamedOptions(conf, owned)
+	if err != nil {
+		return err
+	}
+
+	if conf, err = addNamedInclude(conf, optionsConf()); err != nil {
+		return err
+	}
+
+	return os.WriteFile(namedConf, []byte(conf), 0644)
+}
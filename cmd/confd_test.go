@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testNamedConf = `options {
+	directory "/var/cache/bind";
+	forwarders { 192.0.2.53; };
+	listen-on { any; };
+};
+`
+
+// testOptions sets forwarders twice, as when BIND_OPTIONS overrides those of dnstool,
+// and clears listen-on.
+var testOptions = [][2]string{
+	{"forwarders", "{ 192.0.2.1; }"},
+	{"listen-on", ""},
+	{"response-policy", `{ zone "rpz"; }`},
+	{"forwarders", "{ 192.0.2.2; }"},
+}
+
+func TestOptionsInPlace(t *testing.T) {
+	conf, err := setNamedOptions(testNamedConf, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(conf, "forwarders"); n != 1 {
+		t.Errorf("got %d forwarders statements, want 1:\n%s", n, conf)
+	}
+
+	for _, want := range []string{"forwarders { 192.0.2.2; };", `response-policy { zone "rpz"; };`, `directory "/var/cache/bind";`} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("missing %s:\n%s", want, conf)
+		}
+	}
+
+	if strings.Contains(conf, "listen-on") {
+		t.Errorf("listen-on was not removed:\n%s", conf)
+	}
+}
+
+func TestOptionsFragment(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Setenv("CONF_D_GENERATED", "true")
+	t.Setenv("CONF_D_DIR", dir)
+
+	saved := namedConf
+	namedConf = filepath.Join(dir, "named.conf.options")
+	t.Cleanup(func() { namedConf = saved })
+
+	if err := os.WriteFile(namedConf, []byte(testNamedConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written twice, as by consecutive generations.
+	for range 2 {
+		conf, err := os.ReadFile(namedConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = writeOptionsFragment(string(conf), testOptions); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fragment, err := os.ReadFile(optionsConf())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "forwarders { 192.0.2.2; };\nresponse-policy { zone \"rpz\"; };\n"; string(fragment) != want {
+		t.Errorf("fragment is\n%s\nwant\n%s", fragment, want)
+	}
+
+	conf, err := os.ReadFile(namedConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"forwarders", "listen-on", "response-policy"} {
+		if strings.Contains(string(conf), name) {
+			t.Errorf("%s was left in named.conf.options:\n%s", name, conf)
+		}
+	}
+
+	if n := strings.Count(string(conf), `include "`+optionsConf()+`";`); n != 1 {
+		t.Errorf("got %d includes of the fragment, want 1:\n%s", n, conf)
+	}
+}
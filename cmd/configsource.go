@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configSourceKeys are the variables last applied from the configuration source, so
+// that keys deleted from the source can be unset again.
+var configSourceKeys = struct {
+	sync.Mutex
+	applied map[string]bool
+}{applied: map[string]bool{}}
+
+// configSourcePrefix returns CONFIG_SOURCE_PREFIX with a trailing slash.
+func configSourcePrefix() string {
+	prefix := os.Getenv("CONFIG_SOURCE_PREFIX")
+	if prefix == "" {
+		prefix = "lancache"
+	}
+
+	return strings.TrimSuffix(prefix, "/") + "/"
+}
+
+// loadConfigSource reads variables from the Consul KV or etcd prefix named by
+// CONFIG_SOURCE and CONFIG_SOURCE_PREFIX and applies them to the process environment,
+// so that a fleet of instances can share one set of service IPs, passthroughs and
+// toggles. Keys below the prefix name the variables, with slashes read as underscores.
+// It returns a version that changes whenever the source does.
+func loadConfigSource() (string, error) {
+	var (
+		kv      map[string]string
+		version string
+		err     error
+	)
+
+	switch source := os.Getenv("CONFIG_SOURCE"); source {
+	case "":
+		return "", nil
+	case "consul":
+		kv, version, err = readConsulKV("")
+	case "etcd":
+		kv, version, err = readEtcdKV()
+	default:
+		return "", fmt.Errorf("CONFIG_SOURCE must be consul or etcd, not %s", source)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	configSourceKeys.Lock()
+	defer configSourceKeys.Unlock()
+
+	applied := map[string]bool{}
+
+	for key, value := range kv {
+		name := strings.ToUpper(strings.ReplaceAll(strings.Trim(key, "/"), "/", "_"))
+		if name == "" {
+			continue
+		}
+
+		if err = os.Setenv(name, value); err != nil {
+			return "", err
+		}
+
+		applied[name] = true
+	}
+
+	for name := range configSourceKeys.applied {
+		if !applied[name] {
+			_ = os.Unsetenv(name)
+		}
+	}
+
+	configSourceKeys.applied = applied
+
+	return version, nil
+}
+
+// configSourceURL returns the base URL of the configuration source API.
+func configSourceURL(fallback string) string {
+	if os.Getenv("CONFIG_SOURCE_URL") != "" {
+		return strings.TrimSuffix(os.Getenv("CONFIG_SOURCE_URL"), "/")
+	}
+
+	return fallback
+}
+
+// readConsulKV reads every key below the prefix. When index is set the request blocks
+// until the prefix changes from that index or the wait time elapses.
+func readConsulKV(index string) (map[string]string, string, error) {
+	path := "/v1/kv/" + configSourcePrefix() + "?recurse=true"
+	if index != "" {
+		path += "&wait=5m&index=" + url.QueryEscape(index)
+	}
+
+	resp, err := consulRequest(http.MethodGet, path, nil, 6*time.Minute)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	kv := map[string]string{}
+	version := resp.Header.Get("X-Consul-Index")
+
+	if resp.StatusCode == http.StatusNotFound {
+		return kv, version, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("Consul returned %s", resp.Status)
+	}
+
+	var entries []struct {
+		Key   string
+		Value []byte
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, "", err
+	}
+
+	for _, e := range entries {
+		if key := strings.TrimPrefix(e.Key, configSourcePrefix()); key != "" && !strings.HasSuffix(key, "/") {
+			kv[key] = string(e.Value)
+		}
+	}
+
+	return kv, version, nil
+}
+
+// readEtcdKV reads every key below the prefix through the etcd v3 JSON gateway.
+func readEtcdKV() (map[string]string, string, error) {
+	prefix := []byte(configSourcePrefix())
+
+	end := append([]byte(nil), prefix...)
+	end[len(end)-1]++
+
+	body, err := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString(prefix),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, configSourceURL("http://127.0.0.1:2379")+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if token := os.Getenv("ETCD_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("etcd returned %s", resp.Status)
+	}
+
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		KVs []struct {
+			Key         []byte `json:"key"`
+			Value       []byte `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+
+	kv := map[string]string{}
+
+	// The store revision moves with writes anywhere, so the version is derived from the
+	// keys below the prefix alone.
+	var version strings.Builder
+
+	for _, e := range result.KVs {
+		key := strings.TrimPrefix(string(e.Key), configSourcePrefix())
+		kv[key] = string(e.Value)
+		version.WriteString(key + "@" + e.ModRevision + ";")
+	}
+
+	return kv, version.String(), nil
+}
+
+// watchConfigSource regenerates the configuration whenever the configuration source
+// changes, using Consul blocking queries or polling etcd every CONFIG_SOURCE_INTERVAL.
+func watchConfigSource() {
+	source := os.Getenv("CONFIG_SOURCE")
+	if source == "" {
+		return
+	}
+
+	version, err := loadConfigSource()
+	if err != nil {
+		log.Warn("Failed to read configuration source", "phase", "config", "error", err)
+	}
+
+	interval := 30 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("CONFIG_SOURCE_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+
+	log.Info("Watching configuration source", "phase", "config", "source", source, "prefix", configSourcePrefix())
+
+	go func() {
+		for {
+			if source == "consul" {
+				// Block until the prefix changes; the result is applied by loadConfigSource.
+				_, index, err := readConsulKV(version)
+				if err != nil || index == "" {
+					log.Warn("Failed to watch Consul", "phase", "config", "error", err)
+					time.Sleep(interval)
+
+					continue
+				}
+
+				if index == version {
+					continue
+				}
+			} else {
+				time.Sleep(interval)
+			}
+
+			current, err := loadConfigSource()
+			if err != nil {
+				log.Warn("Failed to read configuration source", "phase", "config", "error", err)
+				continue
+			}
+
+			if current != version {
+				log.Info("Configuration source changed", "phase", "config", "version", current)
+				version = current
+
+				requestRegeneration("config source")
+			}
+		}
+	}()
+}
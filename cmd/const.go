@@ -1,30 +1,16 @@
 package cmd
 
-import logger "log"
-import "os"
-
 const (
-	domainsPath = "/opt/cache-domains"
-	cacheDomain = "cache_domains.json"
-
-	cacheConf  = "/etc/bind/cache.conf"
-	namedConf  = "/etc/bind/named.conf.options"
-	zonePath   = "/etc/bind/cache/"
-	rpzZone    = zonePath + "rpz.db"
-	customZone = zonePath + "custom.db"
+	defaultDomainsPath = "/opt/cache-domains"
+	cacheDomain        = "cache_domains.json"
 
-	fmtCacheTemplate = `$ORIGIN %s. 
-$TTL    600
-@       IN  SOA localhost. dns.lancache.net. (
-             %s
-             604800	
-             600
-             600
-             600 )
-@       IN  NS  localhost.
+	snapshotMarker = ".snapshot"
 
+	defaultStateFile = "/var/lib/dnstool/state.json"
 
-`
+	defaultResolvConf  = "/etc/resolv.conf"
+	resolvConfOriginal = ".dnstool-orig"
+	resolvConfHeader   = "# Lancache dns config"
 
 	fmtGenericServer = `
 ----------------------------------------------------------------------
@@ -38,26 +24,53 @@ Make sure you are using a monolithic cache or load balancer at %s
 
 `
 
-	cacheConfTemplate = `	zone "cache.lancache.net" {
+	fmtUnqueriedZoneConf = `	zone "%s" {
 		type master;
-		file "/etc/bind/cache/cache.lancache.net.db";
-	};
-	zone "rpz" {
-		type master;
-		file "/etc/bind/cache/rpz.db";
+		file "%s";
 		allow-query { none; };
-	};`
-
-	rpzTemplate = `$TTL 60
-@            IN    SOA  localhost. root.localhost.  (
-                          2   ; serial 
-                          3H  ; refresh 
-                          1H  ; retry 
-                          1W  ; expiry 
-                          1H) ; minimum 
-                  IN    NS    localhost.`
-)
+%s	};
+`
+
+	fmtCatalogZone = `$ORIGIN %s.
+$TTL 3600
+@       IN  SOA invalid. invalid. ( %d 3600 600 86400 3600 )
+@       IN  NS  invalid.
+version IN  TXT "2"
+`
+
+	fmtTSIGKey = `	key "%s" {
+		algorithm %s;
+		secret "%s";
+	};
+`
 
-var (
-	log = logger.New(os.Stdout, "", 0)
+	fmtForwardZone = `	zone "%s" {
+		type forward;
+		forward only;
+		forwarders { %s; };
+	};
+`
+
+	fmtStatisticsChannels = `	statistics-channels {
+		inet %s port %s allow { %s };
+	};
+`
+
+	fmtFilterAAAA = `	plugin query "filter-aaaa.so" {
+		filter-aaaa-on-v4 yes;
+		filter-aaaa-on-v6 yes;
+	};
+`
+
+	fmtRPZLogging = `	logging {
+		channel rpz_log {
+			file "%s" versions %s size %s;
+			severity info;
+			print-time yes;
+			print-category yes;
+			print-severity yes;
+		};
+		category rpz { rpz_log; };
+	};
+`
 )
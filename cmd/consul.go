@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// consulServiceID is the ID this instance is registered under, empty when not registered.
+var consulServiceID string
+
+// consulAddress returns the base URL of the Consul agent, from CONSUL_HTTP_ADDR or, when
+// Consul is also the configuration source, CONFIG_SOURCE_URL.
+func consulAddress() string {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	} else if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	if os.Getenv("CONFIG_SOURCE") == "consul" {
+		return configSourceURL(addr)
+	}
+
+	return strings.TrimSuffix(addr, "/")
+}
+
+// consulRequest sends a request to the Consul agent API, authenticated with
+// CONSUL_HTTP_TOKEN when set.
+func consulRequest(method, path string, body any, timeout time.Duration) (*http.Response, error) {
+	var r io.Reader
+
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, consulAddress()+path, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	return (&http.Client{Timeout: timeout}).Do(req)
+}
+
+// consulCall sends a request to the Consul agent and discards the response body,
+// returning an error for any non-2xx status.
+func consulCall(method, path string, body any) (int, error) {
+	resp, err := consulRequest(method, path, body, 10*time.Second)
+	if err != nil {
+		return 0, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("Consul returned %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// startConsulRegistration registers the DNS endpoint with the local Consul agent when
+// CONSUL_REGISTER is enabled. The service carries a TTL check that is kept passing only
+// while BIND answers a query for the cache domain, so that Consul reflects whether the
+// resolver is actually serving rather than merely whether dnstool is running.
+func startConsulRegistration() error {
+	if os.Getenv("CONSUL_REGISTER") != "true" {
+		return nil
+	}
+
+	port, err := bindPort()
+	if err != nil {
+		return err
+	}
+
+	interval := 10 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("CONSUL_CHECK_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+
+	name := "lancache-dns"
+	if os.Getenv("CONSUL_SERVICE_NAME") != "" {
+		name = os.Getenv("CONSUL_SERVICE_NAME")
+	}
+
+	id := os.Getenv("CONSUL_SERVICE_ID")
+	if id == "" {
+		id = name
+		if host, err := os.Hostname(); err == nil && host != "" {
+			id = name + "-" + host
+		}
+	}
+
+	deregisterAfter := "10m"
+	if os.Getenv("CONSUL_DEREGISTER_AFTER") != "" {
+		deregisterAfter = os.Getenv("CONSUL_DEREGISTER_AFTER")
+	}
+
+	n, _ := strconv.Atoi(port)
+
+	registration := map[string]any{
+		"ID":      id,
+		"Name":    name,
+		"Address": os.Getenv("CONSUL_SERVICE_ADDRESS"),
+		"Port":    n,
+		"Tags": strings.FieldsFunc(os.Getenv("CONSUL_SERVICE_TAGS"), func(r rune) bool {
+			return r == ',' || r == ';' || r == ' '
+		}),
+		"Meta": map[string]string{"domain": dnsDomain()},
+		"Check": map[string]string{
+			"CheckID":                        "service:" + id,
+			"Name":                           "DNS query for " + dnsDomain(),
+			"TTL":                            (3 * interval).String(),
+			"DeregisterCriticalServiceAfter": deregisterAfter,
+		},
+	}
+
+	if _, err = consulCall(http.MethodPut, "/v1/agent/service/register", registration); err != nil {
+		return fmt.Errorf("Failed to register %s with Consul: %w", id, err)
+	}
+
+	consulServiceID = id
+
+	log.Info("Registered with Consul", "phase", "consul", "id", id, "port", port, "interval", interval)
+
+	// In supervise mode superviseNamed owns the termination signals and deregisters
+	// before exiting.
+	if !superviseMode {
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
+		go func() {
+			<-term
+			deregisterConsulService()
+			os.Exit(0)
+		}()
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			status, output := "passing", "BIND answered for "+dnsDomain()
+
+			answer, err := queryDNS(upstream{IP: "127.0.0.1", Port: port}, dnsQuery{Name: dnsDomain(), Type: dnsmessage.TypeSOA})
+			if err != nil {
+				status, output = "critical", err.Error()
+			} else if answer.RCode != dnsmessage.RCodeSuccess {
+				status, output = "critical", "BIND answered "+answer.RCode.String()
+			}
+
+			code, err := consulCall(http.MethodPut, "/v1/agent/check/update/service:"+id, map[string]string{"Status": status, "Output": output})
+			if code == http.StatusNotFound {
+				// The agent has lost the registration, typically after a restart.
+				_, err = consulCall(http.MethodPut, "/v1/agent/service/register", registration)
+			}
+
+			if err != nil {
+				log.Warn("Failed to update Consul health check", "phase", "consul", "id", id, "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// deregisterConsulService removes this instance from Consul, if it was registered.
+func deregisterConsulService() {
+	if consulServiceID == "" {
+		return
+	}
+
+	if _, err := consulCall(http.MethodPut, "/v1/agent/service/deregister/"+consulServiceID, nil); err != nil {
+		log.Warn("Failed to deregister from Consul", "phase", "consul", "id", consulServiceID, "error", err)
+		return
+	}
+
+	log.Info("Deregistered from Consul", "phase", "consul", "id", consulServiceID)
+}
@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// regenerateRequest describes an out-of-band regeneration, optionally preceded by a
+// fresh fetch of cache_domains.
+type regenerateRequest struct {
+	reason string
+	fetch  bool
+}
+
+// regenerateRequests carries out-of-band regeneration requests to the daemon loop.
+var regenerateRequests = make(chan regenerateRequest, 1)
+
+// requestRegeneration asks a running daemon to regenerate the configuration. Requests
+// arriving while one is already pending are coalesced.
+func requestRegeneration(reason string) {
+	select {
+	case regenerateRequests <- regenerateRequest{reason: reason}:
+	default:
+	}
+}
+
+// requestRefresh asks a running daemon to fetch cache_domains and then regenerate.
+func requestRefresh(reason string) {
+	select {
+	case regenerateRequests <- regenerateRequest{reason: reason, fetch: true}:
+	default:
+	}
+}
+
+// runDaemon periodically re-fetches cache_domains and regenerates and reloads BIND
+// whenever the upstream content has changed.
+func runDaemon(dns []upstream, interval time.Duration) {
+	log.Info("Running in daemon mode", "phase", "daemon", "interval", interval)
+
+	if err := startHTTPServer(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startGRPCServer(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startDoHProxy(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startECSProxy(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startPprof(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startConsulRegistration(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := startMDNS(); err != nil {
+		log.Fatal(err)
+	}
+
+	startStatsExport()
+	startHealthChecks()
+	startDriftMonitor()
+	startScheduler()
+	watchDockerEvents()
+	watchConfigSource()
+	startSmokeTest("startup")
+
+	revision := cacheDomainsRevision()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-hup:
+			log.Info("Received SIGHUP, reloading configuration", "phase", "daemon")
+
+			if err := loadEnvFile(); err != nil {
+				log.Error("Failed to read environment file", "file", os.Getenv("DNSTOOL_ENV_FILE"), "error", err)
+			}
+
+			if _, err := loadConfigSource(); err != nil {
+				log.Error("Failed to read configuration source", "phase", "config", "error", err)
+			}
+
+			dns = reloadUpstreams(dns)
+
+			if err := bootstrapDNS(); err != nil {
+				log.Error("Failed to refresh cache_domains", "phase", "bootstrap", "error", err)
+			}
+
+			revision = cacheDomainsRevision()
+
+			refreshLancacheDNS(dns, "SIGHUP")
+		case <-ticker.C:
+			if err := bootstrapDNS(); err != nil {
+				log.Error("Failed to refresh cache_domains", "phase", "bootstrap", "error", err)
+				continue
+			}
+
+			current := cacheDomainsRevision()
+			if current == revision {
+				log.Info("cache_domains unchanged, skipping regeneration", "phase", "daemon", "revision", revision)
+				continue
+			}
+
+			log.Info("cache_domains changed", "phase", "daemon", "from", revision, "to", current)
+			revision = current
+
+			refreshLancacheDNS(dns, "interval")
+		case req := <-regenerateRequests:
+			if req.fetch {
+				if err := bootstrapDNS(); err != nil {
+					log.Error("Failed to refresh cache_domains", "phase", "bootstrap", "error", err)
+				}
+
+				revision = cacheDomainsRevision()
+			}
+
+			// The configuration source may have changed the upstreams.
+			dns = reloadUpstreams(dns)
+
+			refreshLancacheDNS(dns, req.reason)
+		}
+	}
+}
+
+// reloadUpstreams reads the upstreams from the environment again once it may have
+// changed, rewriting resolv.conf and starting the DNS-over-HTTPS proxy when they differ
+// from dns. The previous upstreams are kept when the new ones cannot be used.
+func reloadUpstreams(dns []upstream) []upstream {
+	current, err := configuredUpstreams()
+	if err == nil {
+		err = checkUpstreamLoops(current)
+	}
+
+	if err != nil {
+		log.Error("Failed to reload the upstreams, keeping the previous ones", "phase", "config", "error", err)
+		return dns
+	}
+
+	if slices.Equal(current, dns) {
+		return dns
+	}
+
+	log.Info("Upstreams changed", "phase", "config", "upstream", forwarderList(current))
+
+	if err = writeResolverConfiguration(current); err != nil {
+		log.Error("Failed to configure resolv.conf", "phase", "config", "error", err)
+	}
+
+	if err = startDoHProxy(); err != nil {
+		log.Error("Failed to start the DNS-over-HTTPS proxy", "phase", "config", "error", err)
+	}
+
+	return current
+}
+
+// refreshLancacheDNS regenerates the configuration and reloads BIND, logging rather
+// than exiting on failure so that the daemon keeps serving the previous configuration.
+func refreshLancacheDNS(dns []upstream, reason string) {
+	log.Info("Regenerating configuration", "phase", "generate", "reason", reason)
+
+	if err := regenerateLancacheDNS(dns, reason); err != nil {
+		log.Error("Failed to regenerate configuration", "phase", "generate", "error", err)
+		return
+	}
+
+	if err := reloadBIND(); err != nil {
+		log.Error("Failed to reload BIND", "phase", "reload", "error", err)
+		return
+	}
+
+	if os.Getenv("ECS_PROXY_LISTEN") != "" {
+		if err := refreshECSViews(); err != nil {
+			log.Error("Failed to refresh the views of the ECS proxy", "phase", "reload", "error", err)
+		}
+	}
+
+	startSmokeTest(reason)
+}
+
+// envFileKeys are the variables last applied from DNSTOOL_ENV_FILE along with the values
+// they had before, nil when unset, so that those deleted from the file can be restored.
+var envFileKeys = struct {
+	sync.Mutex
+	previous map[string]*string
+}{previous: map[string]*string{}}
+
+// loadEnvFile applies KEY=VALUE lines from DNSTOOL_ENV_FILE to the process environment,
+// allowing configuration to be changed without restarting a long-running process.
+// Variables applied by an earlier load but since deleted from the file are returned to
+// the value they had before, or unset.
+func loadEnvFile() error {
+	path := os.Getenv("DNSTOOL_ENV_FILE")
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer func(f *os.File) {
+		if err = f.Close(); err != nil {
+			log.Fatalf("error while closing resource %s: %v", f.Name(), err)
+		}
+	}(f)
+
+	envFileKeys.Lock()
+	defer envFileKeys.Unlock()
+
+	applied := map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+
+		key = strings.TrimSpace(key)
+		if _, tracked := envFileKeys.previous[key]; !tracked {
+			if v, ok := os.LookupEnv(key); ok {
+				envFileKeys.previous[key] = &v
+			} else {
+				envFileKeys.previous[key] = nil
+			}
+		}
+
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		if err = os.Setenv(key, value); err != nil {
+			return err
+		}
+
+		applied[key] = true
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	for key, previous := range envFileKeys.previous {
+		if applied[key] {
+			continue
+		}
+
+		if previous == nil {
+			_ = os.Unsetenv(key)
+		} else {
+			_ = os.Setenv(key, *previous)
+		}
+
+		delete(envFileKeys.previous, key)
+	}
+
+	return nil
+}
+
+// cacheDomainsRevision identifies the current cache_domains content, preferring the git
+// commit and falling back to a hash of the index file for non-git copies.
+func cacheDomainsRevision() string {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = domainsPath
+
+	if out, err := cmd.Output(); err == nil {
+		return strings.TrimSpace(string(out))
+	}
+
+	f, err := os.ReadFile(domainsPath + "/" + cacheDomain)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(f)
+
+	return hex.EncodeToString(sum[:])
+}
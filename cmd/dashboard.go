@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardPage is a static page driving the admin API from the browser.
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+func init() {
+	httpMux.HandleFunc("GET /{$}", handleDashboard)
+}
+
+func handleDashboard(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if _, err := w.Write(dashboardPage); err != nil {
+		log.Error("Failed to write dashboard", "error", err)
+	}
+}
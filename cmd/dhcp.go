@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	dhcpFormat  string
+	dhcpServers string
+	dhcpOutput  string
+)
+
+// dhcpFormats renders the DNS server option for each supported DHCP server.
+var dhcpFormats = map[string]func(w io.Writer, servers []string){
+	"dnsmasq": func(w io.Writer, servers []string) {
+		fmt.Fprintln(w, "# Advertise lancache-dns as the DNS server (option 6)")
+		fmt.Fprintf(w, "dhcp-option=option:dns-server,%s\n", strings.Join(servers, ","))
+	},
+	"isc": func(w io.Writer, servers []string) {
+		fmt.Fprintln(w, "# Advertise lancache-dns as the DNS server (option 6)")
+		fmt.Fprintf(w, "option domain-name-servers %s;\n", strings.Join(servers, ", "))
+	},
+	"kea": func(w io.Writer, servers []string) {
+		fmt.Fprintln(w, `// Advertise lancache-dns as the DNS server (option 6), for the "option-data"`)
+		fmt.Fprintln(w, "// list of Dhcp4 or of a subnet4")
+		fmt.Fprintf(w, "{ \"name\": \"domain-name-servers\", \"code\": 6, \"space\": \"dhcp4\", \"data\": \"%s\" }\n", strings.Join(servers, ", "))
+	},
+}
+
+// dhcpFiles names the snippet written for each format with --output.
+var dhcpFiles = map[string]string{
+	"dnsmasq": "lancache-dns.dnsmasq.conf",
+	"isc":     "lancache-dns.dhcpd.conf",
+	"kea":     "lancache-dns.kea.json",
+}
+
+var dhcpCmd = &cobra.Command{
+	Use:   "dhcp",
+	Short: "Generate DHCP snippets advertising lancache-dns",
+	Long:  `Generate dnsmasq, ISC dhcpd or Kea configuration snippets advertising the lancache-dns addresses as the network's DNS servers (option 6)`,
+	Run: func(_ *cobra.Command, _ []string) {
+		if err := generateDHCP(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	generateCmd.AddCommand(dhcpCmd)
+
+	dhcpCmd.Flags().StringVar(&dhcpFormat, "format", "all", "Snippet format: dnsmasq, isc, kea or all")
+	dhcpCmd.Flags().StringVar(&dhcpServers, "servers", "", "DNS server addresses to advertise, defaulting to DHCP_DNS_SERVERS, BIND_LISTEN or the primary address")
+	dhcpCmd.Flags().StringVar(&dhcpOutput, "output", "", "Directory to write the snippets to instead of printing them")
+}
+
+func generateDHCP() error {
+	formats := []string{"dnsmasq", "isc", "kea"}
+	if dhcpFormat != "all" {
+		if _, ok := dhcpFormats[dhcpFormat]; !ok {
+			return fmt.Errorf("DHCP format: %s is not one of dnsmasq, isc, kea or all", dhcpFormat)
+		}
+
+		formats = []string{dhcpFormat}
+	}
+
+	list := dhcpServers
+	if list == "" {
+		list = os.Getenv("DHCP_DNS_SERVERS")
+	}
+
+	servers, err := advertisedAddresses(list)
+	if err != nil {
+		return err
+	}
+
+	for _, format := range formats {
+		if dhcpOutput == "" {
+			if len(formats) > 1 {
+				fmt.Printf("--- %s ---\n", format)
+			}
+
+			dhcpFormats[format](os.Stdout, servers)
+
+			continue
+		}
+
+		path := filepath.Join(dhcpOutput, dhcpFiles[format])
+
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		dhcpFormats[format](f, servers)
+
+		if err = f.Close(); err != nil {
+			return err
+		}
+
+		log.Info("Wrote DHCP snippet", "phase", "dhcp", "format", format, "file", path)
+	}
+
+	return nil
+}
+
+// advertisedAddresses returns the IPv4 addresses lancache-dns is reachable at, taken
+// from list when set, then the concrete addresses of BIND_LISTEN, and finally the
+// address of the interface carrying the default route.
+func advertisedAddresses(list string) ([]string, error) {
+	entries := cleanIP(strings.ReplaceAll(list, ",", " "))
+
+	if len(entries) == 0 && os.Getenv("BIND_LISTEN") != "" {
+		addrs, err := listenAddresses(cleanIP(os.Getenv("BIND_LISTEN")), false)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil && !ip.IsLoopback() {
+				entries = append(entries, a)
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		// Connecting a UDP socket sends nothing but selects the outbound address.
+		conn, err := net.Dial("udp4", "192.0.2.1:53")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to determine the lancache-dns address: %w", err)
+		}
+
+		entries = append(entries, conn.LocalAddr().(*net.UDPAddr).IP.String())
+		_ = conn.Close()
+	}
+
+	servers := make([]string, 0, len(entries))
+
+	for _, e := range entries {
+		ip := net.ParseIP(e)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("DNS server address: %s is not an IPv4 address", e)
+		}
+
+		servers = append(servers, ip.String())
+	}
+
+	return servers, nil
+}
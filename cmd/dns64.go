@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// dns64Configuration returns the dns64 statement for DNS64_PREFIX, letting IPv6-only
+// clients reach the IPv4-only cache through NAT64. Intercepted domains only have the
+// cache's A records, so their AAAA answers are always synthesised from the cache
+// address rather than leaking the origin's IPv6 address. DNS64_CLIENTS limits which
+// clients get synthesised answers and DNS64_EXCLUDE lists AAAA prefixes to ignore.
+func dns64Configuration() (string, error) {
+	prefix := os.Getenv("DNS64_PREFIX")
+	if prefix == "" {
+		return "", nil
+	}
+
+	ip, n, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil {
+		return "", fmt.Errorf("DNS64_PREFIX value: %s is not a valid IPv6 prefix", prefix)
+	}
+
+	switch ones, _ := n.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return "", fmt.Errorf("DNS64_PREFIX value: %s must be a /32, /40, /48, /56, /64 or /96", prefix)
+	}
+
+	clients := []string{"any"}
+	if c := cleanIP(os.Getenv("DNS64_CLIENTS")); len(c) > 0 {
+		clients = c
+	}
+
+	conf := prefix + " { clients { " + strings.Join(clients, "; ") + "; };"
+
+	if exclude := cleanIP(os.Getenv("DNS64_EXCLUDE")); len(exclude) > 0 {
+		conf += " exclude { " + strings.Join(exclude, "; ") + "; };"
+	}
+
+	return conf + " }", nil
+}
@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsAnswer is the part of a DNS response the tool inspects.
+type dnsAnswer struct {
+	RCode         dnsmessage.RCode
+	Addrs         []string
+	CNAMEs        []string
+	Authenticated bool
+	Signed        bool
+	Types         []dnsmessage.Type
+	Serial        uint32
+}
+
+// dnsQuery describes a single lookup sent by queryDNS.
+type dnsQuery struct {
+	Name    string
+	Type    dnsmessage.Type
+	DNSSEC  bool
+	Timeout time.Duration
+}
+
+// queryDNS sends a single query to server, over TLS for DNS-over-TLS upstreams and
+// otherwise over UDP, retrying over TCP when the answer is truncated.
+func queryDNS(server upstream, q dnsQuery) (dnsAnswer, error) {
+	if q.Timeout == 0 {
+		q.Timeout = 2 * time.Second
+	}
+
+	msg, id, err := buildDNSQuery(q)
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+
+	addr := server.address()
+
+	var resp []byte
+
+	if server.TLS != "" {
+		resp, err = exchangeStream(addr, msg, q.Timeout, server.tlsConfig())
+	} else {
+		resp, err = exchangeUDP(addr, msg, q.Timeout)
+		if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+			resp, err = exchangeStream(addr, msg, q.Timeout, nil)
+		}
+	}
+
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+
+	return parseDNSAnswer(resp, id)
+}
+
+// resolverTarget returns the resolver at server, or the local BIND when it is empty.
+func resolverTarget(server string) (upstream, error) {
+	if server != "" {
+		servers, err := parseUpstreams(server)
+		if err != nil {
+			return upstream{}, err
+		}
+
+		if len(servers) != 1 {
+			return upstream{}, fmt.Errorf("--server must be a single resolver")
+		}
+
+		return servers[0], nil
+	}
+
+	port, err := bindPort()
+	if err != nil {
+		return upstream{}, err
+	}
+
+	return upstream{IP: "127.0.0.1", Port: port}, nil
+}
+
+// address returns the host:port the upstream is queried at.
+func (u upstream) address() string {
+	port := u.Port
+	if port == "" {
+		port = "53"
+	}
+
+	return net.JoinHostPort(u.IP, port)
+}
+
+// tlsConfig returns the client TLS configuration for a DNS-over-TLS upstream.
+func (u upstream) tlsConfig() *tls.Config {
+	if u.TLS == "-" {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &tls.Config{ServerName: u.TLS}
+}
+
+func buildDNSQuery(q dnsQuery) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(q.Name, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var idb [2]byte
+	if _, err = rand.Read(idb[:]); err != nil {
+		return nil, 0, err
+	}
+
+	id := binary.BigEndian.Uint16(idb[:])
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true, AuthenticData: q.DNSSEC})
+	b.EnableCompression()
+
+	if err = b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	if err = b.Question(dnsmessage.Question{Name: name, Type: q.Type, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+
+	if err = b.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+
+	var opt dnsmessage.ResourceHeader
+	if err = opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, q.DNSSEC); err != nil {
+		return nil, 0, err
+	}
+
+	if err = b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, 0, err
+	}
+
+	msg, err := b.Finish()
+
+	return msg, id, err
+}
+
+func exchangeUDP(addr string, msg []byte, timeout time.Duration) ([]byte, error) {
+	return exchangeUDPFrom(nil, addr, msg, timeout)
+}
+
+// exchangeUDPFrom is exchangeUDP sending from the local address local, or from any when
+// it is nil.
+func exchangeUDPFrom(local net.IP, addr string, msg []byte, timeout time.Duration) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if local != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: local}
+	}
+
+	conn, err := dialer.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func exchangeStream(addr string, msg []byte, timeout time.Duration, tlsConfig *tls.Config) ([]byte, error) {
+	return exchangeStreamFrom(nil, addr, msg, timeout, tlsConfig)
+}
+
+// exchangeStreamFrom is exchangeStream connecting from the local address local, or from
+// any when it is nil.
+func exchangeStreamFrom(local net.IP, addr string, msg []byte, timeout time.Duration, tlsConfig *tls.Config) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if local != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: local}
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if err = binary.Write(conn, binary.BigEndian, uint16(len(msg))); err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, length)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func parseDNSAnswer(resp []byte, id uint16) (dnsAnswer, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return dnsAnswer{}, err
+	}
+
+	if m.ID != id {
+		return dnsAnswer{}, fmt.Errorf("DNS response ID mismatch")
+	}
+
+	a := dnsAnswer{RCode: m.RCode, Authenticated: m.AuthenticData}
+
+	for _, rr := range m.Answers {
+		a.Types = append(a.Types, rr.Header.Type)
+
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			a.Addrs = append(a.Addrs, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			a.Addrs = append(a.Addrs, net.IP(body.AAAA[:]).String())
+		case *dnsmessage.CNAMEResource:
+			a.CNAMEs = append(a.CNAMEs, strings.TrimSuffix(body.CNAME.String(), "."))
+		case *dnsmessage.SOAResource:
+			a.Serial = body.Serial
+		}
+
+		// RRSIG (46) has no dedicated dnsmessage type.
+		if rr.Header.Type == dnsmessage.Type(46) {
+			a.Signed = true
+		}
+	}
+
+	// Denials from a signed zone carry their signatures in the authority section.
+	for _, rr := range m.Authorities {
+		if rr.Header.Type == dnsmessage.Type(46) {
+			a.Signed = true
+		}
+	}
+
+	return a, nil
+}
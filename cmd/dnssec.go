@@ -0,0 +1,228 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const defaultDNSSECKeyDir = "/var/lib/bind/keys"
+
+// cacheZoneSigning returns the zone options enabling inline signing of the cache zone
+// when CACHE_ZONE_DNSSEC is set. Keys are kept in DNSSEC_KEY_DIR, which should be a
+// persistent volume so that the trust anchor survives container recreation.
+func cacheZoneSigning() (string, error) {
+	if os.Getenv("CACHE_ZONE_DNSSEC") != "true" {
+		return "", nil
+	}
+
+	policy := "default"
+	if os.Getenv("DNSSEC_POLICY") != "" {
+		policy = os.Getenv("DNSSEC_POLICY")
+	}
+
+	keyDir := defaultDNSSECKeyDir
+	if os.Getenv("DNSSEC_KEY_DIR") != "" {
+		keyDir = os.Getenv("DNSSEC_KEY_DIR")
+	}
+
+	if err := os.MkdirAll(keyDir, 0750); err != nil {
+		return "", err
+	}
+
+	log.Info("Signing the cache zone; publish its DNSKEY as a trust anchor on validating clients",
+		"phase", "generate", "policy", policy, "file", keyDir)
+
+	return fmt.Sprintf("\t\tdnssec-policy %s;\n\t\tinline-signing yes;\n\t\tkey-directory \"%s\";\n", policy, keyDir), nil
+}
+
+// dnssecValidation returns the dnssec-validation mode from DNSSEC_VALIDATION, treating
+// the older ENABLE_DNSSEC_VALIDATION=true as auto. An empty string leaves the template's
+// setting alone.
+func dnssecValidation() (string, error) {
+	switch mode := strings.ToLower(os.Getenv("DNSSEC_VALIDATION")); mode {
+	case "auto", "yes", "no":
+		return mode, nil
+	case "":
+		if os.Getenv("ENABLE_DNSSEC_VALIDATION") == "true" {
+			return "auto", nil
+		}
+
+		return "", nil
+	default:
+		return "", fmt.Errorf("DNSSEC_VALIDATION must be auto, yes or no, not %s", mode)
+	}
+}
+
+// trustAnchorsConfiguration includes DNSSEC_TRUST_ANCHORS_FILE, which holds trust-anchors
+// statements for validating private or test zones.
+func trustAnchorsConfiguration() (string, error) {
+	path := os.Getenv("DNSSEC_TRUST_ANCHORS_FILE")
+	if path == "" {
+		return "", nil
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("\tinclude \"%s\";\n", path), nil
+}
+
+// validateExcept returns the permanent negative trust anchors from
+// DNSSEC_NEGATIVE_TRUST_ANCHORS. With DNSSEC_EXCEPT_INTERCEPTED the domains of every
+// enabled service are added, so rewritten answers for signed domains don't SERVFAIL
+// while validation stays on for everything else.
+func validateExcept() string {
+	domains := cleanIP(os.Getenv("DNSSEC_NEGATIVE_TRUST_ANCHORS"))
+
+	if os.Getenv("DNSSEC_EXCEPT_INTERCEPTED") == "true" {
+		if all, err := loadServiceDomains(); err == nil {
+			for _, s := range pendingServices() {
+				if !s.Enabled {
+					continue
+				}
+
+				for _, d := range append(all[s.Name], customDomainsFor(s.Name)...) {
+					domains = append(domains, strings.TrimPrefix(d, "*."))
+				}
+			}
+		} else {
+			log.Warn("Could not read service domains for negative trust anchors", "phase", "finalise", "error", err)
+		}
+	}
+
+	if len(domains) == 0 {
+		return ""
+	}
+
+	slices.Sort(domains)
+	domains = slices.Compact(domains)
+
+	return `{ "` + strings.Join(domains, `"; "`) + `"; }`
+}
+
+// warnSignedDomains looks up, when DNSSEC_CHECK is set, the domains of every enabled
+// service at the first upstream with DNSSEC records requested, and warns about those
+// signed in the real DNS: clients and resolvers downstream that validate will SERVFAIL
+// on the rewritten answers, as the cache addresses carry no valid signature.
+func warnSignedDomains(dns []upstream) error {
+	if os.Getenv("DNSSEC_CHECK") != "true" {
+		return nil
+	}
+
+	var server *upstream
+	for i := range dns {
+		if !dns[i].Proxy {
+			server = &dns[i]
+			break
+		}
+	}
+
+	if server == nil {
+		log.Warn("Not checking intercepted domains for DNSSEC, only the DNS-over-HTTPS proxy is configured", "phase", "dnssec")
+		return nil
+	}
+
+	all, err := loadServiceDomains()
+	if err != nil {
+		return err
+	}
+
+	workers, err := generateWorkers()
+	if err != nil {
+		return err
+	}
+
+	type lookup struct {
+		service, name string
+		signed        bool
+	}
+
+	queue := make(chan lookup)
+	results := make(chan lookup)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for l := range queue {
+				answer, err := queryDNS(*server, dnsQuery{Name: l.name, Type: dnsmessage.TypeA, DNSSEC: true})
+				if err != nil {
+					log.Debug("DNSSEC lookup failed", "phase", "dnssec", "domain", l.name, "error", err)
+				}
+
+				l.signed = err == nil && (answer.Signed || answer.Authenticated)
+				results <- l
+			}
+		}()
+	}
+
+	go func() {
+		for _, s := range pendingServices() {
+			if !s.Enabled {
+				continue
+			}
+
+			names := make([]string, 0)
+			for _, d := range append(all[s.Name], customDomainsFor(s.Name)...) {
+				names = append(names, strings.TrimPrefix(d, "*."))
+			}
+
+			slices.Sort(names)
+
+			for _, name := range slices.Compact(names) {
+				queue <- lookup{service: s.Name, name: name}
+			}
+		}
+
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	signed := map[string][]string{}
+	for l := range results {
+		if l.signed {
+			signed[l.service] = append(signed[l.service], l.name)
+		}
+	}
+
+	if len(signed) == 0 {
+		return nil
+	}
+
+	guidance := "Clients and resolvers downstream that validate DNSSEC will SERVFAIL on the rewritten answers; " +
+		"turn off validation on them or add negative trust anchors for these domains there"
+
+	if mode, _ := dnssecValidation(); mode != "" && mode != "no" && os.Getenv("DNSSEC_EXCEPT_INTERCEPTED") != "true" {
+		guidance += ", and set DNSSEC_EXCEPT_INTERCEPTED=true so that this resolver does not validate them either"
+	}
+
+	if breakDNSSEC, _ := envYesNo("RPZ_BREAK_DNSSEC"); breakDNSSEC != "yes" {
+		guidance += ". Without RPZ_BREAK_DNSSEC=true named leaves their answers unrewritten for clients requesting DNSSEC records, which then bypass the cache"
+	}
+
+	services := make([]string, 0, len(signed))
+	for service := range signed {
+		services = append(services, service)
+	}
+
+	slices.Sort(services)
+
+	for _, service := range services {
+		slices.Sort(signed[service])
+		log.Warn("Intercepted domains are DNSSEC-signed upstream. "+guidance, "phase", "dnssec", "service", service,
+			"upstream", server.address(), "domains", strings.Join(signed[service], ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// minUDPPayload is the largest UDP answer every client accepts (RFC 1035).
+const minUDPPayload = 512
+
+// dnsHandler answers a single DNS message received from a client, tcp being set when it
+// arrived over TCP.
+type dnsHandler func(query []byte, from net.Addr, tcp bool) ([]byte, error)
+
+// serveDNS listens for DNS messages over UDP and TCP on addr, answering each with handle.
+// Failed queries are logged under name and left unanswered, and answers too large for a
+// UDP client are truncated.
+func serveDNS(name, addr string, handle dnsHandler) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+
+	go func() {
+		buf := make([]byte, 65535)
+
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				log.Error(name+" stopped", "error", err)
+				return
+			}
+
+			query := append([]byte(nil), buf[:n]...)
+
+			go func() {
+				answer, err := handle(query, from, false)
+				if err != nil {
+					log.Warn(name+" query failed", "error", err)
+					return
+				}
+
+				_, _ = pc.WriteTo(truncateAnswer(query, answer), from)
+			}()
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Error(name+" stopped", "error", err)
+				return
+			}
+
+			go serveDNSConn(name, conn, handle)
+		}
+	}()
+
+	return nil
+}
+
+// serveDNSConn answers length-prefixed DNS messages received over TCP.
+func serveDNSConn(name string, conn net.Conn, handle dnsHandler) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	for {
+		_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		answer, err := handle(query, conn.RemoteAddr(), true)
+		if err != nil {
+			log.Warn(name+" query failed", "error", err)
+			return
+		}
+
+		if err = binary.Write(conn, binary.BigEndian, uint16(len(answer))); err != nil {
+			return
+		}
+
+		if _, err = conn.Write(answer); err != nil {
+			return
+		}
+	}
+}
+
+// udpPayloadSize returns the largest UDP answer the client sending query accepts: the
+// size advertised by its EDNS OPT record, or 512 bytes without one.
+func udpPayloadSize(query []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return minUDPPayload
+	}
+
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return minUDPPayload
+	}
+
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return minUDPPayload
+		}
+
+		if h.Type == dnsmessage.TypeOPT {
+			return max(minUDPPayload, int(h.Class))
+		}
+
+		if err = p.SkipAdditional(); err != nil {
+			return minUDPPayload
+		}
+	}
+}
+
+// truncateAnswer returns answer as sent over UDP to the client of query: when it is
+// larger than the client accepts, just its header with TC set, its questions and its
+// OPT record, so that the client retries over TCP.
+func truncateAnswer(query, answer []byte) []byte {
+	size := udpPayloadSize(query)
+	if len(answer) <= size {
+		return answer
+	}
+
+	var p dnsmessage.Parser
+
+	h, err := p.Start(answer)
+	if err != nil {
+		return answer
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return answer
+	}
+
+	var (
+		optHeader dnsmessage.ResourceHeader
+		opt       *dnsmessage.OPTResource
+	)
+
+	for opt == nil {
+		rr, err := p.Additional()
+		if err != nil {
+			break
+		}
+
+		optHeader = rr.Header
+		opt, _ = rr.Body.(*dnsmessage.OPTResource)
+	}
+
+	h.Truncated = true
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, size), h)
+	if b.StartQuestions() != nil {
+		return answer
+	}
+
+	for _, q := range questions {
+		if b.Question(q) != nil {
+			return answer
+		}
+	}
+
+	if opt != nil {
+		if b.StartAdditionals() != nil || b.OPTResource(optHeader, *opt) != nil {
+			return answer
+		}
+	}
+
+	truncated, err := b.Finish()
+	if err != nil {
+		return answer
+	}
+
+	return truncated
+}
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDockerSocket = "/var/run/docker.sock"
+
+	dockerServiceLabel = "lancache.service"
+	dockerNetworkLabel = "lancache.network"
+)
+
+// dockerCaches holds the cache IPs of each service discovered from container labels.
+var dockerCaches = struct {
+	sync.Mutex
+	services map[string][]string
+}{}
+
+// dockerDiscovery reports whether cache containers are discovered from Docker.
+func dockerDiscovery() bool {
+	return os.Getenv("DOCKER_DISCOVERY") == "true"
+}
+
+// dockerDiscoveryIPv6 reports whether the IPv6 addresses of cache containers are
+// discovered along with their IPv4 ones, with DOCKER_DISCOVERY_IPV6. Like any cache IP
+// they must be private, so only networks with unique local addresses qualify.
+func dockerDiscoveryIPv6() bool {
+	return os.Getenv("DOCKER_DISCOVERY_IPV6") == "true"
+}
+
+// dockerClient returns an HTTP client talking to the Docker Engine API over
+// DOCKER_SOCKET.
+func dockerClient(timeout time.Duration) *http.Client {
+	socket := defaultDockerSocket
+	if os.Getenv("DOCKER_SOCKET") != "" {
+		socket = os.Getenv("DOCKER_SOCKET")
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// dockerContainer is the part of the container list the discovery reads.
+type dockerContainer struct {
+	Names           []string
+	Labels          map[string]string
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string
+			GlobalIPv6Address string
+		}
+	}
+}
+
+// refreshDockerCaches lists running containers labelled lancache.service=<name>[,<name>]
+// and records their network IPv4 addresses, and IPv6 ones when asked for, as the cache
+// IPs of those services. A container may pick the network to use with the
+// lancache.network label.
+func refreshDockerCaches() error {
+	if !dockerDiscovery() {
+		return nil
+	}
+
+	filters, err := json.Marshal(map[string][]string{"label": {dockerServiceLabel}, "status": {"running"}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := dockerClient(10 * time.Second).Get("http://docker/containers/json?filters=" + url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker API returned %s", resp.Status)
+	}
+
+	var containers []dockerContainer
+	if err = json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+
+	services := map[string][]string{}
+
+	for _, c := range containers {
+		networks := make([]string, 0, len(c.NetworkSettings.Networks))
+		for name := range c.NetworkSettings.Networks {
+			networks = append(networks, name)
+		}
+
+		sort.Strings(networks)
+
+		if n := c.Labels[dockerNetworkLabel]; n != "" {
+			networks = []string{n}
+		}
+
+		var ips []string
+
+		for _, name := range networks {
+			n, ok := c.NetworkSettings.Networks[name]
+			if !ok {
+				continue
+			}
+
+			addrs := []string{n.IPAddress}
+			if dockerDiscoveryIPv6() {
+				addrs = append(addrs, n.GlobalIPv6Address)
+			}
+
+			for _, ip := range addrs {
+				if ip != "" {
+					ips = append(ips, ip)
+				}
+			}
+		}
+
+		if len(ips) == 0 {
+			log.Warn("Cache container has no network address", "phase", "discovery", "container", strings.Join(c.Names, ","))
+			continue
+		}
+
+		for _, service := range strings.Split(c.Labels[dockerServiceLabel], ",") {
+			if service = strings.ToLower(strings.TrimSpace(service)); service != "" {
+				services[service] = append(services[service], ips...)
+			}
+		}
+	}
+
+	dockerCaches.Lock()
+	defer dockerCaches.Unlock()
+
+	dockerCaches.services = services
+
+	return nil
+}
+
+// dockerCacheIP returns the discovered cache IPs of service, space separated, falling
+// back to containers labelled for every service with *.
+func dockerCacheIP(service string) string {
+	dockerCaches.Lock()
+	defer dockerCaches.Unlock()
+
+	if ips, ok := dockerCaches.services[strings.ToLower(service)]; ok {
+		return strings.Join(ips, " ")
+	}
+
+	return strings.Join(dockerCaches.services["*"], " ")
+}
+
+// watchDockerEvents regenerates the configuration whenever a labelled cache container
+// starts or stops, reconnecting to the event stream if it drops.
+func watchDockerEvents() {
+	if !dockerDiscovery() {
+		return
+	}
+
+	filters, err := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die", "stop"},
+		"label": {dockerServiceLabel},
+	})
+	if err != nil {
+		log.Error("Failed to watch Docker events", "phase", "discovery", "error", err)
+		return
+	}
+
+	log.Info("Watching Docker for cache containers", "phase", "discovery")
+
+	go func() {
+		for {
+			if err := streamDockerEvents(string(filters)); err != nil {
+				log.Warn("Docker event stream failed", "phase", "discovery", "error", err)
+			}
+
+			time.Sleep(10 * time.Second)
+		}
+	}()
+}
+
+func streamDockerEvents(filters string) error {
+	resp, err := dockerClient(0).Get("http://docker/events?filters=" + url.QueryEscape(filters))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker API returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event struct {
+			Action string
+			Actor  struct {
+				Attributes map[string]string
+			}
+		}
+
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+
+		requestRegeneration("docker: " + event.Action + " " + event.Actor.Attributes["name"])
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,371 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+var (
+	doctorServer string
+	doctorDomain string
+	doctorMaxAge time.Duration
+	doctorJSON   bool
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnose common lancache-dns problems",
+	Long:  `Check the environment, cache_domains, the generated configuration, named and the upstreams, and whether a cached domain resolves to its cache, printing a checklist to include in support requests`,
+	Run: func(_ *cobra.Command, _ []string) {
+		results := runDoctor()
+
+		if doctorJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err := enc.Encode(results); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "STATUS\tCHECK\tDETAIL\n")
+
+			for _, r := range results {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(r.Status), r.Check, r.Detail)
+			}
+
+			_ = w.Flush()
+		}
+
+		for _, r := range results {
+			if r.Status == doctorFail {
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+func init() {
+	doctorCmd.Flags().StringVar(&doctorServer, "server", "", "Resolver to check, defaulting to 127.0.0.1 on BIND_PORT")
+	doctorCmd.Flags().StringVar(&doctorDomain, "domain", "", "Cache domain the resolver serves, defaulting to LANCACHE_DNSDOMAIN")
+	doctorCmd.Flags().DurationVar(&doctorMaxAge, "max-age", 7*24*time.Hour, "Age beyond which cache_domains is reported as stale")
+	doctorCmd.Flags().BoolVar(&doctorJSON, "json", false, "Output as JSON")
+}
+
+// doctorResult is the outcome of a single check.
+type doctorResult struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// runDoctor runs every check in turn, skipping those that depend on a failed one.
+func runDoctor() []doctorResult {
+	results := make([]doctorResult, 0)
+
+	add := func(check, status, detail string) {
+		results = append(results, doctorResult{Check: check, Status: status, Detail: detail})
+	}
+
+	if err := doctorEnvironment(); err != nil {
+		add("Environment", doctorFail, err.Error())
+	} else if !cacheIPsConfigured() {
+		add("Environment", doctorWarn, "No cache IP is set, set USE_GENERIC_CACHE=true with LANCACHE_IP or <SERVICE>CACHE_IP")
+	} else {
+		add("Environment", doctorPass, fmt.Sprintf("%s layout, cache domain %s", layout.Name, servedDomain(doctorDomain)))
+	}
+
+	if err := checkWritablePaths(); err != nil {
+		add("Writable paths", doctorFail, err.Error())
+	} else {
+		add("Writable paths", doctorPass, "zones in "+zonePath)
+	}
+
+	dns, err := configuredUpstreams()
+	if err != nil {
+		add("Upstream DNS", doctorFail, err.Error())
+	} else {
+		status, detail := doctorUpstreams(dns)
+		add("Upstream DNS", status, detail)
+
+		if err = checkUpstreamLoops(dns); err != nil {
+			add("Forwarding loops", doctorFail, err.Error())
+		} else {
+			add("Forwarding loops", doctorPass, "no upstream points back at this resolver")
+		}
+	}
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		add("cache_domains", doctorFail, err.Error())
+	} else {
+		status, detail := doctorCacheDomains()
+		add("cache_domains", status, fmt.Sprintf("%d services, %s", len(services), detail))
+	}
+
+	if path, err := exec.LookPath("named-checkconf"); err != nil {
+		add("Configuration syntax", doctorSkip, "named-checkconf is not installed")
+	} else if out, err := exec.Command(path, "-z", layout.MainConf).CombinedOutput(); err != nil {
+		add("Configuration syntax", doctorFail, lastLine(out, err))
+	} else {
+		add("Configuration syntax", doctorPass, layout.MainConf+" and its zones load")
+	}
+
+	server, err := resolverTarget(doctorServer)
+	if err != nil {
+		add("named answering", doctorFail, err.Error())
+		return results
+	}
+
+	domain := servedDomain(doctorDomain)
+
+	started := time.Now()
+	if _, err = queryDNS(server, dnsQuery{Name: domain, Type: dnsmessage.TypeSOA}); err != nil {
+		add("named answering", doctorFail, fmt.Sprintf("%s: %s%s", server.address(), err, doctorPortHint(server)))
+		add("Intercepted domain", doctorSkip, "named is not answering")
+		add("External domain", doctorSkip, "named is not answering")
+
+		return results
+	}
+
+	add("named answering", doctorPass, fmt.Sprintf("%s answered in %s", server.address(), time.Since(started).Round(time.Millisecond)))
+
+	cacheIPs := map[string]bool{}
+
+	if services == nil {
+		add("Intercepted domain", doctorSkip, "cache_domains could not be read")
+	} else {
+		status, detail := doctorIntercepted(server, domain, services, cacheIPs)
+		add("Intercepted domain", status, detail)
+	}
+
+	status, detail := doctorExternal(server, cacheIPs)
+	add("External domain", status, detail)
+
+	return results
+}
+
+// doctorEnvironment validates the configuration read from the environment.
+func doctorEnvironment() error {
+	if err := loadEnvFile(); err != nil {
+		return err
+	}
+
+	if _, err := loadConfigSource(); err != nil {
+		return err
+	}
+
+	if err := configurePaths(); err != nil {
+		return err
+	}
+
+	useGenericCache := "false"
+	if os.Getenv("USE_GENERIC_CACHE") != "" {
+		useGenericCache = os.Getenv("USE_GENERIC_CACHE")
+	}
+
+	if err := checkGenericCache(useGenericCache, os.Getenv("LANCACHE_IP")); err != nil {
+		return err
+	}
+
+	if _, err := bindPort(); err != nil {
+		return err
+	}
+
+	if _, err := generateWorkers(); err != nil {
+		return err
+	}
+
+	if _, err := newServicePolicy(); err != nil {
+		return err
+	}
+
+	_, _, err := zoneLimits()
+
+	return err
+}
+
+// cacheIPsConfigured reports whether any cache IP is set, LANCACHE_IP for the generic
+// cache or <SERVICE>CACHE_IP for individual services.
+func cacheIPsConfigured() bool {
+	for _, e := range os.Environ() {
+		key, value, _ := strings.Cut(e, "=")
+		if strings.HasSuffix(key, "CACHE_IP") && value != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// doctorUpstreams queries each upstream for UPSTREAM_CHECK_NAME.
+func doctorUpstreams(dns []upstream) (string, string) {
+	ok, failed := make([]string, 0), make([]string, 0)
+
+	for _, u := range dns {
+		if u.Proxy {
+			continue
+		}
+
+		if _, err := queryDNS(u, dnsQuery{Name: upstreamCheckName(), Type: dnsmessage.TypeA}); err != nil {
+			failed = append(failed, u.address())
+			continue
+		}
+
+		ok = append(ok, u.address())
+	}
+
+	switch {
+	case len(ok) == 0 && len(failed) == 0:
+		return doctorSkip, "only the DNS-over-HTTPS proxy is configured"
+	case len(ok) == 0:
+		return doctorFail, "none responded: " + strings.Join(failed, ", ")
+	case len(failed) > 0:
+		return doctorWarn, strings.Join(ok, ", ") + " responded, " + strings.Join(failed, ", ") + " did not"
+	}
+
+	return doctorPass, strings.Join(ok, ", ") + " responded"
+}
+
+// doctorCacheDomains reports how recently the cache_domains clone was updated.
+func doctorCacheDomains() (string, string) {
+	if fileExists(domainsPath + "/" + snapshotMarker) {
+		return doctorWarn, "using the embedded offline snapshot as " + domainsPath + " could not be cloned"
+	}
+
+	if !fileExists(domainsPath + "/.git") {
+		return doctorWarn, domainsPath + " is not a git clone and is not updated"
+	}
+
+	cmd := exec.Command("git", "log", "-1", "--format=%ct %h")
+	cmd.Dir = domainsPath
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return doctorFail, "git log: " + lastLine(out, err)
+	}
+
+	committed, commit, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+
+	seconds, err := strconv.ParseInt(committed, 10, 64)
+	if err != nil {
+		return doctorFail, "git log: " + err.Error()
+	}
+
+	age := time.Since(time.Unix(seconds, 0)).Round(time.Minute)
+	if age > doctorMaxAge {
+		return doctorWarn, fmt.Sprintf("last commit %s is %s old, check the clone is being fetched", commit, age)
+	}
+
+	return doctorPass, fmt.Sprintf("at commit %s from %s ago", commit, age)
+}
+
+// doctorPortHint explains a resolver that does not answer when another process holds
+// its port.
+func doctorPortHint(server upstream) string {
+	if server.Port == "" || !net.ParseIP(server.IP).IsLoopback() {
+		return ""
+	}
+
+	owners, err := dnsPortOwners(server.Port)
+	if err != nil {
+		return ""
+	}
+
+	for _, o := range owners {
+		if o.Process != "" && o.Process != "named" {
+			return fmt.Sprintf(", port %s is held by %s: %s", server.Port, o.Process, portConflictHint(o.Process))
+		}
+	}
+
+	if len(owners) == 0 {
+		return ", nothing is listening on port " + server.Port
+	}
+
+	return ""
+}
+
+// doctorIntercepted resolves a domain of the first service answered with a cache,
+// checking the answer holds only its cache addresses, which are added to cacheIPs.
+func doctorIntercepted(server upstream, domain string, services serviceDomains, cacheIPs map[string]bool) (string, string) {
+	names, expected := interceptedNames(server, domain, services)
+	if len(names) == 0 {
+		return doctorFail, fmt.Sprintf("no service is answered with a cache under %s, check generation completed", domain)
+	}
+
+	for _, ips := range expected {
+		for ip := range ips {
+			cacheIPs[ip] = true
+		}
+	}
+
+	sample := names[0]
+
+	answer, err := queryDNS(server, dnsQuery{Name: sample.name, Type: dnsmessage.TypeA})
+	if err != nil {
+		return doctorFail, sample.name + ": " + err.Error()
+	}
+
+	for _, a := range answer.Addrs {
+		if !expected[sample.service][a] {
+			return doctorFail, fmt.Sprintf("%s resolved to %s rather than the %s cache", sample.name, strings.Join(answer.Addrs, ", "), sample.service)
+		}
+	}
+
+	if len(answer.Addrs) == 0 {
+		return doctorFail, fmt.Sprintf("%s was not answered with an address (%s)", sample.name, answer.RCode)
+	}
+
+	return doctorPass, fmt.Sprintf("%s resolved to %s (%s)", sample.name, strings.Join(answer.Addrs, ", "), sample.service)
+}
+
+// doctorExternal resolves UPSTREAM_CHECK_NAME through the resolver, which must be
+// forwarded rather than answered with a cache.
+func doctorExternal(server upstream, cacheIPs map[string]bool) (string, string) {
+	name := upstreamCheckName()
+
+	answer, err := queryDNS(server, dnsQuery{Name: name, Type: dnsmessage.TypeA})
+	if err != nil {
+		return doctorFail, name + ": " + err.Error()
+	}
+
+	if answer.RCode != dnsmessage.RCodeSuccess || len(answer.Addrs) == 0 {
+		return doctorFail, fmt.Sprintf("%s was not answered with an address (%s), check the upstreams", name, answer.RCode)
+	}
+
+	for _, a := range answer.Addrs {
+		if cacheIPs[a] {
+			return doctorWarn, fmt.Sprintf("%s resolved to the cache address %s, it should not be intercepted", name, a)
+		}
+	}
+
+	return doctorPass, fmt.Sprintf("%s resolved to %s", name, strings.Join(answer.Addrs, ", "))
+}
+
+// lastLine returns the last line of a command's output, or its error when it printed
+// nothing.
+func lastLine(out []byte, err error) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if lines[len(lines)-1] == "" {
+		return err.Error()
+	}
+
+	return lines[len(lines)-1]
+}
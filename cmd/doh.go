@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultDoHListen = "127.0.0.1:5053"
+
+	dohTimeout = 5 * time.Second
+)
+
+var dohProxyCmd = &cobra.Command{
+	Use:   "doh-proxy",
+	Short: "Run a local DNS-over-HTTPS forwarding proxy",
+	Long:  `Listen for plain DNS queries on DOH_PROXY_LISTEN and forward them to UPSTREAM_DOH over HTTPS`,
+	Run: func(cmd *cobra.Command, _ []string) {
+		if os.Getenv("UPSTREAM_DOH") == "" {
+			log.Fatal("UPSTREAM_DOH must be set")
+		}
+
+		configureProxy()
+
+		if err := startDoHProxy(); err != nil {
+			log.Fatal(err)
+		}
+
+		select {}
+	},
+}
+
+// dohListen returns the local address the DNS-over-HTTPS proxy listens on.
+func dohListen() string {
+	if os.Getenv("DOH_PROXY_LISTEN") != "" {
+		return os.Getenv("DOH_PROXY_LISTEN")
+	}
+
+	return defaultDoHListen
+}
+
+// dohUpstream returns the upstream named forwards to when UPSTREAM_DOH is set.
+func dohUpstream() (upstream, error) {
+	host, port, err := net.SplitHostPort(dohListen())
+	if err != nil {
+		return upstream{}, err
+	}
+
+	return upstream{IP: host, Port: port, Proxy: true}, nil
+}
+
+// dohProxyStarted is set once the DNS-over-HTTPS proxy is listening.
+var dohProxyStarted atomic.Bool
+
+// startDoHProxy serves plain DNS over UDP and TCP on dohListen, relaying each query to
+// UPSTREAM_DOH as an RFC 8484 POST request. UPSTREAM_DOH is read for every query, so
+// that a reloaded configuration applies to a proxy already running, and the proxy is
+// started by the first call after it has been set.
+func startDoHProxy() error {
+	if os.Getenv("UPSTREAM_DOH") == "" || dohProxyStarted.Load() {
+		return nil
+	}
+
+	client := dohClient()
+	addr := dohListen()
+
+	err := serveDNS("DNS-over-HTTPS proxy", addr, func(query []byte, _ net.Addr, _ bool) ([]byte, error) {
+		url := os.Getenv("UPSTREAM_DOH")
+		if url == "" {
+			return nil, fmt.Errorf("UPSTREAM_DOH is no longer set")
+		}
+
+		return dohExchange(client, url, query)
+	})
+	if err != nil {
+		return err
+	}
+
+	dohProxyStarted.Store(true)
+
+	log.Info("DNS-over-HTTPS proxy listening", "listen", addr, "upstream", os.Getenv("UPSTREAM_DOH"))
+
+	return nil
+}
+
+// dohExchange sends a single DNS message to the DoH server and returns its answer.
+func dohExchange(client *http.Client, url string, query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// dohClient returns the HTTP client used for DoH. When DOH_BOOTSTRAP_IP is set the DoH
+// server is dialled at that address, avoiding the need to resolve its hostname via
+// the resolver that is itself forwarding to the proxy.
+func dohClient() *http.Client {
+	transport := fetchClient().Transport.(*http.Transport)
+	transport.ForceAttemptHTTP2 = true
+
+	if ip := os.Getenv("DOH_BOOTSTRAP_IP"); ip != "" {
+		dialer := &net.Dialer{Timeout: dohTimeout}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		}
+	}
+
+	return &http.Client{Timeout: dohTimeout, Transport: transport}
+}
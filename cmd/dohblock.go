@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"dnstool/pkg/dnsgen"
+)
+
+const dohCanaryDomain = "use-application-dns.net"
+
+// dohProviders lists well known public DoH and DoT endpoints and their addresses.
+//
+//go:embed doh-providers.txt
+var dohProviders string
+
+func init() {
+	httpMux.HandleFunc("GET /doh-blocklist.txt", handleDoHBlocklist)
+}
+
+// generateDoHCanary answers NXDOMAIN for the DoH canary domain, plus any listed in
+// DOH_CANARY_DOMAINS, when BLOCK_DOH_CANARY is enabled. Browsers check the canary before
+// turning on DNS-over-HTTPS by default, so blocking it keeps them on the lancache resolver.
+func generateDoHCanary() error {
+	if os.Getenv("BLOCK_DOH_CANARY") != "true" {
+		return nil
+	}
+
+	f := appendZoneFile(rpzZone)
+
+	if _, err := fmt.Fprintln(f, `;## DoH canary`); err != nil {
+		return err
+	}
+
+	for _, domain := range append([]string{dohCanaryDomain}, cleanIP(os.Getenv("DOH_CANARY_DOMAINS"))...) {
+		if err := dnsgen.WriteRewrites(f, domain, []string{"CNAME ."}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dohBlocklist returns the hostnames and addresses of public DoH and DoT providers, from
+// the bundled list and DOH_BLOCKLIST_FILE. The host used by UPSTREAM_DOH and the
+// upstreams named forwards to are left out so that resolution keeps working.
+func dohBlocklist() ([]string, []string, error) {
+	lists := []string{dohProviders}
+
+	if path := os.Getenv("DOH_BLOCKLIST_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		lists = append(lists, string(b))
+	}
+
+	own, err := forwarderAddresses()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if u, err := url.Parse(os.Getenv("UPSTREAM_DOH")); err == nil && u.Hostname() != "" {
+		own[u.Hostname()] = true
+	}
+
+	var hosts, ips []string
+
+	for _, list := range lists {
+		scanner := bufio.NewScanner(strings.NewReader(list))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || own[fields[0]] {
+				continue
+			}
+
+			if err := isIP(fields[1:]); err != nil {
+				return nil, nil, err
+			}
+
+			hosts = append(hosts, fields[0])
+
+			for _, ip := range fields[1:] {
+				if !own[net.ParseIP(ip).String()] {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+
+	slices.Sort(hosts)
+	slices.Sort(ips)
+
+	return slices.Compact(hosts), slices.Compact(ips), nil
+}
+
+// forwarderAddresses returns the addresses, and the DNS-over-TLS hostnames, of the
+// upstreams of UPSTREAM_DNS and of every forward zone.
+func forwarderAddresses() (map[string]bool, error) {
+	dns, err := configuredUpstreams()
+	if err != nil {
+		return nil, err
+	}
+
+	zones, err := forwardZones()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, servers := range zones {
+		dns = append(dns, servers...)
+	}
+
+	own := map[string]bool{}
+
+	for _, u := range dns {
+		if u.Proxy {
+			continue
+		}
+
+		if ip := net.ParseIP(u.IP); ip != nil {
+			own[ip.String()] = true
+		}
+
+		if u.TLS != "" && u.TLS != "-" {
+			own[u.TLS] = true
+		}
+	}
+
+	return own, nil
+}
+
+// generateDoHBlocklist answers NXDOMAIN for public DoH and DoT providers when
+// BLOCK_DOH_PROVIDERS is enabled, and writes their addresses to DOH_BLOCKLIST_EXPORT
+// for use in firewall rules.
+func generateDoHBlocklist() error {
+	export := os.Getenv("DOH_BLOCKLIST_EXPORT")
+	if os.Getenv("BLOCK_DOH_PROVIDERS") != "true" && export == "" {
+		return nil
+	}
+
+	hosts, ips, err := dohBlocklist()
+	if err != nil {
+		return err
+	}
+
+	if export != "" {
+		if err = os.WriteFile(export, []byte(strings.Join(ips, "\n")+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+
+	if os.Getenv("BLOCK_DOH_PROVIDERS") != "true" {
+		return nil
+	}
+
+	f := appendZoneFile(rpzZone)
+
+	if _, err = fmt.Fprintln(f, `;## DoH and DoT providers`); err != nil {
+		return err
+	}
+
+	for _, host := range hosts {
+		if err = dnsgen.WriteRewrites(f, host, []string{"CNAME ."}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleDoHBlocklist serves the addresses of public DoH and DoT providers, one per line.
+func handleDoHBlocklist(w http.ResponseWriter, _ *http.Request) {
+	_, ips, err := dohBlocklist()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	for _, ip := range ips {
+		_, _ = fmt.Fprintln(w, ip)
+	}
+}
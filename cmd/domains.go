@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"dnstool/pkg/dnsgen"
+)
+
+// serviceDomains maps a service name to the domains listed in its domain files.
+type serviceDomains map[string][]string
+
+// loadServiceDomains reads every service and its domain files from cache_domains.
+func loadServiceDomains() (serviceDomains, error) {
+	loaded, err := dnsgen.LoadCacheDomains(os.DirFS(domainsPath))
+	if err != nil {
+		return nil, err
+	}
+
+	services := serviceDomains{}
+	for _, s := range loaded {
+		services[s.Name] = s.Domains
+	}
+
+	return services, nil
+}
+
+// names returns the service names in sorted order.
+func (s serviceDomains) names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// has reports whether service is in s.
+func (s serviceDomains) has(service string) bool {
+	_, ok := s[service]
+	return ok
+}
+
+// validDomainName reports whether domain is a DNS name that can be intercepted, as
+// listed in a domain file: letters, digits, hyphens and underscores in labels of up to
+// 63 characters, optionally under a leading *. wildcard.
+func validDomainName(domain string) bool {
+	domain = strings.TrimSuffix(strings.TrimPrefix(domain, "*."), ".")
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// domainIndex matches query names against service domains, including wildcards.
+type domainIndex struct {
+	exact    map[string]string
+	wildcard map[string]string
+}
+
+func newDomainIndex(services serviceDomains) domainIndex {
+	idx := domainIndex{exact: map[string]string{}, wildcard: map[string]string{}}
+
+	for service, domains := range services {
+		for _, d := range domains {
+			if strings.HasPrefix(d, "*.") {
+				idx.wildcard[strings.TrimPrefix(d, "*.")] = service
+			} else {
+				idx.exact[d] = service
+			}
+		}
+	}
+
+	return idx
+}
+
+// lookup returns the service intercepting name and the rule that matched it.
+func (idx domainIndex) lookup(name string) (string, string) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	if service, ok := idx.exact[name]; ok {
+		return service, name
+	}
+
+	for parent := name; ; {
+		i := strings.Index(parent, ".")
+		if i < 0 {
+			return "", ""
+		}
+
+		parent = parent[i+1:]
+		if service, ok := idx.wildcard[parent]; ok {
+			return service, "*." + parent
+		}
+	}
+}
+
+// servedDomain returns domain, or the cache domain of the configuration when it is empty.
+func servedDomain(domain string) string {
+	if domain == "" {
+		domain = dnsDomain()
+	}
+
+	if domain == "" {
+		domain = "cache.lancache.net"
+	}
+
+	return domain
+}
+
+// interceptedName is a domain intercepted for a service.
+type interceptedName struct {
+	name    string
+	service string
+}
+
+// interceptedNames returns the domains of the services server answers with a cache,
+// together with the cache addresses of each service, learned from its record in the
+// cache domain. A name under each wildcard stands in for it.
+func interceptedNames(server upstream, domain string, services serviceDomains) ([]interceptedName, map[string]map[string]bool) {
+	names := make([]interceptedName, 0)
+	expected := map[string]map[string]bool{}
+
+	for _, service := range services.names() {
+		answer, err := queryDNS(server, dnsQuery{Name: service + "." + domain, Type: dnsmessage.TypeA})
+		if err != nil || len(answer.Addrs) == 0 {
+			log.Debug("Service is not cached, leaving it out", "service", service)
+			continue
+		}
+
+		expected[service] = map[string]bool{}
+		for _, a := range answer.Addrs {
+			expected[service][a] = true
+		}
+
+		for _, d := range services[service] {
+			if parent, ok := strings.CutPrefix(d, "*."); ok {
+				d = "dnstool-test." + parent
+			}
+
+			names = append(names, interceptedName{name: d, service: service})
+		}
+	}
+
+	return names, expected
+}
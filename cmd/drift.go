@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var zonestatusSerial = regexp.MustCompile(`(?m)^serial: (\d+)`)
+
+// driftProblems holds the problems found by the previous drift check, keyed by kind, so
+// that each is alerted once when it appears and once when it clears.
+var driftProblems = map[string]string{}
+
+// driftBehindSince is when cache_domains upstream was first seen ahead of the generated
+// revision, or zero while they match.
+var driftBehindSince time.Time
+
+// startDriftMonitor compares, every DRIFT_CHECK_INTERVAL, what the running named serves
+// with what the last generation intended and cache_domains upstream, alerting through
+// the log, NOTIFY_URL and the metrics when answers drift, zones fail to load or the
+// configuration falls behind.
+func startDriftMonitor() {
+	interval, err := time.ParseDuration(os.Getenv("DRIFT_CHECK_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	log.Info("Monitoring for drift", "phase", "drift", "interval", interval)
+
+	go func() {
+		for range time.Tick(interval) {
+			reportDrift(checkDrift())
+		}
+	}()
+}
+
+// checkDrift returns the problems found, keyed by kind.
+func checkDrift() map[string]string {
+	problems := map[string]string{}
+	status := currentStatus()
+
+	server, err := resolverTarget("")
+	if err != nil {
+		problems["resolver"] = err.Error()
+		return problems
+	}
+
+	if detail := driftAnswers(server, status); detail != "" {
+		problems["answers"] = detail
+	}
+
+	// Leave named time to load a generation before holding its zones to it.
+	if time.Since(status.Time) > time.Minute {
+		for zone, detail := range driftZones(server, status) {
+			problems["zone "+zone] = detail
+		}
+	}
+
+	if detail := driftStale(status); detail != "" {
+		problems["stale"] = detail
+	}
+
+	return problems
+}
+
+// driftAnswers resolves DRIFT_CHECK_SAMPLE domains drawn from the services the last
+// generation enabled, each of which must be answered with only its cache IPs.
+func driftAnswers(server upstream, status generationStatus) string {
+	// During a canary rollout lookups from the host itself are not intercepted.
+	if len(cleanIP(os.Getenv("CANARY_CLIENTS"))) > 0 {
+		return ""
+	}
+
+	sample := 10
+	if n, err := strconv.Atoi(os.Getenv("DRIFT_CHECK_SAMPLE")); err == nil && n > 0 {
+		sample = n
+	}
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		return err.Error()
+	}
+
+	candidates := make([]interceptedName, 0)
+	expected := map[string]map[string]bool{}
+
+	for _, s := range status.Services {
+		if !s.Enabled || len(s.IPs) == 0 {
+			continue
+		}
+
+		expected[s.Name] = map[string]bool{}
+		for _, ip := range s.IPs {
+			expected[s.Name][ip] = true
+		}
+
+		for _, name := range sampleDomains(services[s.Name], 0) {
+			candidates = append(candidates, interceptedName{name: name, service: s.Name})
+		}
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	candidates = candidates[:min(sample, len(candidates))]
+	wrong := make([]string, 0)
+
+	for _, n := range candidates {
+		answer, err := queryDNS(server, dnsQuery{Name: n.name, Type: dnsmessage.TypeA})
+
+		switch {
+		case err != nil:
+			wrong = append(wrong, n.name+": "+err.Error())
+		case len(answer.Addrs) == 0:
+			wrong = append(wrong, fmt.Sprintf("%s was not answered with an address (%s)", n.name, answer.RCode))
+		case !onlyCacheIPs(answer.Addrs, expected[n.service]):
+			wrong = append(wrong, fmt.Sprintf("%s resolved to %s rather than the %s cache", n.name, strings.Join(answer.Addrs, ", "), n.service))
+		}
+	}
+
+	if len(wrong) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d of %d sampled domains answered wrongly: %s", len(wrong), len(candidates), strings.Join(wrong, "; "))
+}
+
+// driftZones compares the serial named serves for each generated zone with the serial
+// of its file, which is ahead when named failed to load the latest generation. The cache
+// zone is asked for its SOA, while the response policy zones, which clients cannot
+// query, are checked through rndc where it is installed.
+func driftZones(server upstream, status generationStatus) map[string]string {
+	problems := map[string]string{}
+
+	served := map[string]uint32{}
+
+	if answer, err := queryDNS(server, dnsQuery{Name: dnsDomain(), Type: dnsmessage.TypeSOA}); err != nil {
+		problems[dnsDomain()] = "named did not answer for the cache zone: " + err.Error()
+	} else {
+		served[dnsDomain()] = answer.Serial
+	}
+
+	if _, err := exec.LookPath("rndc"); err == nil {
+		for _, zone := range rpzZones(status.Services) {
+			args := []string{"zonestatus", zone}
+			if views, _ := clientViews(); len(views) > 0 {
+				args = append(args, "IN", "default")
+			}
+
+			out, err := rndc(args...)
+			if err != nil {
+				problems[zone] = "named has not loaded the zone: " + lastLine([]byte(out), err)
+				continue
+			}
+
+			if m := zonestatusSerial.FindStringSubmatch(out); m != nil {
+				serial, _ := strconv.ParseUint(m[1], 10, 32)
+				served[zone] = uint32(serial)
+			}
+		}
+	}
+
+	for zone, serial := range served {
+		path := zonePath + zone + ".db"
+		if zone == "rpz" {
+			path = rpzZone
+		}
+
+		// Serials are compared in sequence space arithmetic, as secondaries do.
+		if onDisk := zoneSerial(path); onDisk != 0 && int32(onDisk-serial) > 0 {
+			problems[zone] = fmt.Sprintf("named serves serial %d but %s has %d, the latest generation failed to load", serial, path, onDisk)
+		}
+	}
+
+	return problems
+}
+
+// driftStale reports a configuration that has fallen behind: the last generation failed,
+// or cache_domains upstream has been ahead of the generated revision for longer than
+// DRIFT_MAX_AGE.
+func driftStale(status generationStatus) string {
+	if status.Time.IsZero() {
+		return "no generation has completed"
+	}
+
+	if status.Error != "" {
+		return "the last generation failed, named is serving an older configuration: " + status.Error
+	}
+
+	if os.Getenv("NOFETCH") == "true" || !fileExists(domainsPath+"/.git") {
+		return ""
+	}
+
+	maxAge := 24 * time.Hour
+	if d, err := time.ParseDuration(os.Getenv("DRIFT_MAX_AGE")); err == nil && d > 0 {
+		maxAge = d
+	}
+
+	ref := "HEAD"
+	if branch := os.Getenv("CACHE_DOMAINS_BRANCH"); branch != "" {
+		ref = "refs/heads/" + branch
+	}
+
+	cmd := exec.Command("git", "ls-remote", "origin", ref)
+	cmd.Dir = domainsPath
+
+	out, err := cmd.Output()
+	if err != nil {
+		log.Warn("Failed to query cache_domains upstream", "phase", "drift", "error", err)
+		return ""
+	}
+
+	upstream, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\t")
+	if upstream == "" || upstream == status.Revision {
+		driftBehindSince = time.Time{}
+		return ""
+	}
+
+	if driftBehindSince.IsZero() {
+		driftBehindSince = time.Now()
+	}
+
+	if time.Since(driftBehindSince) < maxAge {
+		return ""
+	}
+
+	return fmt.Sprintf("cache_domains upstream has been at %s for %s but %s is generated, check it is being fetched", shortRevision(upstream), time.Since(driftBehindSince).Round(time.Minute), shortRevision(status.Revision))
+}
+
+// reportDrift alerts about problems that have appeared or cleared since the last check.
+func reportDrift(problems map[string]string) {
+	metrics.driftChecks.Add(1)
+	metrics.driftProblems.Store(int64(len(problems)))
+
+	kinds := make([]string, 0, len(problems))
+	for kind := range problems {
+		kinds = append(kinds, kind)
+	}
+
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		if _, known := driftProblems[kind]; known {
+			continue
+		}
+
+		log.Error("Resolver has drifted from the configuration", "phase", "drift", "check", kind, "detail", problems[kind])
+		notify("drift", "Lancache DNS drift ("+kind+"): "+problems[kind])
+	}
+
+	for kind := range driftProblems {
+		if _, ok := problems[kind]; !ok {
+			log.Info("Drift resolved", "phase", "drift", "check", kind)
+			notify("drift_resolved", "Lancache DNS drift resolved ("+kind+")")
+		}
+	}
+
+	driftProblems = problems
+}
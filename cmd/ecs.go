@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ednsClientSubnet is the EDNS option code of the client subnet option (RFC 7871).
+const ednsClientSubnet = 8
+
+// The ECS proxy queries named from loopback addresses of its own, matched by the
+// ecs-intercept and ecs-passthru views generated alongside the client views, so that
+// named intercepts or passes through the query as the view of the client would.
+const (
+	ecsInterceptSource = "127.0.0.2"
+	ecsPassthruSource  = "127.0.0.3"
+)
+
+// ecsViews holds the client views the ECS proxy steers by, parsed when it starts and
+// again once a reloaded configuration has been generated.
+var ecsViews atomic.Pointer[[]dnsView]
+
+// startECSProxy relays queries received on ECS_PROXY_LISTEN to named, answering them as
+// the view matching the client subnet the query carries: clients of a view that does not
+// intercept, or outside CANARY_CLIENTS during a canary rollout, get the answers named
+// gives without the response policy, those of an intercepting view answers steered to
+// its own caches. Open source BIND can't match views on EDNS Client Subnet, so this lets
+// SITE_MAP, VIEWS and CANARY_CLIENTS work behind another forwarder that hides the real
+// client address.
+func startECSProxy() error {
+	addr := os.Getenv("ECS_PROXY_LISTEN")
+	if addr == "" {
+		return nil
+	}
+
+	port, err := bindPort()
+	if err != nil {
+		return err
+	}
+
+	if err = refreshECSViews(); err != nil {
+		return err
+	}
+
+	server := upstream{IP: "127.0.0.1", Port: port}
+
+	err = serveDNS("ECS proxy", addr, func(query []byte, from net.Addr, tcp bool) ([]byte, error) {
+		views := *ecsViews.Load()
+		view, intercept := ecsClientView(views, querySubnetAddress(query, from))
+
+		// Without client views named has a single view answering every query.
+		var source net.IP
+		if len(views) > 0 {
+			source = net.ParseIP(ecsPassthruSource)
+			if intercept {
+				source = net.ParseIP(ecsInterceptSource)
+			}
+		}
+
+		var (
+			answer []byte
+			err    error
+		)
+
+		if tcp {
+			answer, err = exchangeStreamFrom(source, server.address(), query, 5*time.Second, nil)
+		} else {
+			answer, err = exchangeUDPFrom(source, server.address(), query, 5*time.Second)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !intercept || view == nil || len(view.CacheIPs) == 0 {
+			return answer, nil
+		}
+
+		return steerAnswer(answer, view.CacheIPs), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Info("ECS proxy listening", "listen", addr, "upstream", server.address())
+
+	return nil
+}
+
+// refreshECSViews parses the client views for the ECS proxy to steer by.
+func refreshECSViews() error {
+	views, err := clientViews()
+	if err != nil {
+		return err
+	}
+
+	ecsViews.Store(&views)
+
+	return nil
+}
+
+// ecsClientView returns the view of views matching client, or nil for the default view,
+// and whether queries from client are intercepted. The default view intercepts unless a
+// canary rollout limits interception to CANARY_CLIENTS.
+func ecsClientView(views []dnsView, client net.IP) (*dnsView, bool) {
+	if client != nil {
+		for i, v := range views {
+			if matchesClient(v.Clients, client) {
+				return &views[i], v.Intercept
+			}
+		}
+	}
+
+	return nil, len(views) == 0 || views[0].Name != "canary"
+}
+
+// querySubnetAddress returns the address from the client subnet option of query, or the
+// source of the query when it has none.
+func querySubnetAddress(query []byte, from net.Addr) net.IP {
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err == nil {
+		for _, rr := range m.Additionals {
+			opt, ok := rr.Body.(*dnsmessage.OPTResource)
+			if !ok {
+				continue
+			}
+
+			for _, o := range opt.Options {
+				// Family, source and scope prefix lengths, then the truncated address.
+				if o.Code != ednsClientSubnet || len(o.Data) < 4 {
+					continue
+				}
+
+				size := net.IPv4len
+				if o.Data[1] == 2 {
+					size = net.IPv6len
+				}
+
+				ip := make(net.IP, size)
+				copy(ip, o.Data[4:])
+
+				return ip
+			}
+		}
+	}
+
+	if a, ok := from.(*net.UDPAddr); ok {
+		return a.IP
+	}
+
+	if a, ok := from.(*net.TCPAddr); ok {
+		return a.IP
+	}
+
+	return nil
+}
+
+// steerAnswer replaces the default cache addresses in answer with cacheIPs, the caches
+// of the client's view, returning answer unchanged when it has none.
+func steerAnswer(answer []byte, cacheIPs []string) []byte {
+	caches := map[string]bool{}
+	for _, s := range currentStatus().Services {
+		for _, ip := range s.IPs {
+			caches[ip] = true
+		}
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(answer); err != nil {
+		return answer
+	}
+
+	steered := make([]dnsmessage.Resource, 0, len(m.Answers))
+	replaced := map[string]bool{}
+
+	for _, rr := range m.Answers {
+		var ip net.IP
+
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		}
+
+		if ip == nil || !caches[ip.String()] {
+			steered = append(steered, rr)
+			continue
+		}
+
+		// Replace the whole RRset once, with the view's caches of the same family.
+		if replaced[rr.Header.Name.String()] {
+			continue
+		}
+
+		replaced[rr.Header.Name.String()] = true
+
+		for _, s := range cacheIPs {
+			sip := net.ParseIP(s)
+
+			if v4 := sip.To4(); v4 != nil && rr.Header.Type == dnsmessage.TypeA {
+				steered = append(steered, dnsmessage.Resource{Header: rr.Header, Body: &dnsmessage.AResource{A: [4]byte(v4)}})
+			} else if v4 == nil && rr.Header.Type == dnsmessage.TypeAAAA {
+				steered = append(steered, dnsmessage.Resource{Header: rr.Header, Body: &dnsmessage.AAAAResource{AAAA: [16]byte(sip.To16())}})
+			}
+		}
+	}
+
+	if len(replaced) == 0 {
+		return answer
+	}
+
+	m.Answers = steered
+
+	packed, err := m.Pack()
+	if err != nil {
+		return answer
+	}
+
+	return packed
+}
+
+// matchesClient reports whether ip is within any of the addresses or networks in clients.
+func matchesClient(clients []string, ip net.IP) bool {
+	for _, c := range clients {
+		if _, n, err := net.ParseCIDR(c); err == nil && n.Contains(ip) {
+			return true
+		}
+
+		if net.ParseIP(c).Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	exporterListen   string
+	exporterStatsURL string
+)
+
+var exporterCmd = &cobra.Command{
+	Use:   "exporter",
+	Short: "Export BIND statistics as Prometheus metrics",
+	Long:  `Scrape the BIND statistics channel and republish query, RPZ and cache statistics as Prometheus metrics`,
+	Run: func(cmd *cobra.Command, _ []string) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", handleBINDMetrics)
+
+		log.Info("Exporting BIND statistics", "source", exporterStatsURL, "listen", exporterListen)
+		log.Fatal(http.ListenAndServe(exporterListen, mux))
+	},
+}
+
+func init() {
+	exporterCmd.Flags().StringVar(&exporterListen, "listen", ":9119", "Address to serve metrics on")
+	exporterCmd.Flags().StringVar(&exporterStatsURL, "stats-url", "http://127.0.0.1:8053/json/v1", "URL of the BIND JSON statistics channel")
+}
+
+// bindStats is the subset of the BIND JSON statistics document that is exported.
+type bindStats struct {
+	Opcodes map[string]int64 `json:"opcodes"`
+	Rcodes  map[string]int64 `json:"rcodes"`
+	Qtypes  map[string]int64 `json:"qtypes"`
+	Nsstats map[string]int64 `json:"nsstats"`
+	Views   map[string]struct {
+		Resolver struct {
+			Cachestats map[string]int64 `json:"cachestats"`
+		} `json:"resolver"`
+	} `json:"views"`
+}
+
+func handleBINDMetrics(w http.ResponseWriter, _ *http.Request) {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	resp, err := client.Get(exporterStatsURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var stats bindStats
+	if err = json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeLabelled(w, "bind_incoming_queries_total", "counter", "Incoming queries by type.", "type", stats.Qtypes)
+	writeLabelled(w, "bind_incoming_requests_total", "counter", "Incoming requests by opcode.", "opcode", stats.Opcodes)
+	writeLabelled(w, "bind_responses_total", "counter", "Responses by rcode.", "rcode", stats.Rcodes)
+	writeLabelled(w, "bind_server_stats_total", "counter", "Name server statistics.", "name", stats.Nsstats)
+
+	writeMetric(w, "bind_rpz_rewrites_total", "counter", "Responses rewritten by RPZ.", float64(stats.Nsstats["RPZRewrites"]))
+
+	fmt.Fprintln(w, "# HELP bind_cache_stats Resolver cache statistics.")
+	fmt.Fprintln(w, "# TYPE bind_cache_stats gauge")
+
+	for _, view := range sortedKeys(stats.Views) {
+		cache := stats.Views[view].Resolver.Cachestats
+		for _, name := range sortedKeys(cache) {
+			fmt.Fprintf(w, "bind_cache_stats{view=%q,name=%q} %d\n", view, name, cache[name])
+		}
+	}
+}
+
+func writeLabelled(w io.Writer, name, kind, help, label string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
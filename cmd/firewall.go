@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	firewallFormat    string
+	firewallServer    string
+	firewallInterface string
+	firewallExclude   string
+	firewallOutput    string
+)
+
+// firewallRules describes the redirect a rule set implements.
+type firewallRules struct {
+	// Server is the lancache-dns address queries are redirected to.
+	Server string
+	// Interface limits the redirect to traffic arriving on the LAN interface.
+	Interface string
+	// Exclude lists sources left alone, always including Server itself so that BIND can
+	// still reach its upstreams.
+	Exclude []string
+}
+
+// firewallFormats renders a gateway script applying the redirect for each firewall.
+var firewallFormats = map[string]func(w io.Writer, r firewallRules){
+	"nftables": func(w io.Writer, r firewallRules) {
+		iif := ""
+		if r.Interface != "" {
+			iif = fmt.Sprintf("iifname %q ", r.Interface)
+		}
+
+		fmt.Fprintln(w, "nft delete table ip lancache_dns 2>/dev/null")
+		fmt.Fprintln(w, "nft -f - <<'EOF'")
+		fmt.Fprintln(w, "table ip lancache_dns {")
+		fmt.Fprintln(w, "\tchain prerouting {")
+		fmt.Fprintln(w, "\t\ttype nat hook prerouting priority dstnat; policy accept;")
+		fmt.Fprintf(w, "\t\t%sip saddr != { %s } ip daddr != %s meta l4proto { tcp, udp } th dport 53 dnat to %s:53\n", iif, strings.Join(r.Exclude, ", "), r.Server, r.Server)
+		fmt.Fprintln(w, "\t}")
+		fmt.Fprintln(w, "\tchain postrouting {")
+		fmt.Fprintln(w, "\t\ttype nat hook postrouting priority srcnat; policy accept;")
+		fmt.Fprintf(w, "\t\tct status dnat ip daddr %s meta l4proto { tcp, udp } th dport 53 masquerade\n", r.Server)
+		fmt.Fprintln(w, "\t}")
+		fmt.Fprintln(w, "}")
+		fmt.Fprintln(w, "EOF")
+	},
+	"iptables": func(w io.Writer, r firewallRules) {
+		iif := ""
+		if r.Interface != "" {
+			iif = "-i " + r.Interface + " "
+		}
+
+		fmt.Fprintln(w, "iptables -t nat -N LANCACHE_DNS 2>/dev/null || iptables -t nat -F LANCACHE_DNS")
+		fmt.Fprintln(w, "iptables -t nat -C PREROUTING -j LANCACHE_DNS 2>/dev/null || iptables -t nat -A PREROUTING -j LANCACHE_DNS")
+
+		for _, e := range r.Exclude {
+			fmt.Fprintf(w, "iptables -t nat -A LANCACHE_DNS -s %s -j RETURN\n", e)
+		}
+
+		fmt.Fprintf(w, "iptables -t nat -A LANCACHE_DNS -d %s -j RETURN\n", r.Server)
+
+		for _, proto := range []string{"udp", "tcp"} {
+			fmt.Fprintf(w, "iptables -t nat -A LANCACHE_DNS %s-p %s --dport 53 -j DNAT --to-destination %s:53\n", iif, proto, r.Server)
+		}
+
+		for _, proto := range []string{"udp", "tcp"} {
+			rule := fmt.Sprintf("POSTROUTING -d %s -p %s --dport 53 -m conntrack --ctstate DNAT -j MASQUERADE", r.Server, proto)
+			fmt.Fprintf(w, "iptables -t nat -C %s 2>/dev/null || iptables -t nat -A %s\n", rule, rule)
+		}
+	},
+	"pf": func(w io.Writer, r firewallRules) {
+		fmt.Fprintln(w, "pfctl -a lancache-dns -f - <<'EOF'")
+		fmt.Fprintf(w, "table <lancache_dns_exclude> { %s }\n", strings.Join(r.Exclude, ", "))
+		fmt.Fprintf(w, "rdr pass on %s inet proto { udp, tcp } from ! <lancache_dns_exclude> to ! %s port 53 -> %s port 53\n", r.Interface, r.Server, r.Server)
+		fmt.Fprintf(w, "nat on %s inet proto { udp, tcp } from %s:network to %s port 53 -> (%s)\n", r.Interface, r.Interface, r.Server, r.Interface)
+		fmt.Fprintln(w, "EOF")
+		fmt.Fprintln(w, "# The lancache-dns anchor must be referenced from pf.conf with rdr-anchor and nat-anchor.")
+	},
+}
+
+var firewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "Generate gateway rules redirecting DNS to lancache-dns",
+	Long:  `Generate an nftables, iptables or pf script for the gateway that redirects all outbound port 53 traffic to lancache-dns, so clients with hardcoded resolvers still use the cache`,
+	Run: func(_ *cobra.Command, _ []string) {
+		if err := generateFirewall(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	generateCmd.AddCommand(firewallCmd)
+
+	firewallCmd.Flags().StringVar(&firewallFormat, "format", "nftables", "Rule set format: nftables, iptables or pf")
+	firewallCmd.Flags().StringVar(&firewallServer, "server", "", "lancache-dns address to redirect to, defaulting to FIREWALL_DNS_IP, BIND_LISTEN or the primary address")
+	firewallCmd.Flags().StringVar(&firewallInterface, "interface", "", "LAN interface of the gateway to redirect traffic arriving on, defaulting to FIREWALL_LAN_INTERFACE")
+	firewallCmd.Flags().StringVar(&firewallExclude, "exclude", "", "Further source addresses or networks allowed to query other resolvers, defaulting to FIREWALL_EXCLUDE")
+	firewallCmd.Flags().StringVar(&firewallOutput, "output", "", "File to write the script to instead of printing it")
+}
+
+func generateFirewall() error {
+	render, ok := firewallFormats[firewallFormat]
+	if !ok {
+		return fmt.Errorf("Firewall format: %s is not one of nftables, iptables or pf", firewallFormat)
+	}
+
+	list := firewallServer
+	if list == "" {
+		list = os.Getenv("FIREWALL_DNS_IP")
+	}
+
+	servers, err := advertisedAddresses(list)
+	if err != nil {
+		return err
+	}
+
+	rules := firewallRules{Server: servers[0], Interface: firewallInterface}
+	if rules.Interface == "" {
+		rules.Interface = os.Getenv("FIREWALL_LAN_INTERFACE")
+	}
+
+	if rules.Interface == "" && firewallFormat == "pf" {
+		return fmt.Errorf("The pf rule set requires the LAN interface, set FIREWALL_LAN_INTERFACE")
+	}
+
+	exclude := firewallExclude
+	if exclude == "" {
+		exclude = os.Getenv("FIREWALL_EXCLUDE")
+	}
+
+	rules.Exclude = append([]string{servers[0]}, cleanIP(strings.ReplaceAll(exclude, ",", " "))...)
+
+	for _, e := range rules.Exclude {
+		ip, ipnet, err := net.ParseCIDR(e)
+		if err != nil {
+			ip = net.ParseIP(e)
+		} else {
+			ip = ipnet.IP
+		}
+
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("FIREWALL_EXCLUDE value: %s is not a valid IPv4 address or network", e)
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+
+	if firewallOutput != "" {
+		f, err := os.OpenFile(firewallOutput, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+		if err != nil {
+			return err
+		}
+
+		defer func(f *os.File) {
+			if err = f.Close(); err != nil {
+				log.Fatalf("error while closing resource %s: %v", f.Name(), err)
+			}
+		}(f)
+
+		w = f
+	}
+
+	fmt.Fprintln(w, "#!/bin/sh")
+	fmt.Fprintf(w, "# Redirect outbound DNS to lancache-dns at %s, generated by dnstool %s\n", rules.Server, version)
+
+	render(w, rules)
+
+	if firewallOutput != "" {
+		log.Info("Wrote firewall rules", "phase", "firewall", "format", firewallFormat, "file", firewallOutput)
+	}
+
+	return nil
+}
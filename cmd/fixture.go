@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// fixture is a small synthetic cache_domains dataset, along with a stock named.conf.options
+// template, for exercising generation end to end without the network or the real repos.
+//
+//go:embed fixture
+var fixture embed.FS
+
+var fixtureCmd = &cobra.Command{
+	Use:   "fixture <dir>",
+	Short: "Write the synthetic cache_domains dataset as a git repository",
+	Long:  `Write the bundled synthetic cache_domains dataset to dir as a git repository, which can be served to other containers as CACHE_DOMAINS_REPO=file://<dir> to test cloning and fetching offline. Set FIXTURE_DIR instead to generate from the dataset into a sandbox directory`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		if err := publishFixture(args[0]); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// fixtureDir returns FIXTURE_DIR, the sandbox that fixture mode writes everything to, or
+// an empty string outside fixture mode.
+func fixtureDir() string {
+	if os.Getenv("FIXTURE_DIR") == "" {
+		return ""
+	}
+
+	return filepath.Clean(os.Getenv("FIXTURE_DIR"))
+}
+
+// applyFixtureEnvironment points, in fixture mode, every path generation reads or writes
+// into FIXTURE_DIR, with cache_domains cloned from a repository of the synthetic dataset
+// published there, the image's defaults for a generic cache, and the checks that reach the
+// network or the host turned off. Variables that are already set are left alone, so that
+// tests can still exercise them.
+func applyFixtureEnvironment() {
+	dir := fixtureDir()
+	if dir == "" {
+		return
+	}
+
+	for _, v := range [][2]string{
+		{"ZONE_PATH", filepath.Join(dir, "zones")},
+		{"CACHE_CONF", filepath.Join(dir, "cache.conf")},
+		{"NAMED_CONF_OPTIONS", filepath.Join(dir, "named.conf.options")},
+		{"CONF_D_DIR", filepath.Join(dir, "conf.d")},
+		{"CACHE_DOMAINS_DIR", filepath.Join(dir, "cache_domains")},
+		{"CACHE_DOMAINS_REPO", "file://" + filepath.Join(dir, "upstream")},
+		{"CACHE_DOMAINS_BRANCH", "master"},
+		{"STATE_FILE", filepath.Join(dir, "state.json")},
+		{"RESOLV_CONF_PATH", filepath.Join(dir, "resolv.conf")},
+		{"DNSSEC_KEY_DIR", filepath.Join(dir, "keys")},
+		{"UPSTREAM_CHECK", "off"},
+		{"PORT_CHECK", "off"},
+		{"USE_GENERIC_CACHE", "true"},
+		{"LANCACHE_IP", "10.0.39.1"},
+		{"LANCACHE_DNSDOMAIN", "cache.lancache.net"},
+		{"UPSTREAM_DNS", "192.0.2.1"},
+	} {
+		if _, ok := os.LookupEnv(v[0]); !ok {
+			_ = os.Setenv(v[0], v[1])
+		}
+	}
+}
+
+// prepareFixture creates the sandbox for fixture mode: the zone directory, the stock
+// named.conf.options template and the upstream repository of the synthetic dataset. Where
+// git is not installed the dataset is written straight to CACHE_DOMAINS_DIR instead.
+func prepareFixture() error {
+	dir := fixtureDir()
+
+	log.Info("Generating from the synthetic cache_domains dataset", "phase", "bootstrap", "dir", dir)
+
+	for _, d := range []string{zonePath, domainsPath} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	if !fileExists(namedConf) {
+		b, err := fixture.ReadFile("fixture/named.conf.options")
+		if err != nil {
+			return err
+		}
+
+		if err = os.WriteFile(namedConf, b, 0644); err != nil {
+			return err
+		}
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		log.Warn("git is not installed, writing the dataset without a repository", "phase", "bootstrap", "dir", domainsPath)
+		return copyEmbedded(fixture, "fixture/cache_domains", domainsPath)
+	}
+
+	// A repository given in CACHE_DOMAINS_REPO is cloned in place of the sandbox's own.
+	upstream := filepath.Join(dir, "upstream")
+	if os.Getenv("CACHE_DOMAINS_REPO") != "file://"+upstream || fileExists(filepath.Join(upstream, ".git")) {
+		return nil
+	}
+
+	return publishFixture(upstream)
+}
+
+// publishFixture writes the synthetic dataset to dir and commits it on master.
+func publishFixture(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := copyEmbedded(fixture, "fixture/cache_domains", dir); err != nil {
+		return err
+	}
+
+	for _, args := range [][]string{
+		{"init", "--quiet", "--initial-branch", "master"},
+		{"add", "--all"},
+		{"commit", "--quiet", "--allow-empty", "--message", "Synthetic cache_domains fixture"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=dnstool", "GIT_AUTHOR_EMAIL=dnstool@localhost",
+			"GIT_COMMITTER_NAME=dnstool", "GIT_COMMITTER_EMAIL=dnstool@localhost")
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("Unable to publish the fixture at %s: git %s: %s", dir, args[0], lastLine(out, err))
+		}
+	}
+
+	log.Info("Published the synthetic cache_domains dataset", "phase", "bootstrap", "dir", dir)
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// forwardZones collects conditional forward zones from FORWARD_ZONE_<domain> variables
+// and FORWARD_ZONES_FILE. Variable names without a dot have underscores translated,
+// so both FORWARD_ZONE_corp.example.com and FORWARD_ZONE_CORP_EXAMPLE_COM work.
+func forwardZones() (map[string][]upstream, error) {
+	zones := map[string][]upstream{}
+
+	for _, e := range os.Environ() {
+		key, value, _ := strings.Cut(e, "=")
+
+		domain, ok := strings.CutPrefix(key, "FORWARD_ZONE_")
+		if !ok || domain == "" {
+			continue
+		}
+
+		if !strings.Contains(domain, ".") {
+			domain = strings.ReplaceAll(domain, "_", ".")
+		}
+
+		if err := addForwardZone(zones, domain, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if path := os.Getenv("FORWARD_ZONES_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		defer func(f *os.File) {
+			if err = f.Close(); err != nil {
+				log.Fatalf("error while closing resource %s: %v", f.Name(), err)
+			}
+		}(f)
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("Forward zone %s in %s has no servers", fields[0], path)
+			}
+
+			if err = addForwardZone(zones, fields[0], strings.Join(fields[1:], " ")); err != nil {
+				return nil, err
+			}
+		}
+
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := addServiceForwardZones(zones); err != nil {
+		return nil, err
+	}
+
+	return zones, nil
+}
+
+// serviceForwarders returns the servers set by FORWARD_<SERVICE>, which sends a
+// service's domains to a specific upstream instead of intercepting them.
+func serviceForwarders(service string) string {
+	return os.Getenv("FORWARD_" + strings.ToUpper(service))
+}
+
+// addServiceForwardZones adds a forward zone for each domain of every service with
+// FORWARD_<SERVICE> set. Wildcard entries forward the domain below the wildcard.
+func addServiceForwardZones(zones map[string][]upstream) error {
+	found := false
+
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "FORWARD_") && !strings.HasPrefix(e, "FORWARD_ZONE") {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range services.names() {
+		servers := serviceForwarders(name)
+		if servers == "" {
+			continue
+		}
+
+		for _, domain := range append(services[name], customDomainsFor(name)...) {
+			if err = addForwardZone(zones, strings.TrimPrefix(domain, "*."), servers); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func addForwardZone(zones map[string][]upstream, domain, servers string) error {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	upstreams, err := parseUpstreams(strings.ReplaceAll(servers, ",", " "))
+	if err != nil {
+		return fmt.Errorf("Forward zone %s: %v", domain, err)
+	}
+
+	if len(upstreams) == 0 {
+		return fmt.Errorf("Forward zone %s has no servers", domain)
+	}
+
+	zones[domain] = append(zones[domain], upstreams...)
+
+	return nil
+}
+
+// forwardZoneConfiguration renders the conditional forward zones for cache.conf.
+func forwardZoneConfiguration() (string, error) {
+	zones, err := forwardZones()
+	if err != nil {
+		return "", err
+	}
+
+	domains := make([]string, 0, len(zones))
+	for d := range zones {
+		domains = append(domains, d)
+	}
+
+	sort.Strings(domains)
+
+	var b strings.Builder
+
+	for _, d := range domains {
+		fmt.Fprintf(&b, fmtForwardZone, d, forwarderList(zones[d]))
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"dnstool/pkg/controlpb"
+)
+
+// startGRPCServer serves the control API of pkg/controlpb/control.proto on GRPC_LISTEN
+// when set. Like the REST API it is authenticated with API_TOKEN, which must be set.
+func startGRPCServer() error {
+	addr := os.Getenv("GRPC_LISTEN")
+	if addr == "" {
+		return nil
+	}
+
+	if os.Getenv("API_TOKEN") == "" {
+		return fmt.Errorf("GRPC_LISTEN requires API_TOKEN to be set")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s := grpc.NewServer(grpc.UnaryInterceptor(grpcAuth))
+	controlpb.RegisterControlServer(s, controlServer{})
+
+	log.Info("Listening for gRPC requests", "listen", l.Addr().String())
+
+	go func() {
+		if err := s.Serve(l); err != nil {
+			log.Error("gRPC server stopped", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// grpcAuth requires "authorization: Bearer <API_TOKEN>" metadata on every call.
+func grpcAuth(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	token := os.Getenv("API_TOKEN")
+
+	var got string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			got = strings.TrimPrefix(v[0], "Bearer ")
+		}
+	}
+
+	if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+
+	return handler(ctx, req)
+}
+
+// controlServer implements the control API on top of the same runtime state as the
+// REST API, so that changes made through either are persisted and seen by both.
+type controlServer struct {
+	controlpb.UnimplementedControlServer
+}
+
+func (controlServer) GetStatus(context.Context, *controlpb.GetStatusRequest) (*controlpb.GetStatusResponse, error) {
+	gen := currentStatus()
+	rt := runtimeSnapshot()
+
+	resp := &controlpb.GetStatusResponse{
+		Generation: &controlpb.Generation{
+			Duration: durationpb.New(gen.Duration),
+			Revision: gen.Revision,
+			Error:    gen.Error,
+		},
+		Overrides:       map[string]*controlpb.ServiceOverride{},
+		PendingServices: rt.PendingServices,
+	}
+
+	if !gen.Time.IsZero() {
+		resp.Generation.Time = timestamppb.New(gen.Time)
+	}
+
+	for _, s := range gen.Services {
+		svc := &controlpb.Service{
+			Name:    s.Name,
+			Enabled: s.Enabled,
+			Ips:     s.IPs,
+			Domains: int32(s.Domains),
+			Policy:  s.Policy,
+		}
+
+		if len(s.Weights) > 0 {
+			svc.Weights = map[string]int32{}
+			for ip, w := range s.Weights {
+				svc.Weights[ip] = int32(w)
+			}
+		}
+
+		resp.Generation.Services = append(resp.Generation.Services, svc)
+	}
+
+	for name, o := range rt.Services {
+		resp.Overrides[name] = &controlpb.ServiceOverride{Enabled: o.Enabled, Ip: o.IP}
+	}
+
+	return resp, nil
+}
+
+func (controlServer) EnableService(_ context.Context, req *controlpb.EnableServiceRequest) (*controlpb.EnableServiceResponse, error) {
+	if req.GetService() == "" {
+		return nil, status.Error(codes.InvalidArgument, "a service is required")
+	}
+
+	if _, err := cacheService(req.GetService()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if err := checkEnableIP(req.GetService(), req.GetIp()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	enabled := true
+	setServiceOverride(req.GetService(), serviceOverride{Enabled: &enabled, IP: req.GetIp()})
+	clearPendingService(req.GetService())
+	if err := saveGRPCState(); err != nil {
+		return nil, err
+	}
+
+	requestRegeneration("grpc: enable " + req.GetService())
+
+	return &controlpb.EnableServiceResponse{}, nil
+}
+
+func (controlServer) DisableService(_ context.Context, req *controlpb.DisableServiceRequest) (*controlpb.DisableServiceResponse, error) {
+	if req.GetService() == "" {
+		return nil, status.Error(codes.InvalidArgument, "a service is required")
+	}
+
+	if _, err := cacheService(req.GetService()); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	enabled := false
+	setServiceOverride(req.GetService(), serviceOverride{Enabled: &enabled})
+	clearPendingService(req.GetService())
+	if err := saveGRPCState(); err != nil {
+		return nil, err
+	}
+
+	requestRegeneration("grpc: disable " + req.GetService())
+
+	return &controlpb.DisableServiceResponse{}, nil
+}
+
+func (controlServer) Regenerate(_ context.Context, req *controlpb.RegenerateRequest) (*controlpb.RegenerateResponse, error) {
+	if req.GetFetch() {
+		requestRefresh("grpc")
+	} else {
+		requestRegeneration("grpc")
+	}
+
+	return &controlpb.RegenerateResponse{}, nil
+}
+
+// saveGRPCState persists runtime changes, reporting failures to the client.
+func saveGRPCState() error {
+	if err := saveRuntimeState(); err != nil {
+		log.Error("Failed to save runtime state", "file", stateFile(), "error", err)
+		return status.Error(codes.Internal, "failed to save state: "+err.Error())
+	}
+
+	return nil
+}
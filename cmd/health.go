@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheHealth tracks the cache IPs seen during generation and those failing their
+// health check, so that dead caches can be withdrawn from the generated zones.
+var cacheHealth = struct {
+	sync.Mutex
+	targets map[string]bool
+	down    map[string]bool
+}{targets: map[string]bool{}, down: map[string]bool{}}
+
+// healthyAddresses notes ips as health check targets and returns those not currently
+// failing. When every address is down they are all withdrawn so that clients fall back
+// to the origin rather than a dead cache.
+func healthyAddresses(ips []string) []string {
+	cacheHealth.Lock()
+	defer cacheHealth.Unlock()
+
+	healthy := make([]string, 0, len(ips))
+
+	for _, ip := range ips {
+		cacheHealth.targets[ip] = true
+
+		if !cacheHealth.down[ip] {
+			healthy = append(healthy, ip)
+		}
+	}
+
+	return healthy
+}
+
+// startHealthChecks periodically requests HEALTH_CHECK_PATH from each cache IP when
+// HEALTH_CHECK is enabled, regenerating the configuration whenever a cache goes down or
+// comes back.
+func startHealthChecks() {
+	if os.Getenv("HEALTH_CHECK") != "true" {
+		return
+	}
+
+	interval := 30 * time.Second
+	if d, err := time.ParseDuration(os.Getenv("HEALTH_CHECK_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+
+	path := "/lancache-heartbeat"
+	if os.Getenv("HEALTH_CHECK_PATH") != "" {
+		path = os.Getenv("HEALTH_CHECK_PATH")
+	}
+
+	port := "80"
+	if os.Getenv("HEALTH_CHECK_PORT") != "" {
+		port = os.Getenv("HEALTH_CHECK_PORT")
+	}
+
+	// Requests go straight to the cache IP, never through FETCH_PROXY.
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{Proxy: nil},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	log.Info("Health checking cache IPs", "phase", "health", "interval", interval, "path", path)
+
+	go func() {
+		for range time.Tick(interval) {
+			if changed := checkCacheHealth(client, port, path); len(changed) > 0 {
+				requestRegeneration("health: " + strings.Join(changed, ", "))
+			}
+		}
+	}()
+}
+
+// checkCacheHealth probes every target once, returning a description of each change.
+func checkCacheHealth(client *http.Client, port, path string) []string {
+	cacheHealth.Lock()
+	targets := make([]string, 0, len(cacheHealth.targets))
+	for ip := range cacheHealth.targets {
+		targets = append(targets, ip)
+	}
+	cacheHealth.Unlock()
+
+	sort.Strings(targets)
+
+	var changed []string
+
+	for _, ip := range targets {
+		err := probeCache(client, "http://"+net.JoinHostPort(ip, port)+path)
+
+		cacheHealth.Lock()
+		wasDown := cacheHealth.down[ip]
+
+		if err != nil && !wasDown {
+			cacheHealth.down[ip] = true
+			changed = append(changed, ip+" down")
+			log.Warn("Cache failed its health check, withdrawing it", "phase", "health", "ip", ip, "error", err)
+		} else if err == nil && wasDown {
+			delete(cacheHealth.down, ip)
+			changed = append(changed, ip+" up")
+			log.Info("Cache passed its health check, restoring it", "phase", "health", "ip", ip)
+		}
+		cacheHealth.Unlock()
+	}
+
+	return changed
+}
+
+func probeCache(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("Health check returned %s", resp.Status)
+	}
+
+	return nil
+}
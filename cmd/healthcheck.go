@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"dnstool/pkg/dnsgen"
+)
+
+var (
+	healthcheckServer   string
+	healthcheckDomain   string
+	healthcheckService  string
+	healthcheckExpected string
+	healthcheckTimeout  time.Duration
+)
+
+var healthcheckCmd = &cobra.Command{
+	Use:   "healthcheck",
+	Short: "Check the resolver answers cached and external names",
+	Long: `Look up a domain of a cached service and an external name at the local resolver, exiting non-zero if either fails or the cached domain does not resolve to its cache. Intended for the image's health check:
+
+  HEALTHCHECK CMD dnstool healthcheck`,
+	Run: func(_ *cobra.Command, _ []string) {
+		detail, err := healthcheck()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "UNHEALTHY: "+err.Error())
+			os.Exit(1)
+		}
+
+		fmt.Println("OK: " + detail)
+	},
+}
+
+func init() {
+	healthcheckCmd.Flags().StringVar(&healthcheckServer, "server", "", "Resolver to check, defaulting to 127.0.0.1 on BIND_PORT")
+	healthcheckCmd.Flags().StringVar(&healthcheckDomain, "domain", "", "Cache domain the resolver serves, defaulting to LANCACHE_DNSDOMAIN")
+	healthcheckCmd.Flags().StringVar(&healthcheckService, "service", "", "Service whose domain is looked up, defaulting to HEALTHCHECK_SERVICE or the first cached service")
+	healthcheckCmd.Flags().StringVar(&healthcheckExpected, "expected-ip", "", "Cache IPs the domain must resolve to, defaulting to HEALTHCHECK_IP, then the service's cache IP in the environment")
+	healthcheckCmd.Flags().DurationVar(&healthcheckTimeout, "timeout", time.Second, "Time to wait for each answer")
+}
+
+func healthcheck() (string, error) {
+	server, err := resolverTarget(healthcheckServer)
+	if err != nil {
+		return "", err
+	}
+
+	domain := servedDomain(healthcheckDomain)
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		return "", err
+	}
+
+	service := healthcheckService
+	if service == "" {
+		service = os.Getenv("HEALTHCHECK_SERVICE")
+	}
+
+	candidates := services.names()
+	if service != "" {
+		candidates = []string{strings.ToLower(service)}
+	}
+
+	var record dnsAnswer
+
+	found := false
+
+	for _, s := range candidates {
+		if record, err = queryDNS(server, dnsQuery{Name: s + "." + domain, Type: dnsmessage.TypeA, Timeout: healthcheckTimeout}); err != nil {
+			return "", fmt.Errorf("%s did not answer: %w", server.address(), err)
+		}
+
+		if found = len(record.Addrs) > 0 && len(services[s]) > 0; found {
+			service = s
+			break
+		}
+	}
+
+	if !found {
+		return "", fmt.Errorf("No service is answered with a cache under %s", domain)
+	}
+
+	list := healthcheckExpected
+	if list == "" {
+		list = os.Getenv("HEALTHCHECK_IP")
+	}
+
+	expected, err := configuredCacheIPs(list, service)
+	if err != nil {
+		return "", err
+	}
+
+	if !onlyCacheIPs(record.Addrs, expected) {
+		return "", fmt.Errorf("%s.%s resolved to %s, which is not a cache IP of %s", service, domain, strings.Join(record.Addrs, ", "), service)
+	}
+
+	name := services[service][0]
+	if parent, ok := strings.CutPrefix(name, "*."); ok {
+		name = "dnstool-test." + parent
+	}
+
+	answer, err := queryDNS(server, dnsQuery{Name: name, Type: dnsmessage.TypeA, Timeout: healthcheckTimeout})
+	if err != nil {
+		return "", fmt.Errorf("%s did not answer %s: %w", server.address(), name, err)
+	}
+
+	if len(answer.Addrs) == 0 {
+		return "", fmt.Errorf("%s was not answered with an address (%s)", name, answer.RCode)
+	}
+
+	// Without cache IPs in the environment the domain must match the service's record.
+	if len(expected) == 0 {
+		for _, a := range record.Addrs {
+			expected[a] = true
+		}
+	}
+
+	if !onlyCacheIPs(answer.Addrs, expected) {
+		return "", fmt.Errorf("%s resolved to %s, which is not a cache IP of %s", name, strings.Join(answer.Addrs, ", "), service)
+	}
+
+	external := upstreamCheckName()
+
+	ext, err := queryDNS(server, dnsQuery{Name: external, Type: dnsmessage.TypeA, Timeout: healthcheckTimeout})
+	if err != nil {
+		return "", fmt.Errorf("%s did not answer %s: %w", server.address(), external, err)
+	}
+
+	if ext.RCode != dnsmessage.RCodeSuccess {
+		return "", fmt.Errorf("%s was answered with %s, check the upstreams", external, ext.RCode)
+	}
+
+	return fmt.Sprintf("%s resolved to %s, %s resolved", name, strings.Join(answer.Addrs, ", "), external), nil
+}
+
+// configuredCacheIPs returns the cache IPs listed, or when list is empty those set for
+// service in the environment, <SERVICE>CACHE_IP or LANCACHE_IP, or none when neither is
+// set.
+func configuredCacheIPs(list, service string) (map[string]bool, error) {
+	for _, key := range []string{strings.ToUpper(service) + "CACHE_IP", "LANCACHE_IP"} {
+		if list == "" {
+			list = os.Getenv(key)
+		}
+	}
+
+	ips, _, err := dnsgen.WeightedAddresses(list)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		expected[ip] = true
+	}
+
+	return expected, nil
+}
+
+// onlyCacheIPs reports whether every address is one of expected, or expected is empty.
+func onlyCacheIPs(addrs []string, expected map[string]bool) bool {
+	for _, a := range addrs {
+		if len(expected) > 0 && !expected[a] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// runHooks runs the executable named by the given environment variable. If it names a
+// directory, every executable within it is run in lexical order, hooks.d style.
+func runHooks(key string, env []string) error {
+	path := os.Getenv(key)
+	if path == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	hooks := []string{path}
+
+	if fi.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		hooks = hooks[:0]
+
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				continue
+			}
+
+			hooks = append(hooks, filepath.Join(path, e.Name()))
+		}
+	}
+
+	for _, hook := range hooks {
+		log.Info("Running hook", "phase", "hooks", "file", hook)
+
+		cmd := exec.Command(hook)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("Hook %s failed: %v", hook, err)
+		}
+	}
+
+	return nil
+}
+
+// hookEnv describes the generation to hook scripts.
+func hookEnv(phase, reason string, changed []string, genErr error) []string {
+	env := []string{
+		"DNSTOOL_PHASE=" + phase,
+		"DNSTOOL_REASON=" + reason,
+		"DNSTOOL_COMMIT=" + cacheDomainsRevision(),
+	}
+
+	if phase == "pre" {
+		return env
+	}
+
+	enabled := make([]string, 0)
+	for _, s := range currentStatus().Services {
+		if s.Enabled {
+			enabled = append(enabled, s.Name)
+		}
+	}
+
+	result := "success"
+	if genErr != nil {
+		result = "failure"
+		env = append(env, "DNSTOOL_ERROR="+genErr.Error())
+	}
+
+	return append(env,
+		"DNSTOOL_RESULT="+result,
+		"DNSTOOL_SERVICES="+strings.Join(enabled, ","),
+		"DNSTOOL_CHANGED_FILES="+strings.Join(changed, " "),
+	)
+}
+
+// zoneVolatile matches the records of a generated zone that change on every generation
+// without changing what is served: the SOA, whose serial is bumped each time, and the
+// _dnstool TXT record stamped with the time of the generation.
+var zoneVolatile = regexp.MustCompile(`(?m)^[^;\n]*\sSOA\s[^(\n]*\([^)]*\).*$|^_dnstool\s.*$`)
+
+// contentDigest hashes generated content, leaving out its volatile records so that
+// regenerating unchanged configuration yields the same digest.
+func contentDigest(b []byte) string {
+	sum := sha256.Sum256(zoneVolatile.ReplaceAll(b, nil))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileDigests hashes the content of each of the given files, omitting those that do not
+// exist.
+func fileDigests(paths []string) map[string]string {
+	digests := make(map[string]string, len(paths))
+
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+
+		digests[p] = contentDigest(b)
+	}
+
+	return digests
+}
+
+// changedFiles lists files whose digest differs between two fileDigests results,
+// including those that were created or removed in between.
+func changedFiles(before, after map[string]string) []string {
+	changed := make([]string, 0)
+
+	for p, digest := range after {
+		if before[p] != digest {
+			changed = append(changed, p)
+		}
+	}
+
+	for p := range before {
+		if _, ok := after[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+
+	sort.Strings(changed)
+
+	return changed
+}
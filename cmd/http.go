@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"net"
+	"net/http"
+	"os"
+)
+
+// httpMux is shared by the optional HTTP features (webhooks, API, metrics) so that they
+// are all served from the single HTTP_LISTEN address.
+var httpMux = http.NewServeMux()
+
+// startHTTPServer serves httpMux on HTTP_LISTEN when set.
+func startHTTPServer() error {
+	addr := os.Getenv("HTTP_LISTEN")
+	if addr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Listening for HTTP requests", "listen", l.Addr().String())
+
+	go func() {
+		if err := http.Serve(l, httpMux); err != nil {
+			log.Error("HTTP server stopped", "error", err)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultUnitPath   = "/etc/systemd/system/lancache-dns.service"
+	defaultInstallEnv = "/etc/default/lancache-dns"
+
+	fmtSystemdUnit = `[Unit]
+Description=lancache-dns configuration generator
+Documentation=https://github.com/lancachenet/lancache-dns
+After=network-online.target named.service bind9.service
+Wants=network-online.target
+
+[Service]
+Type=simple
+EnvironmentFile=-%s
+Environment=DNSTOOL_ENV_FILE=%s
+ExecStart=%s generate lancache-dns --daemon --reload
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=10
+
+[Install]
+WantedBy=multi-user.target
+`
+
+	installEnvTemplate = `# Environment for dnstool generate lancache-dns, re-read on systemctl reload.
+# The host's resolv.conf is managed by the distribution, not by dnstool.
+SKIP_RESOLV_CONF=true
+UPSTREAM_DNS=8.8.8.8
+LANCACHE_DNSDOMAIN=cache.lancache.net
+CACHE_DOMAINS_REPO=https://github.com/uklans/cache-domains.git
+# Either a single monolithic cache for every service...
+#USE_GENERIC_CACHE=true
+#LANCACHE_IP=
+# ...or per-service addresses, such as STEAMCACHE_IP=
+`
+
+	fmtInstallNamedOptions = `options {
+	directory "%s";
+};
+`
+)
+
+var (
+	installUnitPath string
+	installEnvFile  string
+	installNamed    string
+	installNoStart  bool
+	installDryRun   bool
+)
+
+var installCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install lancache-dns on a host BIND",
+	Long:  `Create the directories lancache-dns needs, include the generated configuration from a host BIND installation and install a systemd unit running dnstool in daemon mode`,
+	Run: func(_ *cobra.Command, _ []string) {
+		if err := install(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(installCmd)
+
+	installCmd.Flags().StringVar(&installUnitPath, "unit", defaultUnitPath, "Path to write the systemd unit to")
+	installCmd.Flags().StringVar(&installEnvFile, "env-file", defaultInstallEnv, "Environment file read by the unit, created if missing")
+	installCmd.Flags().StringVar(&installNamed, "named-conf", "", "Main BIND configuration to include the generated configuration from, defaulting to that of the detected layout")
+	installCmd.Flags().BoolVar(&installNoStart, "no-start", false, "Install without enabling and starting the unit")
+	installCmd.Flags().BoolVar(&installDryRun, "dry-run", false, "Print the changes without making them")
+}
+
+// installStep logs a change made by install, returning whether to go ahead with it.
+func installStep(msg string, args ...any) bool {
+	if installDryRun {
+		log.Info("Would "+msg, append([]any{"phase", "install"}, args...)...)
+		return false
+	}
+
+	log.Info(strings.ToUpper(msg[:1])+msg[1:], append([]any{"phase", "install"}, args...)...)
+
+	return true
+}
+
+func install() error {
+	if os.Geteuid() != 0 && !installDryRun {
+		return fmt.Errorf("dnstool install must be run as root")
+	}
+
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if binary, err = filepath.EvalSymlinks(binary); err != nil {
+		return err
+	}
+
+	for _, dir := range []string{zonePath, confDir(), filepath.Dir(defaultStateFile), filepath.Dir(domainsPath)} {
+		if _, err = os.Stat(dir); err == nil {
+			continue
+		}
+
+		if installStep("create directory", "dir", dir) {
+			if err = os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = installNamedConfiguration(); err != nil {
+		return err
+	}
+
+	if _, err = os.Stat(installEnvFile); os.IsNotExist(err) && installStep("write environment file", "file", installEnvFile) {
+		if err = os.WriteFile(installEnvFile, []byte(installEnvTemplate), 0644); err != nil {
+			return err
+		}
+	}
+
+	unit := fmt.Sprintf(fmtSystemdUnit, installEnvFile, installEnvFile, binary)
+
+	if installStep("write systemd unit", "file", installUnitPath) {
+		if err = os.WriteFile(installUnitPath, []byte(unit), 0644); err != nil {
+			return err
+		}
+	}
+
+	if installNoStart {
+		return nil
+	}
+
+	name := filepath.Base(installUnitPath)
+
+	for _, args := range [][]string{{"daemon-reload"}, {"enable", "--now", name}} {
+		if !installStep("run systemctl "+strings.Join(args, " "), "unit", name) {
+			continue
+		}
+
+		if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("systemctl %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(out)))
+		}
+	}
+
+	if !installDryRun {
+		log.Info("Installed, edit " + installEnvFile + " and run systemctl reload " + name + " to apply changes")
+	}
+
+	return nil
+}
+
+// installNamedConfiguration wires the generated configuration into the host BIND: the
+// options file gains the rpz response policy, and the main configuration includes
+// cache.conf, which starts out declaring an empty rpz zone so that named can start
+// before the first generation.
+func installNamedConfiguration() error {
+	options, err := os.ReadFile(namedConf)
+	if os.IsNotExist(err) {
+		options, err = []byte(fmt.Sprintf(fmtInstallNamedOptions, layout.Directory)), nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	from, to, err := namedOptionsBody(string(options))
+	if err != nil {
+		return err
+	}
+
+	statements, err := namedStatements(string(options), from, to)
+	if err != nil {
+		return err
+	}
+
+	if firstNamedStatement(statements, "response-policy") < 0 && installStep("add response-policy to options", "file", namedConf) {
+		conf, err := setNamedOption(string(options), "response-policy", `{ zone "rpz"; }`)
+		if err != nil {
+			return err
+		}
+
+		if err = os.WriteFile(namedConf, []byte(conf), 0644); err != nil {
+			return err
+		}
+	}
+
+	if _, err = os.Stat(cacheConf); os.IsNotExist(err) && installStep("create initial cache configuration", "file", cacheConf) {
+		if err = writeRPZZone(createZoneFile(rpzZone), rpzZone); err != nil {
+			return err
+		}
+
+		if _, err = flushZoneFiles(); err != nil {
+			return err
+		}
+
+		if err = os.WriteFile(cacheConf, []byte(fmt.Sprintf(fmtUnqueriedZoneConf, "rpz", rpzZone, "")), 0644); err != nil {
+			return err
+		}
+	}
+
+	if installNamed == "" {
+		installNamed = layout.MainConf
+	}
+
+	named, err := os.ReadFile(installNamed)
+	if err != nil {
+		return fmt.Errorf("BIND does not appear to be installed: %w", err)
+	}
+
+	if len(named) > 0 && named[len(named)-1] != '\n' {
+		named = append(named, '\n')
+	}
+
+	includes := []string{cacheConf}
+	if namedConf != installNamed {
+		includes = append([]string{namedConf}, includes...)
+	}
+
+	for _, include := range includes {
+		if strings.Contains(string(named), `"`+include+`"`) {
+			continue
+		}
+
+		if installStep("include configuration", "file", installNamed, "include", include) {
+			named = append(named, []byte(fmt.Sprintf("include \"%s\";\n", include))...)
+		}
+	}
+
+	if installDryRun {
+		return nil
+	}
+
+	return os.WriteFile(installNamed, named, 0644)
+}
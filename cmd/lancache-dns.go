@@ -1,17 +1,28 @@
 package cmd
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
+
+	"dnstool/pkg/dnsgen"
+)
+
+var (
+	daemonMode     bool
+	daemonInterval time.Duration
+	watchMode      bool
+	reloadMode     bool
+	superviseMode  bool
 )
 
 var lancacheDNSCmd = &cobra.Command{
@@ -19,30 +30,97 @@ var lancacheDNSCmd = &cobra.Command{
 	Short: "Generate configuration for lancache-dns container",
 	Long:  `Generate and manipulate configuration files for lancache-dns container`,
 	Run: func(cmd *cobra.Command, _ []string) {
-		generateLancacheDNS()
+		if err := checkDaemonInterval(); err != nil {
+			log.Fatal(err)
+		}
+
+		dns := generateLancacheDNS()
+
+		if reloadMode {
+			if err := reloadBIND(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if watchMode {
+			if err := watchConfiguration(); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if superviseMode {
+			go superviseNamed()
+		}
+
+		if daemonMode || watchMode || superviseMode {
+			runDaemon(dns, daemonInterval)
+		}
 	},
 }
 
-func generateLancacheDNS() {
-	useGenericCache := "false"
-	if os.Getenv("USE_GENERIC_CACHE") != "" {
-		useGenericCache = os.Getenv("USE_GENERIC_CACHE")
+func init() {
+	lancacheDNSCmd.Flags().BoolVar(&daemonMode, "daemon", false, "Keep running and periodically refresh cache_domains")
+	lancacheDNSCmd.Flags().DurationVar(&daemonInterval, "interval", 6*time.Hour, "Interval between cache_domains refreshes in daemon mode")
+	lancacheDNSCmd.Flags().BoolVar(&reloadMode, "reload", false, "Reload a running named via rndc after generating configuration")
+	lancacheDNSCmd.Flags().BoolVar(&superviseMode, "supervise", false, "Run and supervise named after generating configuration, refreshing on the daemon interval")
+	lancacheDNSCmd.Flags().BoolVar(&watchMode, "watch", false, "Keep running and regenerate when the custom zone or domain files change")
+}
+
+// checkDaemonInterval verifies the --interval the daemon refreshes cache_domains on is
+// positive, before anything is generated.
+func checkDaemonInterval() error {
+	if daemonInterval <= 0 {
+		return fmt.Errorf("--interval must be positive, not %s", daemonInterval)
 	}
 
-	lancacheDNSDomain := "cache.lancache.net"
-	if os.Getenv("LANCACHE_DNSDOMAIN") != "cache.lancache.net" {
-		lancacheDNSDomain = os.Getenv("LANCACHE_DNSDOMAIN")
+	return nil
+}
+
+func generateLancacheDNS() []upstream {
+	if err := loadEnvFile(); err != nil {
+		log.Fatal(err)
 	}
 
-	cacheZone := zonePath + lancacheDNSDomain + ".db"
+	if _, err := loadConfigSource(); err != nil {
+		log.Fatal(err)
+	}
+
+	configureProxy()
+
+	if err := configurePaths(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Info("Using BIND layout", "phase", "config", "layout", layout.Name, "options", namedConf, "zones", zonePath)
+
+	if fixtureDir() != "" {
+		if err := prepareFixture(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := checkWritablePaths(); err != nil {
+		log.Fatal(err)
+	}
+
+	dns, err := configuredUpstreams()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if os.Getenv("UPSTREAM_DOH") != "" && !daemonMode && !watchMode && !superviseMode {
+		log.Warn("UPSTREAM_DOH requires the doh-proxy command or daemon mode to be running", "listen", dohListen())
+	}
+
+	if err := checkUpstreamLoops(dns); err != nil {
+		log.Fatal(err)
+	}
 
-	upstreamDNS := "8.8.8.8"
-	if os.Getenv("UPSTREAM_DNS") != "8.8.8.8" {
-		upstreamDNS = os.Getenv("UPSTREAM_DNS")
+	if err := checkUpstreams(dns); err != nil {
+		log.Fatal(err)
 	}
 
-	dns := cleanIP(upstreamDNS)
-	if err := isIP(dns); err != nil {
+	if err := checkDNSPort(); err != nil {
 		log.Fatal(err)
 	}
 
@@ -54,20 +132,91 @@ func generateLancacheDNS() {
 		log.Fatal(err)
 	}
 
-	cacheIP := os.Getenv("LANCACHE_IP")
-	if err := checkGenericCache(useGenericCache, cacheIP); err != nil {
+	if err := loadRuntimeState(); err != nil {
 		log.Fatal(err)
 	}
 
-	if err := generateConfiguration(useGenericCache, lancacheDNSDomain, cacheIP, cacheZone, dns); err != nil {
+	if err := regenerateLancacheDNS(dns, "startup"); err != nil {
 		log.Fatal(err)
 	}
+
+	return dns
 }
 
-func writeResolverConfiguration(dns []string) error {
-	log.Print("Configuring /etc/resolv.conf to stop from looping to ourself\n\n")
+// regenerateLancacheDNS re-reads the cache configuration from the environment and
+// regenerates all zones from the current contents of the cache_domains checkout.
+func regenerateLancacheDNS(dns []upstream, reason string) error {
+	useGenericCache := "false"
+	if os.Getenv("USE_GENERIC_CACHE") != "" {
+		useGenericCache = os.Getenv("USE_GENERIC_CACHE")
+	}
+
+	lancacheDNSDomain := dnsDomain()
+
+	cacheZone := zonePath + lancacheDNSDomain + ".db"
+
+	cacheIP := os.Getenv("LANCACHE_IP")
+
+	generated := append([]string{cacheConf, cacheZone, rpzZone, namedConf}, writtenZoneFiles()...)
+	if confDGenerated() {
+		generated = append(generated, zonesConf(), optionsConf())
+	}
+
+	if err := runHooks("PRE_GENERATE_HOOK", hookEnv("pre", reason, nil, nil)); err != nil {
+		return err
+	}
+
+	before := fileDigests(generated)
+	started := time.Now()
+
+	err := checkGenericCache(useGenericCache, cacheIP)
+	if err == nil {
+		err = generateConfiguration(useGenericCache, lancacheDNSDomain, cacheIP, cacheZone, dns)
+	}
+
+	recordGeneration(started, err)
+	notifyGeneration(err)
+
+	changed := changedFiles(before, fileDigests(append(generated, writtenZoneFiles()...)))
+	writeAudit(reason, currentStatus(), changed, err)
+
+	if err == nil {
+		rememberEnabledServices(currentStatus())
+	}
 
-	f, err := os.Create("/etc/resolv.conf")
+	if herr := runHooks("POST_GENERATE_HOOK", hookEnv("post", reason, changed, err)); herr != nil {
+		log.Error("Post-generation hook failed", "phase", "hooks", "error", herr)
+	}
+
+	return err
+}
+
+// dnsDomain returns the domain hosting the per-service cache records.
+func dnsDomain() string {
+	lancacheDNSDomain := "cache.lancache.net"
+	if os.Getenv("LANCACHE_DNSDOMAIN") != "cache.lancache.net" {
+		lancacheDNSDomain = os.Getenv("LANCACHE_DNSDOMAIN")
+	}
+
+	return lancacheDNSDomain
+}
+
+func writeResolverConfiguration(dns []upstream) error {
+	resolvConf := resolvConfPath()
+
+	if os.Getenv("SKIP_RESOLV_CONF") == "true" {
+		log.Info("Leaving " + resolvConf + " untouched as SKIP_RESOLV_CONF is set")
+		return nil
+	}
+
+	log.Print("Configuring " + resolvConf + " to stop from looping to ourself\n\n")
+
+	preserved, err := resolverDirectives(resolvConf)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(resolvConf)
 	if err != nil {
 		return err
 	}
@@ -78,12 +227,35 @@ func writeResolverConfiguration(dns []string) error {
 		}
 	}(f)
 
-	if _, err = fmt.Fprintln(f, "# Lancache dns config"); err != nil {
+	if _, err = fmt.Fprintln(f, resolvConfHeader); err != nil {
 		return err
 	}
 
 	for _, d := range dns {
-		if _, err = fmt.Fprintln(f, "nameserver "+d); err != nil {
+		// resolv.conf has no way to express a port or TLS, so such upstreams are only used by named.
+		if d.Port != "" || d.TLS != "" {
+			continue
+		}
+
+		if _, err = fmt.Fprintln(f, "nameserver "+d.IP); err != nil {
+			return err
+		}
+	}
+
+	options := os.Getenv("RESOLV_CONF_OPTIONS")
+
+	for _, line := range preserved {
+		if options != "" && strings.HasPrefix(line, "options") {
+			continue
+		}
+
+		if _, err = fmt.Fprintln(f, line); err != nil {
+			return err
+		}
+	}
+
+	if options != "" {
+		if _, err = fmt.Fprintln(f, "options "+strings.Join(strings.Fields(strings.ReplaceAll(options, ",", " ")), " ")); err != nil {
 			return err
 		}
 	}
@@ -91,6 +263,38 @@ func writeResolverConfiguration(dns []string) error {
 	return nil
 }
 
+// resolvConfPath returns the resolver configuration file to write, RESOLV_CONF_PATH
+// allowing bare-metal and rootless installs to target an alternate file.
+func resolvConfPath() string {
+	if os.Getenv("RESOLV_CONF_PATH") != "" {
+		return os.Getenv("RESOLV_CONF_PATH")
+	}
+
+	return defaultResolvConf
+}
+
+// resolverDirectives returns the search, domain and options lines of an existing
+// resolv.conf so that they survive it being rewritten.
+func resolverDirectives(path string) ([]string, error) {
+	f, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	directives := make([]string, 0)
+
+	for _, line := range strings.Split(string(f), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && (fields[0] == "search" || fields[0] == "domain" || fields[0] == "options") {
+			directives = append(directives, strings.TrimSpace(line))
+		}
+	}
+
+	return directives, nil
+}
+
 func bootstrapDNS() error {
 	cacheDomainsRepo := os.Getenv("CACHE_DOMAINS_REPO")
 	cacheDomainsBranch := os.Getenv("CACHE_DOMAINS_BRANCH")
@@ -100,9 +304,17 @@ func bootstrapDNS() error {
 		noFetch = os.Getenv("NOFETCH")
 	}
 
-	log.Printf("Bootstrapping Lancache-DNS from %s", cacheDomainsRepo)
+	log.Info("Bootstrapping Lancache-DNS", "phase", "bootstrap", "repo", cacheDomainsRepo)
+
+	if err := verifyCacheDomains(); err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(domainsPath + "/.git"); os.IsNotExist(err) {
+		if err = clearSnapshot(domainsPath); err != nil {
+			return err
+		}
+
 		cmd := exec.Command("git", "clone", cacheDomainsRepo, ".")
 		cmd.Dir = domainsPath
 
@@ -110,7 +322,15 @@ func bootstrapDNS() error {
 			"GIT_SSH_COMMAND=ssh -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no")
 
 		if err = cmd.Run(); err != nil {
-			return err
+			if _, serr := os.Stat(domainsPath + "/" + cacheDomain); serr == nil {
+				log.Warn("Failed to clone cache_domains, using existing local copy", "phase", "bootstrap", "error", err)
+				return nil
+			}
+
+			log.Warn("Failed to clone cache_domains", "phase", "bootstrap", "error", err)
+			metrics.fetchErrors.Add(1)
+
+			return extractSnapshot(domainsPath)
 		}
 	}
 
@@ -123,7 +343,8 @@ func bootstrapDNS() error {
 		cmd.Dir = domainsPath
 
 		if err := cmd.Run(); err != nil {
-			log.Print("Failed to update from remote, using local copy of cache_domains")
+			log.Warn("Failed to update from remote, using local copy of cache_domains", "phase", "bootstrap", "error", err)
+			metrics.fetchErrors.Add(1)
 		}
 
 		cmd = exec.Command("git", "reset", "--hard", "origin/"+cacheDomainsBranch)
@@ -151,29 +372,45 @@ func checkGenericCache(useGenericCache, cacheIP string) error {
 	return nil
 }
 
-func generateConfiguration(useGenericCache, lancacheDNSDomain, cacheIP, cacheZone string, dns []string) error {
+func generateConfiguration(useGenericCache, lancacheDNSDomain, cacheIP, cacheZone string, dns []upstream) error {
 	if useGenericCache == "true" {
 		log.Printf(fmtGenericServer, cacheIP, cacheIP)
 	}
 
-	if err := generateCacheConf(); err != nil {
+	// Zone files are only written once generation has succeeded.
+	defer discardZoneFiles()
+
+	if err := refreshDockerCaches(); err != nil {
+		log.Warn("Failed to discover cache containers, using the last known set", "phase", "discovery", "error", err)
+	}
+
+	services, serviceFiles, err := identifyServices()
+	if err != nil {
+		return err
+	}
+
+	g, outcomes, err := checkService(useGenericCache, services, serviceFiles)
+	if err != nil {
 		return err
 	}
 
-	if err := generateCacheZone(lancacheDNSDomain, cacheZone); err != nil {
+	if err = renderZones(g, lancacheDNSDomain, outcomes); err != nil {
 		return err
 	}
 
-	if err := generateRPZZone(); err != nil {
+	if err = warnSignedDomains(dns); err != nil {
 		return err
 	}
 
-	services, serviceFiles, err := identifyServices()
-	if err != nil {
+	if err = generateSiteZones(lancacheDNSDomain, cacheZone); err != nil {
 		return err
 	}
 
-	if err = checkService(useGenericCache, cacheIP, cacheZone, lancacheDNSDomain, services, serviceFiles); err != nil {
+	if err = generateCacheConf(lancacheDNSDomain, cacheZone, dns); err != nil {
+		return err
+	}
+
+	if err = generateCatalogZone(append([]string{lancacheDNSDomain}, rpzZones(pendingServices())...)); err != nil {
 		return err
 	}
 
@@ -183,11 +420,22 @@ func generateConfiguration(useGenericCache, lancacheDNSDomain, cacheIP, cacheZon
 		return err
 	}
 
-	return nil
+	written, err := flushZoneFiles()
+	if err != nil {
+		return err
+	}
+
+	return pruneZoneFiles(written)
 }
 
-func generateCacheConf() error {
-	f, err := os.Create(cacheConf)
+func generateCacheConf(lancacheDNSDomain, cacheZone string, dns []upstream) error {
+	if confDGenerated() {
+		if err := os.MkdirAll(confDir(), 0755); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(zonesConf())
 	if err != nil {
 		return err
 	}
@@ -198,59 +446,213 @@ func generateCacheConf() error {
 		}
 	}(f)
 
-	if _, err = fmt.Fprintln(f, cacheConfTemplate); err != nil {
+	signing, err := cacheZoneSigning()
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	transfer, err := zoneTransferOptions()
+	if err != nil {
+		return err
+	}
 
-func generateCacheZone(lancacheDNSDomain, cacheZone string) error {
-	f, err := os.Create(cacheZone)
+	if _, err = fmt.Fprint(f, tsigKeyConfiguration()); err != nil {
+		return err
+	}
+
+	zones := dnsgen.ZoneStatements(lancacheDNSDomain, cacheZone, signing+transfer, rpzZone, transfer) +
+		rpzServiceZonesConfiguration(pendingServices(), transfer) +
+		catalogZoneConfiguration(transfer)
+
+	forward, err := forwardZoneConfiguration()
 	if err != nil {
 		return err
 	}
 
-	defer func(f *os.File) {
-		if err = f.Close(); err != nil {
-			log.Fatalf("error while closing resource %s: %v", f.Name(), err)
+	views, err := clientViews()
+	if err != nil {
+		return err
+	}
+
+	if len(views) > 0 {
+		policy, err := policyStatement()
+		if err != nil {
+			return err
 		}
-	}(f)
 
-	now := time.Now()
-	if _, err = fmt.Fprintf(f, fmtCacheTemplate, lancacheDNSDomain, strconv.FormatInt(now.Unix(), 10)); err != nil {
+		zones = viewsConfiguration(views, lancacheDNSDomain, cacheZone, zones, forward, policy)
+	} else {
+		zones += forward
+	}
+
+	if _, err = fmt.Fprint(f, zones); err != nil {
 		return err
 	}
 
-	return nil
-}
+	if _, err = fmt.Fprint(f, tlsConfiguration(dns)); err != nil {
+		return err
+	}
 
-func generateRPZZone() error {
-	f, err := os.Create(rpzZone)
+	filter, err := filterAAAAConfiguration()
 	if err != nil {
 		return err
 	}
 
-	defer func(f *os.File) {
-		if err = f.Close(); err != nil {
-			log.Fatalf("error while closing resource %s: %v", f.Name(), err)
+	if _, err = fmt.Fprint(f, filter); err != nil {
+		return err
+	}
+
+	anchors, err := trustAnchorsConfiguration()
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprint(f, anchors); err != nil {
+		return err
+	}
+
+	logging, err := rpzLoggingConfiguration()
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprint(f, logging); err != nil {
+		return err
+	}
+
+	if os.Getenv("BIND_STATISTICS") == "true" {
+		listen := "127.0.0.1"
+		if os.Getenv("BIND_STATISTICS_LISTEN") != "" {
+			listen = os.Getenv("BIND_STATISTICS_LISTEN")
 		}
-	}(f)
 
-	if _, err = fmt.Fprintln(f, rpzTemplate); err != nil {
+		port := "8053"
+		if os.Getenv("BIND_STATISTICS_PORT") != "" {
+			port = os.Getenv("BIND_STATISTICS_PORT")
+		}
+
+		allow := "127.0.0.1;"
+		if os.Getenv("BIND_STATISTICS_ALLOW") != "" {
+			allow = strings.Join(cleanIP(os.Getenv("BIND_STATISTICS_ALLOW")), "; ") + ";"
+		}
+
+		if _, err = fmt.Fprintf(f, fmtStatisticsChannels, listen, port, allow); err != nil {
+			return err
+		}
+	}
+
+	includes, err := confDIncludes()
+	if err != nil {
+		return err
+	}
+
+	if !confDGenerated() {
+		_, err = fmt.Fprint(f, includes)
+
 		return err
 	}
 
+	// CACHE_CONF, as included by named.conf, then only includes the fragments.
+	return os.WriteFile(cacheConf, []byte(fmt.Sprintf("\tinclude \"%s\";\n", zonesConf())+includes), 0644)
+}
+
+// renderZones renders the cache zone and the response policy zones of the planned
+// services with the bind and rpz backends, each zone following on from the serial of its
+// copy on disk. The zone statements of the bind backend are left out, as cache.conf is
+// written with options the backends know nothing of.
+func renderZones(g *dnsgen.Generator, lancacheDNSDomain string, outcomes []dnsgen.Outcome) error {
+	cfg := g.Config
+	cfg.Domain = lancacheDNSDomain
+
+	records, err := apexRecords(lancacheDNSDomain, cfg.NS)
+	if err != nil {
+		return err
+	}
+
+	cfg.CacheRecords = append(records, fmt.Sprintf(`_dnstool IN TXT "version=%s" "commit=%s" "generated=%s";`,
+		version, cacheDomainsRevision(), time.Now().UTC().Format(time.RFC3339)))
+
+	names := []string{lancacheDNSDomain + ".db", "rpz.db"}
+	for _, o := range outcomes {
+		names = append(names, dnsgen.ServiceRPZZone(o.Service)+".db")
+	}
+
+	cfg.Serials = map[string]uint32{}
+	for _, name := range names {
+		if cfg.Serials[name], err = nextSerial(zonePath+name, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	// The zones are written straight into the zone files of the generation, which move
+	// to disk once they grow large; the zone statements are written by generateCacheConf.
+	create := func(name string, size int) io.Writer {
+		if !strings.HasSuffix(name, ".db") {
+			return io.Discard
+		}
+
+		w := createZoneFile(zonePath + name)
+		w.Grow(size)
+
+		return w
+	}
+
+	for _, name := range []string{"bind", "rpz"} {
+		b, ok := dnsgen.Lookup(name)
+		if !ok {
+			return fmt.Errorf("Output backend: %s is not registered", name)
+		}
+
+		sb, ok := b.(dnsgen.StreamingBackend)
+		if !ok {
+			return fmt.Errorf("Output backend: %s cannot write zone files", name)
+		}
+
+		if err = sb.RenderTo(outcomes, cfg, create); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func identifyServices() ([]string, []string, error) {
+// apexRecords returns the records publishing LANCACHE_DNS_IP as the address of the cache
+// domain itself and, when the NS hostname lies within the domain, of the name server too.
+func apexRecords(lancacheDNSDomain, ns string) ([]string, error) {
+	ips := uniqueIPs(cleanIP(os.Getenv("LANCACHE_DNS_IP")))
+	if err := isIP(ips); err != nil {
+		return nil, err
+	}
+
+	owners := []string{"@"}
+	if host, ok := strings.CutSuffix(ns, "."+lancacheDNSDomain+"."); ok {
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("LANCACHE_DNS_NS %s is within %s so LANCACHE_DNS_IP must be set", ns, lancacheDNSDomain)
+		}
+
+		owners = append(owners, host)
+	}
+
+	records := make([]string, 0, len(owners)*len(ips))
+
+	for _, owner := range owners {
+		for _, ip := range ips {
+			records = append(records, owner+" IN "+addressRRType(ip)+" "+ip+";")
+		}
+	}
+
+	return records, nil
+}
+
+// identifyServices returns the services of cache_domains, in order, along with the
+// domain_files of each, every one of which is loaded as dnsgen.LoadCacheDomains does.
+func identifyServices() ([]string, [][]string, error) {
 	f, err := os.ReadFile(domainsPath + "/" + cacheDomain)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	var cacheData CacheFile
+	var cacheData dnsgen.CacheFile
 
 	err = json.Unmarshal(f, &cacheData)
 	if err != nil {
@@ -258,217 +660,253 @@ func identifyServices() ([]string, []string, error) {
 	}
 
 	serviceMap := make([]string, 0)
-	serviceFileMap := make([]string, 0)
+	serviceFileMap := make([][]string, 0)
 
 	for _, services := range cacheData.CacheDomains {
 		service := services.Name
 		serviceMap = append(serviceMap, service)
-		serviceFileMap = append(serviceFileMap, services.DomainFiles[0])
+		serviceFileMap = append(serviceFileMap, services.DomainFiles)
 	}
 
 	return serviceMap, serviceFileMap, nil
 }
 
-func checkService(genericCache, cacheIP, cacheZone, lancacheDNSDomain string, services, serviceFiles []string) error {
-	for i, service := range services {
-		log.Printf("Processing service: %s", service)
+// cacheService returns the name of the service of cache_domains matching name, in any
+// case, or an error when there is none.
+func cacheService(name string) (string, error) {
+	services, _, err := identifyServices()
+	if err != nil {
+		return "", err
+	}
 
-		if err := generateService(genericCache, cacheIP, cacheZone, lancacheDNSDomain, service, serviceFiles[i]); err != nil {
-			return err
+	for _, s := range services {
+		if strings.EqualFold(s, name) {
+			return strings.ToLower(s), nil
 		}
 	}
 
-	return nil
+	return "", fmt.Errorf("%s is not a service in cache_domains", strings.ToLower(name))
 }
 
-func generateService(genericCache, cacheIP, cacheZone, lancacheDNSDomain, service, serviceFile string) error {
-	enabled := false
-	populate := false
-	ip := ""
+// checkService plans every service on a pool of GENERATE_WORKERS workers, one per CPU by
+// default, loading the domains of each service rewritten. The outcomes are returned, and
+// recorded, in service order so that the output does not depend on scheduling.
+func checkService(genericCache string, services []string, serviceFiles [][]string) (*dnsgen.Generator, []dnsgen.Outcome, error) {
+	workers, err := generateWorkers()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	service = strings.ToUpper(service)
-	if genericCache == "true" {
-		if os.Getenv("DISABLE_"+service) != "true" {
-			enabled = true
-		}
-	} else {
-		log.Printf("Testing for presence of %sCACHE_IP", service)
-		if _, ok := os.LookupEnv(service + "CACHE_IP"); ok {
-			enabled = true
-		}
+	if err = holdNewServices(genericCache, services); err != nil {
+		return nil, nil, err
 	}
 
-	if enabled {
-		if os.Getenv(service+"CACHE_IP") != "" {
-			ip = os.Getenv(service + "CACHE_IP")
-		} else {
-			ip = cacheIP
-		}
+	g, err := newGenerator(namedServices(services))
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if ip != "" {
-			log.Printf("Enabling service with IP(s): %s", ip)
+	type result struct {
+		outcome dnsgen.Outcome
+		status  serviceStatus
+		err     error
+	}
 
-			service = strings.ToLower(service)
+	results := make([]result, len(services))
+	next := make(chan int)
 
-			f, err := os.OpenFile(rpzZone, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return err
-			}
+	var wg sync.WaitGroup
 
-			defer func(f *os.File) {
-				if err = f.Close(); err != nil {
-					log.Fatalf("error while closing resource %s: %v", f.Name(), err)
-				}
-			}(f)
+	for w := 0; w < min(workers, len(services)); w++ {
+		wg.Add(1)
 
-			if _, err = fmt.Fprintln(f, `;## `+service); err != nil {
-				return err
-			}
+		go func() {
+			defer wg.Done()
 
-			ips := cleanIP(ip)
-			if err := isPrivateIP(ips); err != nil {
-				return err
-			}
+			for i := range next {
+				log.Info("Processing service", "phase", "generate", "service", services[i])
 
-			for _, ip := range ips {
-				c, err := os.OpenFile(cacheZone, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-				if err != nil {
-					return err
-				}
-
-				defer func(c *os.File) {
-					if err = c.Close(); err != nil {
-						log.Fatalf("error while closing resource %s: %v", c.Name(), err)
-					}
-				}(c)
-
-				if _, err = fmt.Fprintln(c, service+` IN A `+ip+`;`); err != nil {
-					return err
-				}
-
-				r, err := os.OpenFile(rpzZone, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-				if err != nil {
-					return err
-				}
-
-				defer func(r *os.File) {
-					if err = r.Close(); err != nil {
-						log.Fatalf("error while closing resource %s: %v", r.Name(), err)
-					}
-				}(r)
-
-				revIP := reverseIPv4(ip)
-				if _, err = fmt.Fprintln(r, `32.`+revIP+`.rpz-client-ip      CNAME rpz-passthru.;`); err != nil {
-					return err
-				}
-
-				populate = true
+				o, status, err := planService(g, services[i], serviceFiles[i])
+				results[i] = result{outcome: o, status: status, err: err}
 			}
-		} else {
-			return fmt.Errorf("Could not find IP for requested service: %s", service)
-		}
-	} else {
-		log.Printf("Skipping service: %s", strings.ToLower(service))
+		}()
 	}
 
-	if populate {
-		if err := generateDomains(serviceFile, lancacheDNSDomain, service); err != nil {
-			return err
+	for i := range services {
+		next <- i
+	}
+
+	close(next)
+	wg.Wait()
+
+	outcomes := make([]dnsgen.Outcome, 0, len(results))
+
+	for _, r := range results {
+		if r.err != nil {
+			return nil, nil, r.err
 		}
+
+		outcomes = append(outcomes, r.outcome)
+		recordService(r.status)
 	}
 
-	return nil
+	return g, outcomes, nil
 }
 
-func generateDomains(serviceFile, lancacheDNSDomain, service string) error {
-	f, err := os.Open(domainsPath + "/" + serviceFile)
-	if err != nil {
-		return err
+// generateWorkers returns the number of services generated concurrently.
+func generateWorkers() (int, error) {
+	if os.Getenv("GENERATE_WORKERS") == "" {
+		return runtime.NumCPU(), nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("GENERATE_WORKERS"))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("GENERATE_WORKERS value: %s is not a positive number", os.Getenv("GENERATE_WORKERS"))
 	}
 
-	r, err := os.OpenFile(rpzZone, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return n, nil
+}
+
+// newGenerator returns the generator planning services, configured by the environment
+// along with the runtime state: overrides and pending services, the caches discovered
+// for each service, schedules and the health of the caches. Generation and every command
+// reporting what it would do plan through it, so that they never disagree.
+func newGenerator(services []dnsgen.Service) (*dnsgen.Generator, error) {
+	cfg, err := dnsgen.ConfigFromEnv(os.LookupEnv, services)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer func(f *os.File) {
-		if err = f.Close(); err != nil {
-			log.Fatalf("error while closing resource %s: %v", f.Name(), err)
-		}
-	}(f)
-	defer func(r *os.File) {
-		if err = r.Close(); err != nil {
-			log.Fatalf("error while closing resource %s: %v", r.Name(), err)
+	for name, sc := range cfg.Services {
+		sc.DiscoveredIP = dockerCacheIP(name)
+		sc.Pending = isPendingService(name)
+
+		if o, ok := serviceOverrideFor(name); ok {
+			sc.Enabled, sc.IP = o.Enabled, o.IP
 		}
-	}(r)
 
-	reader := bufio.NewReader(f)
+		cfg.Services[name] = sc
+	}
 
-	for {
-		line, _, err := reader.ReadLine()
+	now := time.Now()
+	cfg.Active = func(service string) (bool, error) {
+		return scheduleActive(service, now)
+	}
 
-		if err == io.EOF {
-			break
-		}
+	cfg.Addresses = cacheAddresses
+	cfg.Healthy = healthyAddresses
 
-		if strings.HasPrefix(string(line), "#") {
-			continue
-		}
+	return dnsgen.New(cfg, services), nil
+}
 
-		if _, err = fmt.Fprintln(r, strings.TrimSpace(string(line))+" IN CNAME "+service+"."+lancacheDNSDomain+".;"); err != nil {
-			return err
-		}
+// namedServices returns the services with the given names, without their domains.
+func namedServices(names []string) []dnsgen.Service {
+	services := make([]dnsgen.Service, 0, len(names))
+	for _, name := range names {
+		services = append(services, dnsgen.Service{Name: name})
 	}
 
-	return nil
+	return services
 }
 
-func finaliseConfiguration(dns []string) error {
-	if ip := os.Getenv("PASSTHRU_IPS"); ip != "" {
-		ips := cleanIP(ip)
-		if err := isIP(ips); err != nil {
-			return err
+// planService plans a single service with g, loading the domains of a service that is
+// rewritten from serviceFiles, and returns its outcome along with the status recorded for
+// it.
+func planService(g *dnsgen.Generator, service string, serviceFiles []string) (dnsgen.Outcome, serviceStatus, error) {
+	o, err := g.PlanService(dnsgen.Service{Name: service})
+	if err != nil {
+		return dnsgen.Outcome{}, serviceStatus{}, err
+	}
+
+	status := serviceStatus{Name: o.Service}
+
+	switch o.Policy {
+	case dnsgen.PolicyBlock:
+		log.Info("Blocking service", "phase", "generate", "service", o.Service)
+		status.Policy = "block"
+	case dnsgen.PolicyForward:
+		log.Info("Forwarding service", "phase", "generate", "service", o.Service, "upstream", serviceForwarders(o.Service))
+		status.Policy = "forward"
+
+		return o, status, nil
+	case dnsgen.PolicyPassthru:
+		log.Info("Passing service through", "phase", "generate", "service", o.Service)
+		status.Policy = "passthru"
+	case dnsgen.PolicyEnabled:
+		log.Info("Enabling service", "phase", "generate", "service", o.Service, "ip", strings.Join(o.IPs, " "))
+		status.Enabled, status.IPs, status.Weights = true, o.IPs, o.Weights
+	default:
+		switch {
+		case o.Policy == dnsgen.PolicyPending:
+			log.Info("Service is awaiting approval", "phase", "generate", "service", o.Service)
+			status.Policy = "pending"
+		case o.Reason == dnsgen.ReasonInactive:
+			log.Info("Service is outside its schedule", "phase", "generate", "service", o.Service)
+		case o.Reason == dnsgen.ReasonDown:
+			log.Warn("Every cache for the service is down, passing it through", "phase", "generate", "service", o.Service)
+
+			return o, status, nil
 		}
 
-		for _, ip := range ips {
-			f, err := os.OpenFile(rpzZone, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				return err
-			}
+		log.Info("Skipping service", "phase", "generate", "service", o.Service)
 
-			defer func(f *os.File) {
-				if err = f.Close(); err != nil {
-					log.Fatalf("error while closing resource %s: %v", f.Name(), err)
-				}
-			}(f)
+		return o, status, nil
+	}
 
-			if _, err = fmt.Fprintln(f, `;## Additional RPZ passthroughs`); err != nil {
-				return err
-			}
+	domains, err := generationDomains(o.Service, serviceFiles)
+	if err != nil {
+		return dnsgen.Outcome{}, serviceStatus{}, err
+	}
 
-			revIP := reverseIPv4(ip)
-			if _, err = fmt.Fprintln(f, `32.`+revIP+`.rpz-client-ip      CNAME rpz-passthru.`); err != nil {
-				return err
-			}
+	for _, d := range domains {
+		o.Domains = append(o.Domains, d.Domain)
+	}
+
+	status.Domains = len(o.Domains)
+
+	return o, status, nil
+}
+
+// generationDomains returns the domains generated for a service, along with where each
+// comes from: those of each of serviceFiles in turn followed by the runtime custom domains attached to it,
+// lower cased, without trailing dots and keeping the first source of any listed twice.
+func generationDomains(service string, serviceFiles []string) ([]listedDomain, error) {
+	domains := make([]listedDomain, 0)
+	seen := map[string]bool{}
+
+	add := func(domain, source string) {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain == "" || seen[domain] {
+			return
 		}
+
+		seen[domain] = true
+		domains = append(domains, listedDomain{Domain: domain, Source: source})
 	}
 
-	if _, err := os.Stat(customZone); os.IsNotExist(err) {
-		f, err := os.Create(customZone)
+	for _, serviceFile := range serviceFiles {
+		listed, err := readServiceFile(serviceFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		defer func(f *os.File) {
-			if err = f.Close(); err != nil {
-				log.Fatalf("error while closing resource %s: %v", f.Name(), err)
-			}
-		}(f)
+		for _, d := range listed {
+			add(d, serviceFile)
+		}
+	}
+
+	for _, d := range customDomainsFor(service) {
+		add(d, "runtime")
 	}
 
-	f, err := os.OpenFile(rpzZone, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return domains, nil
+}
+
+// readServiceFile returns the domains listed in serviceFile of the domains directory.
+func readServiceFile(serviceFile string) ([]string, error) {
+	f, err := os.Open(domainsPath + "/" + serviceFile)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer func(f *os.File) {
@@ -477,34 +915,111 @@ func finaliseConfiguration(dns []string) error {
 		}
 	}(f)
 
-	if _, err = fmt.Fprintln(f, "$INCLUDE "+customZone); err != nil {
+	return dnsgen.ReadDomains(f)
+}
+
+func finaliseConfiguration(dns []upstream) error {
+	if err := generateSitePassthru(); err != nil {
 		return err
 	}
 
-	if dns != nil {
-		f, err := os.ReadFile(namedConf)
-		if err != nil {
-			return err
-		}
+	if err := generateDoHCanary(); err != nil {
+		return err
+	}
 
-		lines := strings.Split(string(f), "\n")
+	if err := generateDoHBlocklist(); err != nil {
+		return err
+	}
 
-		r := strings.NewReplacer("#ENABLE_UPSTREAM_DNS#", "", "dns_ip", strings.Join(dns, "; "))
-		if dnssec := os.Getenv("ENABLE_DNSSEC_VALIDATION"); dnssec == "true" {
-			r = strings.NewReplacer("#ENABLE_UPSTREAM_DNS#", "", "dns_ip", strings.Join(dns, "; "), "dnssec-validation no", "dnssec-validation auto")
-		}
+	if _, err := os.Stat(customZone); os.IsNotExist(err) {
+		createZoneFile(customZone)
+	}
+
+	if _, err := fmt.Fprintln(appendZoneFile(rpzZone), "$INCLUDE "+customZone); err != nil {
+		return err
+	}
+
+	if err := generateNamedOptions(dns); err != nil {
+		return err
+	}
+
+	log.Info("Finished bootstrapping.", "phase", "finalise")
+
+	return nil
+}
+
+// generateNamedOptions applies the upstream and tuning options to named.conf.options,
+// first substituting the placeholders of the stock lancache-dns template.
+func generateNamedOptions(dns []upstream) error {
+	f, err := os.ReadFile(namedConf)
+	if err != nil {
+		return err
+	}
+
+	output := string(f)
+
+	if dns != nil {
+		lines := strings.Split(output, "\n")
+
+		r := strings.NewReplacer("#ENABLE_UPSTREAM_DNS#", "", "dns_ip", forwarderList(dns))
 
 		for i, line := range lines {
 			lines[i] = r.Replace(line)
 		}
 
-		output := strings.Join(lines, "\n")
-		if err = os.WriteFile(namedConf, []byte(output), 0644); err != nil {
+		output = strings.Join(lines, "\n")
+	}
+
+	options, err := namedConfOptions(dns)
+	if err != nil {
+		return err
+	}
+
+	options, owned := ownOptions(options)
+
+	if confDGenerated() {
+		err = writeOptionsFragment(output, options)
+	} else {
+		if output, err = setNamedOptions(output, options); err != nil {
 			return err
 		}
+
+		err = os.WriteFile(namedConf, []byte(output), 0644)
+	}
+
+	if err != nil {
+		return err
 	}
 
-	log.Print("Finished bootstrapping.")
+	if setOwnedNamedOptions(owned) {
+		if err = saveRuntimeState(); err != nil {
+			log.Warn("Failed to record the options set", "phase", "finalise", "file", stateFile(), "error", err)
+		}
+	}
 
 	return nil
 }
+
+// ownOptions appends to options the removal of the statements set by the last generation
+// that no longer are, as when their variable has been cleared, returning them along with
+// the statements now set.
+func ownOptions(options [][2]string) ([][2]string, []string) {
+	set := make([]string, 0, len(options))
+	named := map[string]bool{}
+
+	for _, o := range options {
+		if o[1] != "" && !named[o[0]] {
+			set = append(set, o[0])
+		}
+
+		named[o[0]] = true
+	}
+
+	for _, name := range ownedNamedOptions() {
+		if !named[name] {
+			options = append(options, [2]string{name, ""})
+		}
+	}
+
+	return options, set
+}
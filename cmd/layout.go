@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// bindLayout describes where a distribution's BIND package keeps its configuration.
+type bindLayout struct {
+	Name string
+	// ConfDir holds named.conf and, for the generated configuration, cache.conf.
+	ConfDir string
+	// MainConf is the configuration named is started with.
+	MainConf string
+	// OptionsConf holds the options block, which is MainConf itself on distributions
+	// without a separate named.conf.options.
+	OptionsConf string
+	// ZoneDir holds the generated zone files.
+	ZoneDir string
+	// Directory is the working directory of named.
+	Directory string
+	RNDCKey   string
+	User      string
+}
+
+// bindLayouts are the layouts of the supported distributions. debian also matches the
+// official lancache-dns image.
+var bindLayouts = map[string]bindLayout{
+	"debian": {
+		Name:        "debian",
+		ConfDir:     "/etc/bind",
+		MainConf:    "/etc/bind/named.conf",
+		OptionsConf: "/etc/bind/named.conf.options",
+		ZoneDir:     "/etc/bind/cache/",
+		Directory:   "/var/cache/bind",
+		RNDCKey:     "/etc/bind/rndc.key",
+		User:        "bind",
+	},
+	"rhel": {
+		Name:        "rhel",
+		ConfDir:     "/etc/named",
+		MainConf:    "/etc/named.conf",
+		OptionsConf: "/etc/named.conf",
+		ZoneDir:     "/var/named/cache/",
+		Directory:   "/var/named",
+		RNDCKey:     "/etc/rndc.key",
+		User:        "named",
+	},
+	"alpine": {
+		Name:        "alpine",
+		ConfDir:     "/etc/bind",
+		MainConf:    "/etc/bind/named.conf",
+		OptionsConf: "/etc/bind/named.conf",
+		ZoneDir:     "/var/bind/cache/",
+		Directory:   "/var/bind",
+		RNDCKey:     "/etc/bind/rndc.key",
+		User:        "named",
+	},
+}
+
+// The paths generation writes to, set from the detected layout and the environment by
+// configurePaths.
+var (
+	layout      = bindLayouts["debian"]
+	domainsPath = defaultDomainsPath
+	cacheConf   = layout.ConfDir + "/cache.conf"
+	namedConf   = layout.OptionsConf
+	zonePath    = layout.ZoneDir
+	rpzZone     = zonePath + "rpz.db"
+	customZone  = zonePath + "custom.db"
+)
+
+// configurePaths selects the BIND layout from BIND_LAYOUT or by detecting the host
+// distribution, then applies the NAMED_CONF_OPTIONS, CACHE_CONF, ZONE_PATH and
+// CACHE_DOMAINS_DIR overrides.
+func configurePaths() error {
+	applyFixtureEnvironment()
+
+	name := os.Getenv("BIND_LAYOUT")
+	if name == "" || name == "auto" {
+		name = detectBINDLayout()
+	}
+
+	l, ok := bindLayouts[name]
+	if !ok {
+		return fmt.Errorf("BIND_LAYOUT value: %s is not one of auto, debian, rhel or alpine", name)
+	}
+
+	layout = l
+	namedConf = l.OptionsConf
+	cacheConf = filepath.Join(l.ConfDir, "cache.conf")
+	zonePath = l.ZoneDir
+
+	if os.Getenv("NAMED_CONF_OPTIONS") != "" {
+		namedConf = os.Getenv("NAMED_CONF_OPTIONS")
+	}
+
+	if os.Getenv("CACHE_CONF") != "" {
+		cacheConf = os.Getenv("CACHE_CONF")
+	}
+
+	if os.Getenv("ZONE_PATH") != "" {
+		zonePath = strings.TrimSuffix(os.Getenv("ZONE_PATH"), "/") + "/"
+	}
+
+	rpzZone = zonePath + "rpz.db"
+	customZone = zonePath + "custom.db"
+
+	domainsPath = defaultDomainsPath
+	if os.Getenv("CACHE_DOMAINS_DIR") != "" {
+		domainsPath = strings.TrimSuffix(os.Getenv("CACHE_DOMAINS_DIR"), "/")
+	}
+
+	return nil
+}
+
+// detectBINDLayout identifies the host distribution from /etc/os-release, falling back
+// to the configuration files present and finally to the Debian layout.
+func detectBINDLayout() string {
+	ids := osReleaseIDs()
+
+	for _, id := range ids {
+		switch id {
+		case "debian", "ubuntu":
+			return "debian"
+		case "rhel", "fedora", "centos", "rocky", "almalinux":
+			return "rhel"
+		case "alpine":
+			return "alpine"
+		}
+	}
+
+	switch {
+	case fileExists("/etc/bind/named.conf.options"):
+		return "debian"
+	case fileExists("/etc/named.conf"):
+		return "rhel"
+	case fileExists("/etc/alpine-release"):
+		return "alpine"
+	}
+
+	return "debian"
+}
+
+// osReleaseIDs returns ID followed by the entries of ID_LIKE from /etc/os-release.
+func osReleaseIDs() []string {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return nil
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var id, like []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		value = strings.Trim(value, `"'`)
+
+		switch key {
+		case "ID":
+			id = []string{value}
+		case "ID_LIKE":
+			like = strings.Fields(value)
+		}
+	}
+
+	return append(id, like...)
+}
+
+// rndcKey returns RNDC_KEY, or the layout's key file when it exists.
+func rndcKey() string {
+	if os.Getenv("RNDC_KEY") != "" {
+		return os.Getenv("RNDC_KEY")
+	}
+
+	if fileExists(layout.RNDCKey) {
+		return layout.RNDCKey
+	}
+
+	return ""
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
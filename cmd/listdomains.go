@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var listDomainsJSON bool
+
+var listDomainsCmd = &cobra.Command{
+	Use:   "list-domains <service>",
+	Short: "List the domains intercepted for a service",
+	Long:  `Print the merged domain list of a service as it is generated: the domains of its cache_domains file followed by the custom domains attached to it at runtime, lower cased, without trailing dots and with duplicates dropped, along with where each comes from, so that what a service intercepts can be checked before it is enabled`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		quietLogging()
+
+		domains, err := listDomains(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if listDomainsJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err = enc.Encode(domains); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "DOMAIN\tSOURCE\n")
+
+		for _, d := range domains {
+			fmt.Fprintf(w, "%s\t%s\n", d.Domain, d.Source)
+		}
+
+		_ = w.Flush()
+	},
+}
+
+func init() {
+	listDomainsCmd.Flags().BoolVar(&listDomainsJSON, "json", false, "Output as JSON")
+}
+
+// listedDomain is a domain of a service along with the domain file it is listed in, or
+// runtime for a custom domain.
+type listedDomain struct {
+	Domain string `json:"domain"`
+	Source string `json:"source"`
+}
+
+// listDomains returns the domains generated for service.
+func listDomains(service string) ([]listedDomain, error) {
+	if err := loadEnvFile(); err != nil {
+		return nil, err
+	}
+
+	if err := loadRuntimeState(); err != nil {
+		return nil, err
+	}
+
+	names, serviceFiles, err := identifyServices()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, name := range names {
+		if strings.EqualFold(name, service) {
+			return generationDomains(name, serviceFiles[i])
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not a service in cache_domains", strings.ToLower(service))
+}
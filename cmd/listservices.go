@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var listServicesJSON bool
+
+var listServicesCmd = &cobra.Command{
+	Use:   "list-services",
+	Short: "List the services of cache_domains and how they are generated",
+	Long:  `Evaluate the configuration as a generation would, without writing any zone, and list each service of cache_domains.json with whether it is enabled, the policy applied otherwise, the cache IPs its domains resolve to and the number of domains it holds`,
+	Args:  cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		quietLogging()
+
+		services, err := listServices()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if listServicesJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err = enc.Encode(services); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "SERVICE\tSTATUS\tIPS\tDOMAINS\n")
+
+		for _, s := range services {
+			ips := strings.Join(s.IPs, ", ")
+			if ips == "" {
+				ips = "-"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", s.Name, serviceState(s), ips, s.Domains)
+		}
+
+		_ = w.Flush()
+	},
+}
+
+func init() {
+	listServicesCmd.Flags().BoolVar(&listServicesJSON, "json", false, "Output as JSON")
+}
+
+// listServices plans each service as a generation would, returning the outcomes it would
+// record with the count of the domains generated for every service, not only those
+// enabled.
+func listServices() ([]serviceStatus, error) {
+	if err := loadEnvFile(); err != nil {
+		return nil, err
+	}
+
+	if _, err := loadConfigSource(); err != nil {
+		return nil, err
+	}
+
+	if err := loadRuntimeState(); err != nil {
+		return nil, err
+	}
+
+	useGenericCache := "false"
+	if os.Getenv("USE_GENERIC_CACHE") != "" {
+		useGenericCache = os.Getenv("USE_GENERIC_CACHE")
+	}
+
+	if err := checkGenericCache(useGenericCache, os.Getenv("LANCACHE_IP")); err != nil {
+		return nil, err
+	}
+
+	if err := refreshDockerCaches(); err != nil {
+		log.Warn("Failed to discover cache containers", "phase", "discovery", "error", err)
+	}
+
+	names, serviceFiles, err := identifyServices()
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := newGenerator(namedServices(names))
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]serviceStatus, 0, len(names))
+
+	for i, name := range names {
+		_, status, err := planService(g, name, serviceFiles[i])
+		if err != nil {
+			return nil, err
+		}
+
+		domains, err := generationDomains(name, serviceFiles[i])
+		if err != nil {
+			return nil, err
+		}
+
+		status.Domains = len(domains)
+		services = append(services, status)
+	}
+
+	return services, nil
+}
+
+// serviceState describes how a service is generated: enabled, disabled or the policy
+// keeping it from its cache.
+func serviceState(s serviceStatus) string {
+	switch {
+	case s.Enabled:
+		return "enabled"
+	case s.Policy != "":
+		return s.Policy
+	default:
+		return "disabled"
+	}
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	log = leveledLogger{slog.New(&plainHandler{w: os.Stdout, level: slog.LevelInfo, mu: &sync.Mutex{}})}
+)
+
+// leveledLogger wraps slog with the Print/Fatal helpers used throughout the tool.
+type leveledLogger struct {
+	*slog.Logger
+}
+
+func (l leveledLogger) Print(v ...any) {
+	l.Info(fmt.Sprint(v...))
+}
+
+func (l leveledLogger) Printf(format string, v ...any) {
+	l.Info(fmt.Sprintf(format, v...))
+}
+
+func (l leveledLogger) Fatal(v ...any) {
+	l.Error(fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+func (l leveledLogger) Fatalf(format string, v ...any) {
+	l.Error(fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// With returns a logger that adds the given attributes to every record.
+func (l leveledLogger) With(args ...any) leveledLogger {
+	return leveledLogger{l.Logger.With(args...)}
+}
+
+// configureLogging selects the log format (LOG_FORMAT=text|json) and minimum level
+// (LOG_LEVEL=debug|info|warn|error).
+func configureLogging() {
+	level := slog.LevelInfo
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil && os.Getenv("LOG_LEVEL") != "" {
+		fmt.Fprintf(os.Stderr, "Invalid LOG_LEVEL %q, using info\n", os.Getenv("LOG_LEVEL"))
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = &plainHandler{w: os.Stdout, level: level, mu: &sync.Mutex{}}
+	}
+
+	log = leveledLogger{slog.New(handler)}
+}
+
+// plainHandler writes the bare message followed by any attributes as key=value pairs,
+// preserving the human-oriented console output of the tool.
+type plainHandler struct {
+	w     io.Writer
+	level slog.Level
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+
+	if r.Level >= slog.LevelWarn {
+		b.WriteString(r.Level.String() + ": ")
+	}
+
+	b.WriteString(r.Message)
+
+	write := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	}
+
+	for _, a := range h.attrs {
+		write(a)
+	}
+
+	r.Attrs(write)
+
+	if !strings.HasSuffix(r.Message, "\n") {
+		b.WriteString("\n")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, err := io.WriteString(h.w, b.String())
+
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &plainHandler{w: h.w, level: h.level, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...), mu: h.mu}
+}
+
+func (h *plainHandler) WithGroup(_ string) slog.Handler {
+	return h
+}
+
+// quietLogging restricts logging to warnings and errors on stderr, for commands whose
+// standard output is a report to be read or parsed.
+func quietLogging() {
+	log = leveledLogger{slog.New(&plainHandler{w: os.Stderr, level: slog.LevelWarn, mu: &sync.Mutex{}})}
+}
@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const mdnsTTL = 120
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsRecord is a single record published over mDNS. Unique records are announced with
+// the cache-flush bit so that stale copies are replaced rather than merged.
+type mdnsRecord struct {
+	name   dnsmessage.Name
+	rtype  dnsmessage.Type
+	unique bool
+	body   dnsmessage.ResourceBody
+}
+
+// mdnsService is a DNS-SD service instance published by the responder.
+type mdnsService struct {
+	service, instance, target string
+	port                      int
+	txt                       []string
+}
+
+// startMDNS advertises the resolver over mDNS/DNS-SD when MDNS_ADVERTISE is enabled, as
+// a _dns._udp service and, when LANCACHE_IP is set, the cache heartbeat as an _http._tcp
+// service, so that troubleshooting tools can find both without being told where to look.
+func startMDNS() error {
+	if os.Getenv("MDNS_ADVERTISE") != "true" {
+		return nil
+	}
+
+	records, err := mdnsRecords()
+	if err != nil {
+		return err
+	}
+
+	var iface *net.Interface
+	if os.Getenv("MDNS_INTERFACE") != "" {
+		if iface, err = net.InterfaceByName(os.Getenv("MDNS_INTERFACE")); err != nil {
+			return err
+		}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", iface, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("Failed to join the mDNS group: %w", err)
+	}
+
+	log.Info("Advertising over mDNS", "phase", "mdns", "records", len(records))
+
+	go func() {
+		// Announce twice, as RFC 6762 section 8.3 asks, then answer queries.
+		for i := 0; i < 2; i++ {
+			if msg, err := mdnsResponse(0, nil, records, true); err == nil {
+				_, _ = conn.WriteToUDP(msg, mdnsGroup)
+			}
+
+			time.Sleep(time.Second)
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 9000)
+
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				log.Error("mDNS responder stopped", "phase", "mdns", "error", err)
+				return
+			}
+
+			answerMDNS(conn, buf[:n], from, records)
+		}
+	}()
+
+	return nil
+}
+
+// mdnsRecords builds the records describing this instance.
+func mdnsRecords() ([]mdnsRecord, error) {
+	addrs, err := advertisedAddresses(os.Getenv("MDNS_ADDRESSES"))
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := bindPort()
+	if err != nil {
+		return nil, err
+	}
+
+	instance := "lancache-dns"
+	if os.Getenv("MDNS_NAME") != "" {
+		instance = os.Getenv("MDNS_NAME")
+	}
+
+	host := os.Getenv("MDNS_HOSTNAME")
+	if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	host, _, _ = strings.Cut(host, ".")
+
+	records := make([]mdnsRecord, 0)
+
+	add := func(name string, rtype dnsmessage.Type, unique bool, body dnsmessage.ResourceBody) error {
+		n, err := dnsmessage.NewName(name)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, mdnsRecord{name: n, rtype: rtype, unique: unique, body: body})
+
+		return nil
+	}
+
+	names := map[string]dnsmessage.Name{}
+
+	for _, name := range []string{host + ".local.", host + "-cache.local.", "_dns._udp.local.", "_http._tcp.local.", instance + "._dns._udp.local.", instance + " heartbeat._http._tcp.local."} {
+		if names[name], err = dnsmessage.NewName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	dnsPort, _ := strconv.Atoi(port)
+
+	services := []mdnsService{
+		{"_dns._udp.local.", instance + "._dns._udp.local.", host + ".local.", dnsPort, []string{"domain=" + dnsDomain()}},
+	}
+
+	cacheIPs := make([]net.IP, 0)
+
+	for _, a := range cleanIP(os.Getenv("LANCACHE_IP")) {
+		if ip := net.ParseIP(a).To4(); ip != nil {
+			cacheIPs = append(cacheIPs, ip)
+		}
+	}
+
+	if len(cacheIPs) > 0 {
+		path := "/lancache-heartbeat"
+		if os.Getenv("HEALTH_CHECK_PATH") != "" {
+			path = os.Getenv("HEALTH_CHECK_PATH")
+		}
+
+		httpPort := 80
+		if p, err := strconv.Atoi(os.Getenv("HEALTH_CHECK_PORT")); err == nil {
+			httpPort = p
+		}
+
+		services = append(services, mdnsService{"_http._tcp.local.", instance + " heartbeat._http._tcp.local.", host + "-cache.local.", httpPort, []string{"path=" + path}})
+	}
+
+	for _, s := range services {
+		if err = add("_services._dns-sd._udp.local.", dnsmessage.TypePTR, false, &dnsmessage.PTRResource{PTR: names[s.service]}); err != nil {
+			return nil, err
+		}
+
+		if err = add(s.service, dnsmessage.TypePTR, false, &dnsmessage.PTRResource{PTR: names[s.instance]}); err != nil {
+			return nil, err
+		}
+
+		if err = add(s.instance, dnsmessage.TypeSRV, true, &dnsmessage.SRVResource{Port: uint16(s.port), Target: names[s.target]}); err != nil {
+			return nil, err
+		}
+
+		if err = add(s.instance, dnsmessage.TypeTXT, true, &dnsmessage.TXTResource{TXT: s.txt}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range addrs {
+		var ip [4]byte
+		copy(ip[:], net.ParseIP(a).To4())
+
+		if err = add(host+".local.", dnsmessage.TypeA, true, &dnsmessage.AResource{A: ip}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range cacheIPs {
+		var ip [4]byte
+		copy(ip[:], a)
+
+		if err = add(host+"-cache.local.", dnsmessage.TypeA, true, &dnsmessage.AResource{A: ip}); err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
+
+// answerMDNS replies to the questions in msg that match records. Queries from a port
+// other than 5353 are legacy unicast queries and are answered directly, as are
+// questions asking for a unicast response; everything else is answered to the group.
+func answerMDNS(conn *net.UDPConn, msg []byte, from *net.UDPAddr, records []mdnsRecord) {
+	var p dnsmessage.Parser
+
+	hdr, err := p.Start(msg)
+	if err != nil || hdr.Response {
+		return
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	legacy := from.Port != mdnsGroup.Port
+	unicast := legacy
+
+	matched := make([]mdnsRecord, 0)
+
+	for _, q := range questions {
+		if q.Class&0x8000 != 0 {
+			unicast = true
+		}
+
+		for _, r := range records {
+			if strings.EqualFold(r.name.String(), q.Name.String()) && (q.Type == dnsmessage.TypeALL || q.Type == r.rtype) {
+				matched = append(matched, r)
+			}
+		}
+	}
+
+	if len(matched) == 0 {
+		return
+	}
+
+	var (
+		id       uint16
+		question []dnsmessage.Question
+	)
+
+	if legacy {
+		id, question = hdr.ID, questions
+	}
+
+	resp, err := mdnsResponse(id, question, matched, !legacy)
+	if err != nil {
+		log.Warn("Failed to build mDNS response", "phase", "mdns", "error", err)
+		return
+	}
+
+	to := mdnsGroup
+	if unicast {
+		to = from
+	}
+
+	_, _ = conn.WriteToUDP(resp, to)
+}
+
+// mdnsResponse builds an authoritative response carrying records. flush sets the
+// cache-flush bit on unique records, which legacy unicast responses must not carry.
+func mdnsResponse(id uint16, questions []dnsmessage.Question, records []mdnsRecord, flush bool) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	for _, q := range questions {
+		q.Class &^= 0x8000
+
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range records {
+		hdr := dnsmessage.ResourceHeader{Name: r.name, Class: dnsmessage.ClassINET, TTL: mdnsTTL}
+		if r.unique && flush {
+			hdr.Class |= 0x8000
+		}
+
+		var err error
+
+		switch body := r.body.(type) {
+		case *dnsmessage.PTRResource:
+			err = b.PTRResource(hdr, *body)
+		case *dnsmessage.SRVResource:
+			err = b.SRVResource(hdr, *body)
+		case *dnsmessage.TXTResource:
+			err = b.TXTResource(hdr, *body)
+		case *dnsmessage.AResource:
+			err = b.AResource(hdr, *body)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
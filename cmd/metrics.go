@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metrics holds counters that are not derivable from the last generation status.
+var metrics struct {
+	generationSuccesses atomic.Int64
+	generationFailures  atomic.Int64
+	fetchErrors         atomic.Int64
+	lastSuccess         atomic.Int64
+	driftChecks         atomic.Int64
+	driftProblems       atomic.Int64
+}
+
+func init() {
+	httpMux.HandleFunc("GET /metrics", handleMetrics)
+}
+
+// handleMetrics exposes generation metrics in the Prometheus text exposition format.
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	status := currentStatus()
+
+	enabled := 0
+	records := 0
+
+	for _, s := range status.Services {
+		if s.Enabled {
+			enabled++
+			records += s.Domains
+		}
+	}
+
+	writeMetric(w, "dnstool_generation_duration_seconds", "gauge", "Duration of the most recent generation.", status.Duration.Seconds())
+	writeMetric(w, "dnstool_generation_last_success_timestamp_seconds", "gauge", "Unix time of the last successful generation.", float64(metrics.lastSuccess.Load()))
+	writeMetric(w, "dnstool_fetch_errors_total", "counter", "Failed cache_domains fetches.", float64(metrics.fetchErrors.Load()))
+	writeMetric(w, "dnstool_services_enabled", "gauge", "Services enabled in the most recent generation.", float64(enabled))
+	writeMetric(w, "dnstool_rpz_records", "gauge", "Domain records in the RPZ zone.", float64(records))
+	writeMetric(w, "dnstool_drift_checks_total", "counter", "Drift checks run against the live resolver.", float64(metrics.driftChecks.Load()))
+	writeMetric(w, "dnstool_drift_problems", "gauge", "Problems found by the most recent drift check.", float64(metrics.driftProblems.Load()))
+
+	fmt.Fprintln(w, "# HELP dnstool_generations_total Generations by result.")
+	fmt.Fprintln(w, "# TYPE dnstool_generations_total counter")
+	fmt.Fprintf(w, "dnstool_generations_total{result=\"success\"} %d\n", metrics.generationSuccesses.Load())
+	fmt.Fprintf(w, "dnstool_generations_total{result=\"failure\"} %d\n", metrics.generationFailures.Load())
+
+	fmt.Fprintln(w, "# HELP dnstool_service_domains Domains intercepted per service.")
+	fmt.Fprintln(w, "# TYPE dnstool_service_domains gauge")
+
+	for _, s := range status.Services {
+		if s.Enabled {
+			fmt.Fprintf(w, "dnstool_service_domains{service=%q} %d\n", s.Name, s.Domains)
+		}
+	}
+
+	if commit, ok := cacheDomainsCommitTime(); ok {
+		writeMetric(w, "dnstool_cache_domains_commit_age_seconds", "gauge", "Age of the cache_domains commit in use.", time.Since(commit).Seconds())
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// cacheDomainsCommitTime returns the commit time of the cache_domains checkout.
+func cacheDomainsCommitTime() (time.Time, bool) {
+	cmd := exec.Command("git", "log", "-1", "--format=%ct")
+	cmd.Dir = domainsPath
+
+	out, err := cmd.Output()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	ts, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(ts, 0), true
+}
@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// skipNamedSpace returns the offset of the next token in conf at or after i, skipping
+// whitespace and #, // and /* */ comments.
+func skipNamedSpace(conf string, i int) int {
+	for i < len(conf) {
+		switch {
+		case conf[i] == ' ' || conf[i] == '\t' || conf[i] == '\n' || conf[i] == '\r':
+			i++
+		case conf[i] == '#' || strings.HasPrefix(conf[i:], "//"):
+			if j := strings.IndexByte(conf[i:], '\n'); j >= 0 {
+				i += j + 1
+			} else {
+				i = len(conf)
+			}
+		case strings.HasPrefix(conf[i:], "/*"):
+			if j := strings.Index(conf[i+2:], "*/"); j >= 0 {
+				i += j + 4
+			} else {
+				i = len(conf)
+			}
+		default:
+			return i
+		}
+	}
+
+	return i
+}
+
+// namedStatementEnd returns the offset just past the semicolon terminating the statement
+// starting at i, taking nested braces and quoted strings into account.
+func namedStatementEnd(conf string, i int) (int, error) {
+	depth := 0
+
+	for i < len(conf) {
+		switch c := conf[i]; {
+		case c == '"':
+			j := strings.IndexByte(conf[i+1:], '"')
+			if j < 0 {
+				return 0, fmt.Errorf("Unterminated string in named configuration")
+			}
+
+			i += j + 2
+
+			continue
+		case c == '#' || strings.HasPrefix(conf[i:], "//") || strings.HasPrefix(conf[i:], "/*"):
+			i = skipNamedSpace(conf, i)
+			continue
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		case c == ';' && depth == 0:
+			return i + 1, nil
+		}
+
+		i++
+	}
+
+	return 0, fmt.Errorf("Unterminated statement in named configuration")
+}
+
+// namedKeyword returns the leading keyword of the statement starting at i.
+func namedKeyword(conf string, i int) string {
+	j := i
+	for j < len(conf) && !strings.ContainsRune(" \t\r\n{;\"", rune(conf[j])) {
+		j++
+	}
+
+	return conf[i:j]
+}
+
+// namedStatement is the span of a single statement within a configuration.
+type namedStatement struct {
+	keyword    string
+	start, end int
+}
+
+// namedStatements lists the statements of conf between offsets from and to.
+func namedStatements(conf string, from, to int) ([]namedStatement, error) {
+	statements := make([]namedStatement, 0)
+
+	for i := skipNamedSpace(conf, from); i < to; i = skipNamedSpace(conf, i) {
+		end, err := namedStatementEnd(conf, i)
+		if err != nil {
+			return nil, err
+		}
+
+		statements = append(statements, namedStatement{keyword: namedKeyword(conf, i), start: i, end: end})
+		i = end
+	}
+
+	return statements, nil
+}
+
+// namedOptionsBody returns the offsets of the body of the options block, between its
+// opening and closing braces.
+func namedOptionsBody(conf string) (int, int, error) {
+	statements, err := namedStatements(conf, 0, len(conf))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, s := range statements {
+		if s.keyword != "options" {
+			continue
+		}
+
+		open := strings.IndexByte(conf[s.start:s.end], '{')
+		close := strings.LastIndexByte(conf[s.start:s.end], '}')
+
+		if open < 0 || close < open {
+			break
+		}
+
+		return s.start + open + 1, s.start + close, nil
+	}
+
+	return 0, 0, fmt.Errorf("No options block found in named configuration")
+}
+
+// setNamedOption sets `name value;` within the options block of conf, replacing any
+// existing statements of the same name. An empty value removes the option.
+func setNamedOption(conf, name, value string) (string, error) {
+	from, to, err := namedOptionsBody(conf)
+	if err != nil {
+		return "", err
+	}
+
+	statements, err := namedStatements(conf, from, to)
+	if err != nil {
+		return "", err
+	}
+
+	replacement := ""
+	if value != "" {
+		replacement = name + " " + value + ";"
+	}
+
+	// Walk backwards so that earlier offsets stay valid while editing.
+	replaced := false
+
+	for i := len(statements) - 1; i >= 0; i-- {
+		s := statements[i]
+		if s.keyword != name {
+			continue
+		}
+
+		if !replaced && i == firstNamedStatement(statements, name) && replacement != "" {
+			conf = conf[:s.start] + replacement + conf[s.end:]
+			replaced = true
+
+			continue
+		}
+
+		conf = removeNamedSpan(conf, s.start, s.end)
+	}
+
+	if replaced || replacement == "" {
+		return conf, nil
+	}
+
+	return appendNamedOption(conf, replacement)
+}
+
+// appendNamedOption adds statement at the end of the options block of conf.
+func appendNamedOption(conf, statement string) (string, error) {
+	_, to, err := namedOptionsBody(conf)
+	if err != nil {
+		return "", err
+	}
+
+	lineStart := strings.LastIndexByte(conf[:to], '\n') + 1
+	if strings.TrimSpace(conf[lineStart:to]) == "" {
+		return conf[:lineStart] + "\t" + statement + "\n" + conf[lineStart:], nil
+	}
+
+	return conf[:to] + "\n\t" + statement + "\n" + conf[to:], nil
+}
+
+// addNamedInclude includes path within the options block of conf, unless it already is.
+// Other include statements are left alone.
+func addNamedInclude(conf, path string) (string, error) {
+	from, to, err := namedOptionsBody(conf)
+	if err != nil {
+		return "", err
+	}
+
+	statements, err := namedStatements(conf, from, to)
+	if err != nil {
+		return "", err
+	}
+
+	include := "include " + strconv.Quote(path) + ";"
+	for _, s := range statements {
+		if s.keyword == "include" && strings.Join(strings.Fields(conf[s.start:s.end]), " ") == include {
+			return conf, nil
+		}
+	}
+
+	return appendNamedOption(conf, include)
+}
+
+// setNamedOptions applies setNamedOption for each name/value pair in order.
+func setNamedOptions(conf string, options [][2]string) (string, error) {
+	var err error
+
+	for _, o := range options {
+		if conf, err = setNamedOption(conf, o[0], o[1]); err != nil {
+			return "", err
+		}
+	}
+
+	return conf, nil
+}
+
+func firstNamedStatement(statements []namedStatement, name string) int {
+	for i, s := range statements {
+		if s.keyword == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// removeNamedSpan deletes conf[start:end], along with its line if nothing else is on it.
+func removeNamedSpan(conf string, start, end int) string {
+	lineStart := strings.LastIndexByte(conf[:start], '\n') + 1
+
+	lineEnd := len(conf)
+	if j := strings.IndexByte(conf[end:], '\n'); j >= 0 {
+		lineEnd = end + j + 1
+	}
+
+	if strings.TrimSpace(conf[lineStart:start]) == "" && strings.TrimSpace(strings.TrimSuffix(conf[end:lineEnd], "\n")) == "" {
+		return conf[:lineStart] + conf[lineEnd:]
+	}
+
+	return conf[:start] + conf[end:]
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds how long a generation may be held up by a slow webhook.
+const notifyTimeout = 10 * time.Second
+
+// notification is posted to NOTIFY_URL. The text and content fields make the same
+// payload acceptable to Slack and Discord incoming webhooks respectively.
+type notification struct {
+	Text    string `json:"text"`
+	Content string `json:"content"`
+	Event   string `json:"event"`
+}
+
+// notify posts a message to NOTIFY_URL.
+func notify(event, message string) {
+	url := os.Getenv("NOTIFY_URL")
+	if url == "" {
+		return
+	}
+
+	body, err := json.Marshal(notification{Text: message, Content: message, Event: event})
+	if err != nil {
+		log.Error("Failed to encode notification", "error", err)
+		return
+	}
+
+	client := fetchClient()
+	client.Timeout = notifyTimeout
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Error("Failed to send notification", "event", event, "error", err)
+		return
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Error("Notification rejected", "event", event, "status", resp.Status)
+	}
+}
+
+// notifyGeneration announces failed generations, generations that changed the RPZ
+// zone and services that have newly appeared upstream.
+func notifyGeneration(err error) {
+	if err != nil {
+		notify("failure", "Lancache DNS generation failed: "+err.Error())
+		return
+	}
+
+	status := currentStatus()
+
+	announceNewServices(status.Services)
+
+	h := sha256.New()
+
+	for _, zone := range rpzZones(status.Services) {
+		f, err := os.ReadFile(zonePath + zone + ".db")
+		if err != nil {
+			return
+		}
+
+		h.Write([]byte(contentDigest(f)))
+	}
+
+	if !setRPZDigest(hex.EncodeToString(h.Sum(nil))) {
+		return
+	}
+
+	if err := saveRuntimeState(); err != nil {
+		log.Warn("Failed to record the notified zones", "phase", "generate", "file", stateFile(), "error", err)
+	}
+
+	enabled := 0
+	for _, s := range status.Services {
+		if s.Enabled {
+			enabled++
+		}
+	}
+
+	notify("changed", fmt.Sprintf("Lancache DNS configuration updated: %d services enabled, cache_domains %s", enabled, shortRevision(status.Revision)))
+}
+
+// announceNewServices logs and notifies the services that were not in cache_domains at
+// the previous generation, with whether they are now enabled, then records the services
+// seen in the state file. The first generation only records them.
+func announceNewServices(services []serviceStatus) {
+	known := knownServices()
+
+	seen := make(map[string]bool, len(known))
+	for _, name := range known {
+		seen[name] = true
+	}
+
+	names := make([]string, 0, len(services))
+	messages := make([]string, 0)
+
+	for _, s := range services {
+		names = append(names, s.Name)
+
+		if known == nil || seen[s.Name] {
+			continue
+		}
+
+		state := "disabled"
+		switch {
+		case s.Enabled:
+			state = "enabled"
+		case s.Policy == "pending":
+			state = "awaiting approval"
+		case s.Policy != "":
+			state = s.Policy
+		}
+
+		log.Warn("New service available in cache_domains", "phase", "generate", "service", s.Name, "state", state)
+		messages = append(messages, fmt.Sprintf("new service '%s' available, currently %s", s.Name, state))
+	}
+
+	sort.Strings(names)
+
+	if known != nil && len(messages) == 0 && strings.Join(known, " ") == strings.Join(names, " ") {
+		return
+	}
+
+	if len(messages) > 0 {
+		notify("new_services", "Lancache DNS: "+strings.Join(messages, "; "))
+	}
+
+	setKnownServices(names)
+
+	if err := saveRuntimeState(); err != nil {
+		log.Warn("Failed to record the known services", "phase", "generate", "file", stateFile(), "error", err)
+	}
+}
+
+// shortRevision abbreviates a git commit for display.
+func shortRevision(revision string) string {
+	if len(revision) > 12 {
+		return revision[:12]
+	}
+
+	return revision
+}
@@ -0,0 +1,469 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dnstool/pkg/dnsgen"
+)
+
+// namedConfOptions returns the statements to set in the options block of
+// named.conf.options, as name/value pairs. A pair with an empty value removes the
+// statement from the configuration.
+func namedConfOptions(dns []upstream) ([][2]string, error) {
+	options := make([][2]string, 0)
+
+	if len(dns) > 0 {
+		options = append(options, [2]string{"forwarders", "{ " + forwarderList(dns) + "; }"})
+
+		switch mode := os.Getenv("UPSTREAM_MODE"); mode {
+		case "":
+		case "only", "first":
+			options = append(options, [2]string{"forward", mode})
+		default:
+			return nil, fmt.Errorf("UPSTREAM_MODE must be either only or first, not %s", mode)
+		}
+	}
+
+	listen, err := bindListen()
+	if err != nil {
+		return nil, err
+	}
+
+	if listen != "" {
+		options = append(options, [2]string{"listen-on", listen})
+	}
+
+	listenV6, err := bindListenV6()
+	if err != nil {
+		return nil, err
+	}
+
+	if listenV6 != "" {
+		options = append(options, [2]string{"listen-on-v6", listenV6})
+	}
+
+	for _, o := range []struct {
+		key, option string
+		v6          bool
+	}{
+		{"BIND_QUERY_SOURCE", "query-source", false},
+		{"BIND_QUERY_SOURCE_V6", "query-source-v6", true},
+	} {
+		source, err := querySource(o.key, o.v6)
+		if err != nil {
+			return nil, err
+		}
+
+		if source != "" {
+			options = append(options, [2]string{o.option, "address " + source})
+		}
+	}
+
+	if sortlist := weightedSortlist(pendingServices()); sortlist != "" {
+		options = append(options, [2]string{"sortlist", sortlist})
+	}
+
+	dns64, err := dns64Configuration()
+	if err != nil {
+		return nil, err
+	}
+
+	if dns64 != "" {
+		options = append(options, [2]string{"dns64", dns64})
+	}
+
+	acl, err := lanSubnets()
+	if err != nil {
+		return nil, err
+	}
+
+	if acl != "" {
+		for _, name := range []string{"allow-query", "allow-recursion", "allow-query-cache"} {
+			options = append(options, [2]string{name, acl})
+		}
+	}
+
+	tuning, err := cacheTuning()
+	if err != nil {
+		return nil, err
+	}
+
+	options = append(options, tuning...)
+
+	validation, err := dnssecValidation()
+	if err != nil {
+		return nil, err
+	}
+
+	if validation != "" {
+		options = append(options, [2]string{"dnssec-validation", validation})
+	}
+
+	if except := validateExcept(); except != "" {
+		options = append(options, [2]string{"validate-except", except})
+	}
+
+	hardening, err := serverHardening()
+	if err != nil {
+		return nil, err
+	}
+
+	options = append(options, hardening...)
+
+	views, err := clientViews()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(views) > 0 {
+		// Each view carries its own response-policy so that some can opt out.
+		options = append(options, [2]string{"response-policy", ""})
+	} else {
+		// Always written, so that zones and options dropped since the last generation
+		// do not linger in the statement.
+		policy, err := policyStatement()
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, [2]string{"response-policy", policy})
+	}
+
+	raw, err := rawOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	options = append(options, raw...)
+
+	return options, nil
+}
+
+// bindPort returns the port named answers queries on, from BIND_PORT.
+func bindPort() (string, error) {
+	port := os.Getenv("BIND_PORT")
+	if port == "" {
+		return "53", nil
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("BIND_PORT value: %s is not a valid port", port)
+	}
+
+	return port, nil
+}
+
+// bindListen returns the listen-on statement for BIND_LISTEN and BIND_PORT, or an empty
+// string to leave the template's statement alone. BIND_LISTEN takes addresses, networks
+// or interface names, the latter being expanded to their IPv4 addresses.
+func bindListen() (string, error) {
+	if os.Getenv("BIND_LISTEN") == "" && os.Getenv("BIND_PORT") == "" {
+		return "", nil
+	}
+
+	port, err := bindPort()
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := listenList(false)
+	if err != nil {
+		return "", err
+	}
+
+	return "port " + port + " { " + strings.Join(addrs, "; ") + "; }", nil
+}
+
+// bindListenV6 returns the listen-on-v6 statement for BIND_LISTEN_V6 and BIND_PORT, or an
+// empty string to leave the template's statement alone. BIND_LISTEN_V6 may be true or
+// false to listen on all or no IPv6 addresses, or a list as for BIND_LISTEN.
+func bindListenV6() (string, error) {
+	v := os.Getenv("BIND_LISTEN_V6")
+	if v == "" && os.Getenv("BIND_PORT") == "" {
+		return "", nil
+	}
+
+	port, err := bindPort()
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := listenList(true)
+	if err != nil {
+		return "", err
+	}
+
+	return "port " + port + " { " + strings.Join(addrs, "; ") + "; }", nil
+}
+
+// listenList returns the address match list named listens on for IPv4, or IPv6 when v6
+// is set, from BIND_LISTEN or BIND_LISTEN_V6, any when unset.
+func listenList(v6 bool) ([]string, error) {
+	if !v6 {
+		if os.Getenv("BIND_LISTEN") == "" {
+			return []string{"any"}, nil
+		}
+
+		return listenAddresses(cleanIP(os.Getenv("BIND_LISTEN")), false)
+	}
+
+	switch v := os.Getenv("BIND_LISTEN_V6"); strings.ToLower(v) {
+	case "", "true", "yes":
+		return []string{"any"}, nil
+	case "false", "no":
+		return []string{"none"}, nil
+	default:
+		return listenAddresses(cleanIP(v), true)
+	}
+}
+
+// listenAddresses resolves an address match list for listen-on or listen-on-v6,
+// replacing interface names with their addresses of the matching family.
+func listenAddresses(entries []string, v6 bool) ([]string, error) {
+	addrs := make([]string, 0, len(entries))
+
+	for _, e := range entries {
+		if e == "any" || e == "none" || net.ParseIP(e) != nil {
+			addrs = append(addrs, e)
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(e); err == nil {
+			addrs = append(addrs, e)
+			continue
+		}
+
+		iface, err := net.InterfaceByName(e)
+		if err != nil {
+			return nil, fmt.Errorf("Listen address: %s is not an address, network or interface", e)
+		}
+
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+
+		for _, a := range ifaddrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || (ipnet.IP.To4() == nil) != v6 || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+
+			addrs = append(addrs, ipnet.IP.String())
+			found = true
+		}
+
+		if !found {
+			return nil, fmt.Errorf("Interface %s has no addresses to listen on", e)
+		}
+	}
+
+	return addrs, nil
+}
+
+var (
+	cacheSize     = regexp.MustCompile(`^(\d+[kKmMgG]?|\d+%|unlimited|default)$`)
+	prefetchTimes = regexp.MustCompile(`^\d+( \d+)?$`)
+)
+
+// cacheTuning returns the resolver cache statements set by BIND_MAX_CACHE_SIZE,
+// BIND_PREFETCH and BIND_SERVE_STALE, with BIND_STALE_ANSWER_TTL and BIND_MAX_STALE_TTL
+// controlling how stale answers are served.
+func cacheTuning() ([][2]string, error) {
+	options := make([][2]string, 0)
+
+	if size := os.Getenv("BIND_MAX_CACHE_SIZE"); size != "" {
+		if !cacheSize.MatchString(size) {
+			return nil, fmt.Errorf("BIND_MAX_CACHE_SIZE value: %s is not a valid size", size)
+		}
+
+		options = append(options, [2]string{"max-cache-size", size})
+	}
+
+	if p := os.Getenv("BIND_PREFETCH"); p != "" {
+		if !prefetchTimes.MatchString(p) {
+			return nil, fmt.Errorf("BIND_PREFETCH value: %s must be a trigger and optional eligibility in seconds", p)
+		}
+
+		options = append(options, [2]string{"prefetch", p})
+	}
+
+	stale, err := envYesNo("BIND_SERVE_STALE")
+	if err != nil {
+		return nil, err
+	}
+
+	if stale != "" {
+		options = append(options, [2]string{"stale-cache-enable", stale}, [2]string{"stale-answer-enable", stale})
+	}
+
+	for _, o := range []struct{ key, option string }{
+		{"BIND_STALE_ANSWER_TTL", "stale-answer-ttl"},
+		{"BIND_MAX_STALE_TTL", "max-stale-ttl"},
+	} {
+		v := os.Getenv(o.key)
+		if v == "" {
+			continue
+		}
+
+		if !dnsgen.ValidTime(v) {
+			return nil, fmt.Errorf("%s value: %s is not a valid time", o.key, v)
+		}
+
+		options = append(options, [2]string{o.option, v})
+	}
+
+	return options, nil
+}
+
+// serverHardening returns the statements controlling what named reveals, from
+// BIND_VERSION, BIND_MINIMAL_ANY and BIND_MINIMAL_RESPONSES.
+func serverHardening() ([][2]string, error) {
+	options := make([][2]string, 0)
+
+	switch v := os.Getenv("BIND_VERSION"); v {
+	case "":
+	case "none":
+		options = append(options, [2]string{"version", "none"})
+	default:
+		options = append(options, [2]string{"version", strconv.Quote(v)})
+	}
+
+	minimalAny, err := envYesNo("BIND_MINIMAL_ANY")
+	if err != nil {
+		return nil, err
+	}
+
+	if minimalAny != "" {
+		options = append(options, [2]string{"minimal-any", minimalAny})
+	}
+
+	switch v := strings.ToLower(os.Getenv("BIND_MINIMAL_RESPONSES")); v {
+	case "":
+	case "true", "yes":
+		options = append(options, [2]string{"minimal-responses", "yes"})
+	case "false", "no":
+		options = append(options, [2]string{"minimal-responses", "no"})
+	case "no-auth", "no-auth-recursive":
+		options = append(options, [2]string{"minimal-responses", v})
+	default:
+		return nil, fmt.Errorf("BIND_MINIMAL_RESPONSES must be true, false, no-auth or no-auth-recursive, not %s", v)
+	}
+
+	return options, nil
+}
+
+// querySource returns the address named sends upstream queries from, read from key as
+// an address or an interface name, so multi-homed hosts can pick the route the upstream
+// resolver accepts queries from.
+func querySource(key string, v6 bool) (string, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return "", nil
+	}
+
+	if strings.Contains(v, "/") || v == "any" || v == "none" {
+		return "", fmt.Errorf("%s value: %s must be a single address or interface", key, v)
+	}
+
+	addrs, err := listenAddresses([]string{v}, v6)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(addrs[0]); (ip.To4() == nil) != v6 {
+		return "", fmt.Errorf("%s value: %s is not an address of the right family", key, v)
+	}
+
+	return addrs[0], nil
+}
+
+// lanSubnets returns the address match list of clients allowed to query and recurse,
+// from LAN_SUBNETS, so that a resolver exposed to the internet isn't an open resolver.
+func lanSubnets() (string, error) {
+	subnets := cleanIP(os.Getenv("LAN_SUBNETS"))
+	if len(subnets) == 0 {
+		return "", nil
+	}
+
+	for _, s := range subnets {
+		if _, _, err := net.ParseCIDR(s); err != nil && net.ParseIP(s) == nil {
+			return "", fmt.Errorf("LAN_SUBNETS value: %s is not a valid network", s)
+		}
+	}
+
+	return "{ localhost; " + strings.Join(subnets, "; ") + "; }", nil
+}
+
+// policyStatement returns the value of the response-policy statement listing every
+// response policy zone along with any tuning options.
+func policyStatement() (string, error) {
+	tuning, err := rpzTuning()
+	if err != nil {
+		return "", err
+	}
+
+	zones := rpzZones(pendingServices())
+	if len(zones) > maxPolicyZones {
+		return "", fmt.Errorf("RPZ_PER_SERVICE needs %d response policy zones but BIND allows at most %d, unset it or disable some services", len(zones), maxPolicyZones)
+	}
+
+	policy := "{"
+	for _, zone := range zones {
+		policy += ` zone "` + zone + `";`
+	}
+
+	return strings.TrimSpace(policy + " } " + strings.Join(tuning, " ")), nil
+}
+
+// rpzTuning returns the response-policy options set by RPZ_BREAK_DNSSEC,
+// RPZ_QNAME_WAIT_RECURSE and RPZ_MAX_POLICY_TTL.
+func rpzTuning() ([]string, error) {
+	var tuning []string
+
+	for _, o := range []struct{ key, option string }{
+		{"RPZ_BREAK_DNSSEC", "break-dnssec"},
+		{"RPZ_QNAME_WAIT_RECURSE", "qname-wait-recurse"},
+	} {
+		v, err := envYesNo(o.key)
+		if err != nil {
+			return nil, err
+		}
+
+		if v != "" {
+			tuning = append(tuning, o.option+" "+v)
+		}
+	}
+
+	if ttl := os.Getenv("RPZ_MAX_POLICY_TTL"); ttl != "" {
+		if !dnsgen.ValidTime(ttl) {
+			return nil, fmt.Errorf("RPZ_MAX_POLICY_TTL value: %s is not a valid time", ttl)
+		}
+
+		tuning = append(tuning, "max-policy-ttl "+ttl)
+	}
+
+	return tuning, nil
+}
+
+// envYesNo reads a boolean variable as a named.conf yes/no value, returning an empty
+// string when it is unset.
+func envYesNo(key string) (string, error) {
+	switch v := strings.ToLower(os.Getenv(key)); v {
+	case "":
+		return "", nil
+	case "true", "yes":
+		return "yes", nil
+	case "false", "no":
+		return "no", nil
+	default:
+		return "", fmt.Errorf("%s must be true or false, not %s", key, v)
+	}
+}
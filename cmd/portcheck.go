@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const resolvedDropIn = "/etc/systemd/resolved.conf.d/lancache-dns.conf"
+
+// portOwner is a socket bound to the DNS port by another process.
+type portOwner struct {
+	Proto   string
+	Address string
+	PID     int
+	Process string
+}
+
+// checkDNSPort looks for processes other than named already bound to the DNS port on
+// an address named will listen on, in the current network namespace. Depending on PORT_CHECK (warn, fail or off; warn by
+// default) conflicts are logged with a hint for fixing them or refused. With
+// RESOLVED_DROPIN=true a drop-in disabling the systemd-resolved stub listener is
+// written when it is the culprit.
+func checkDNSPort() error {
+	mode := os.Getenv("PORT_CHECK")
+
+	switch mode {
+	case "off":
+		return nil
+	case "":
+		mode = "warn"
+	case "warn", "fail":
+	default:
+		return fmt.Errorf("PORT_CHECK must be one of warn, fail or off, not %s", mode)
+	}
+
+	port, err := bindPort()
+	if err != nil {
+		return err
+	}
+
+	owners, err := dnsPortOwners(port)
+	if err != nil {
+		log.Debug("Unable to inspect sockets", "phase", "preflight", "error", err)
+		return nil
+	}
+
+	listen := map[bool][]string{}
+	for _, v6 := range []bool{false, true} {
+		if listen[v6], err = listenList(v6); err != nil {
+			return err
+		}
+	}
+
+	conflicts := make([]string, 0)
+
+	for _, o := range owners {
+		if o.Process == "named" {
+			continue
+		}
+
+		if ip := net.ParseIP(o.Address); ip != nil && !listenOverlaps(listen[ip.To4() == nil], ip) {
+			log.Debug("Port "+port+" is in use on an address named does not listen on", "phase", "preflight", "proto", o.Proto, "address", o.Address, "process", o.Process, "pid", o.PID)
+			continue
+		}
+
+		process := o.Process
+		if process == "" {
+			process = "unknown process"
+		}
+
+		log.Warn("Port "+port+" is already in use", "phase", "preflight", "proto", o.Proto, "address", o.Address, "process", process, "pid", o.PID, "hint", portConflictHint(o.Process))
+		conflicts = append(conflicts, fmt.Sprintf("%s (pid %d) on %s/%s", process, o.PID, o.Address, o.Proto))
+
+		if o.Process == "systemd-resolve" && os.Getenv("RESOLVED_DROPIN") == "true" {
+			if err = writeResolvedDropIn(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	err = fmt.Errorf("Port %s is already in use by %s", port, strings.Join(conflicts, ", "))
+	if mode == "fail" {
+		return err
+	}
+
+	log.Error(err.Error(), "phase", "preflight")
+
+	return nil
+}
+
+// listenOverlaps reports whether named listening on the address match list addrs binds
+// ip, on which another socket is bound. A socket on the wildcard address overlaps any
+// address named listens on, and any covers the addresses of the host's interfaces.
+func listenOverlaps(addrs []string, ip net.IP) bool {
+	for _, a := range addrs {
+		switch {
+		case a == "none":
+		case ip.IsUnspecified():
+			return true
+		case a == "any":
+			if isInterfaceAddress(ip) {
+				return true
+			}
+		case net.ParseIP(a) != nil:
+			if net.ParseIP(a).Equal(ip) {
+				return true
+			}
+		default:
+			if _, network, err := net.ParseCIDR(a); err != nil || network.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isInterfaceAddress reports whether ip is assigned to one of the host's interfaces,
+// assuming it is when they cannot be listed.
+func isInterfaceAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// portConflictHint suggests how to free the DNS port from process.
+func portConflictHint(process string) string {
+	switch process {
+	case "systemd-resolve":
+		return "disable the stub listener with DNSStubListener=no in " + resolvedDropIn + ", or set RESOLVED_DROPIN=true, then restart systemd-resolved"
+	case "dnsmasq":
+		return "set port=0 in the dnsmasq configuration to keep DHCP but stop it serving DNS, or stop dnsmasq"
+	case "":
+		return "run ss -lntup as root to identify the process"
+	}
+
+	return "stop " + process + " or move lancache-dns to another address with BIND_LISTEN"
+}
+
+// writeResolvedDropIn disables the systemd-resolved stub listener, which takes effect
+// once systemd-resolved has been restarted.
+func writeResolvedDropIn() error {
+	if _, err := os.Stat(resolvedDropIn); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(resolvedDropIn), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(resolvedDropIn, []byte("# Written by dnstool to free port 53 for lancache-dns\n[Resolve]\nDNSStubListener=no\n"), 0644); err != nil {
+		return err
+	}
+
+	log.Warn("Disabled the systemd-resolved stub listener, restart systemd-resolved to free the port", "phase", "preflight", "file", resolvedDropIn)
+
+	return nil
+}
+
+// dnsPortOwners lists the listening TCP and bound UDP sockets on port from /proc/net,
+// identifying the owning processes where /proc allows it.
+func dnsPortOwners(port string) ([]portOwner, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	want := fmt.Sprintf("%04X", n)
+	inodes := map[string]*portOwner{}
+	owners := make([]*portOwner, 0)
+
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open("/proc/net/" + proto)
+		if err != nil {
+			if proto == "tcp" {
+				return nil, err
+			}
+
+			continue
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Scan()
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+
+			addr, p, _ := strings.Cut(fields[1], ":")
+			if p != want || (strings.HasPrefix(proto, "tcp") && fields[3] != "0A") {
+				continue
+			}
+
+			o := &portOwner{Proto: strings.TrimSuffix(proto, "6"), Address: procNetAddress(addr)}
+			owners = append(owners, o)
+			inodes["socket:["+fields[9]+"]"] = o
+		}
+
+		_ = f.Close()
+	}
+
+	if len(owners) > 0 {
+		procs, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+		for _, fd := range procs {
+			target, err := os.Readlink(fd)
+			if err != nil {
+				continue
+			}
+
+			if o, ok := inodes[target]; ok && o.PID == 0 {
+				o.PID, _ = strconv.Atoi(strings.Split(fd, "/")[2])
+
+				comm, _ := os.ReadFile(filepath.Join("/proc", strconv.Itoa(o.PID), "comm"))
+				o.Process = strings.TrimSpace(string(comm))
+			}
+		}
+	}
+
+	result := make([]portOwner, 0, len(owners))
+	for _, o := range owners {
+		result = append(result, *o)
+	}
+
+	return result, nil
+}
+
+// procNetAddress decodes an address from /proc/net, stored as host-order 32-bit words.
+func procNetAddress(h string) string {
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b)%4 != 0 {
+		return h
+	}
+
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+
+	return net.IP(b).String()
+}
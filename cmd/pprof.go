@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+)
+
+// startPprof serves the runtime profiling endpoints on PPROF_LISTEN when set. It is
+// kept separate from HTTP_LISTEN so that it can be bound to localhost only.
+func startPprof() error {
+	addr := os.Getenv("PPROF_LISTEN")
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Serving pprof", "listen", l.Addr().String())
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Error("pprof server stopped", "error", err)
+		}
+	}()
+
+	return nil
+}
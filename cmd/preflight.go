@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const defaultUpstreamCheckName = "lancache.net"
+
+// upstreamCheckName returns UPSTREAM_CHECK_NAME, the name looked up to test upstreams.
+func upstreamCheckName() string {
+	if os.Getenv("UPSTREAM_CHECK_NAME") != "" {
+		return os.Getenv("UPSTREAM_CHECK_NAME")
+	}
+
+	return defaultUpstreamCheckName
+}
+
+// checkUpstreams sends a test query to each upstream. Depending on UPSTREAM_CHECK
+// (warn, fail or off; warn by default) a configuration where no upstream responds is
+// either logged loudly or refused.
+func checkUpstreams(dns []upstream) error {
+	mode := os.Getenv("UPSTREAM_CHECK")
+
+	switch mode {
+	case "off":
+		return nil
+	case "":
+		mode = "warn"
+	case "warn", "fail":
+	default:
+		return fmt.Errorf("UPSTREAM_CHECK must be one of warn, fail or off, not %s", mode)
+	}
+
+	name := upstreamCheckName()
+	checked := 0
+	failed := make([]string, 0)
+
+	for _, u := range dns {
+		if u.Proxy {
+			continue
+		}
+
+		checked++
+
+		if _, err := queryDNS(u, dnsQuery{Name: name, Type: dnsmessage.TypeA}); err != nil {
+			log.Warn("Upstream DNS did not respond", "phase", "preflight", "upstream", u.address(), "error", err)
+			failed = append(failed, u.address())
+
+			continue
+		}
+
+		log.Info("Upstream DNS is reachable", "phase", "preflight", "upstream", u.address())
+	}
+
+	if checked == 0 || len(failed) < checked {
+		return nil
+	}
+
+	err := fmt.Errorf("None of the upstream DNS servers responded: %s", strings.Join(failed, ", "))
+	if mode == "fail" {
+		return err
+	}
+
+	log.Error(err.Error(), "phase", "preflight")
+
+	return nil
+}
+
+// writablePath is a path generation writes to, with the variable that relocates it.
+type writablePath struct {
+	path, env string
+	dir       bool
+}
+
+// checkWritablePaths verifies up front that every path generation writes to can be
+// written, so that a non-root user or a read-only root filesystem fails with the
+// variables to point elsewhere rather than part way through generation.
+func checkWritablePaths() error {
+	paths := []writablePath{
+		{zonePath, "ZONE_PATH", true},
+		{cacheConf, "CACHE_CONF", false},
+		{namedConf, "NAMED_CONF_OPTIONS", false},
+		{domainsPath, "CACHE_DOMAINS_DIR", true},
+		{stateFile(), "STATE_FILE", false},
+	}
+
+	if confDGenerated() {
+		paths = append(paths, writablePath{confDir(), "CONF_D_DIR", true})
+	}
+
+	if os.Getenv("SKIP_RESOLV_CONF") != "true" {
+		paths = append(paths, writablePath{resolvConfPath(), "RESOLV_CONF_PATH or SKIP_RESOLV_CONF=true", false})
+	}
+
+	failed := make([]string, 0)
+
+	for _, p := range paths {
+		if err := checkWritable(p.path, p.dir); err != nil {
+			log.Error("Path is not writable", "phase", "preflight", "path", p.path, "override", p.env, "error", err)
+			failed = append(failed, fmt.Sprintf("%s (set %s)", p.path, p.env))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to write to %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// checkWritable tests that path can be written: an existing file is opened for writing,
+// otherwise a file is created and removed in the directory that holds, or would hold,
+// path. Missing directories are checked against their nearest existing ancestor, as
+// generation creates them.
+func checkWritable(path string, dir bool) error {
+	if !dir {
+		if _, err := os.Stat(path); err == nil {
+			f, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+
+			return f.Close()
+		}
+
+		path = filepath.Dir(path)
+	}
+
+	for {
+		if _, err := os.Stat(path); err == nil || path == filepath.Dir(path) {
+			break
+		}
+
+		path = filepath.Dir(path)
+	}
+
+	f, err := os.CreateTemp(path, ".dnstool-write-check-*")
+	if err != nil {
+		return err
+	}
+
+	_ = f.Close()
+
+	return os.Remove(f.Name())
+}
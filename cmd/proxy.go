@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// configureProxy exports FETCH_PROXY as the standard proxy environment variables so
+// that both git and the internal HTTP client route outbound fetches through it.
+// NO_PROXY is left untouched and continues to be honoured by both.
+func configureProxy() {
+	proxy := os.Getenv("FETCH_PROXY")
+	if proxy == "" {
+		return
+	}
+
+	log.Info("Using proxy for outbound fetches", "proxy", proxy)
+
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy", "ALL_PROXY", "all_proxy"} {
+		_ = os.Setenv(key, proxy)
+	}
+}
+
+// fetchClient returns an HTTP client honouring HTTP_PROXY/HTTPS_PROXY/NO_PROXY.
+// Both http:// and socks5:// proxy URLs are supported.
+func fetchClient() *http.Client {
+	return &http.Client{
+		Timeout: 60 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               fetchProxy,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// fetchProxy returns the proxy for a request from the environment as it is now.
+// http.ProxyFromEnvironment reads it only once, on the first request of the process,
+// which may come before configureProxy has exported FETCH_PROXY.
+func fetchProxy(req *http.Request) (*url.URL, error) {
+	return httpproxy.FromEnvironment().ProxyFunc()(req.URL)
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"dnstool/pkg/dnsgen"
+)
+
+var (
+	renderBackend string
+	renderOutput  string
+	renderZoneDir string
+)
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Render cache_domains with an output backend",
+	Long:  `Render the services of cache_domains, configured by the environment and the runtime state as for lancache-dns, in the format of an output backend: bind (the cache zone and its zone statements), rpz (the response policy zone), dnsmasq or hosts`,
+	Run: func(_ *cobra.Command, _ []string) {
+		if renderOutput == "" {
+			quietLogging()
+		}
+
+		if err := renderBackends(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	generateCmd.AddCommand(renderCmd)
+
+	renderCmd.Flags().StringVar(&renderBackend, "backend", "all", "Output backend: "+strings.Join(dnsgen.Backends(), ", ")+" or all")
+	renderCmd.Flags().StringVar(&renderOutput, "output", "", "Directory to write the files to instead of printing them")
+	renderCmd.Flags().StringVar(&renderZoneDir, "zone-dir", "", "Directory the bind zone statements name the zone files in, defaulting to ZONE_PATH")
+}
+
+func renderBackends() error {
+	names := dnsgen.Backends()
+	if renderBackend != "all" {
+		if _, ok := dnsgen.Lookup(renderBackend); !ok {
+			return fmt.Errorf("Output backend: %s is not one of %s or all", renderBackend, strings.Join(names, ", "))
+		}
+
+		names = []string{renderBackend}
+	}
+
+	if err := loadEnvFile(); err != nil {
+		return err
+	}
+
+	if _, err := loadConfigSource(); err != nil {
+		return err
+	}
+
+	if err := loadRuntimeState(); err != nil {
+		return err
+	}
+
+	if err := refreshDockerCaches(); err != nil {
+		log.Warn("Failed to discover cache containers", "phase", "discovery", "error", err)
+	}
+
+	services, err := dnsgen.LoadCacheDomains(os.DirFS(domainsPath))
+	if err != nil {
+		return err
+	}
+
+	g, err := newGenerator(services)
+	if err != nil {
+		return err
+	}
+
+	if g.Config.Serial, err = dnsgen.NextSerial(0, time.Now(), g.Config.SerialFormat); err != nil {
+		return err
+	}
+
+	g.Config.ZoneDir = renderZoneDir
+	if g.Config.ZoneDir == "" {
+		g.Config.ZoneDir = strings.TrimSuffix(zonePath, "/")
+	}
+
+	for _, name := range names {
+		files, err := g.Render(name)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if renderOutput == "" {
+				fmt.Printf("--- %s: %s ---\n%s", name, f.Name, f.Data)
+				continue
+			}
+
+			path := filepath.Join(renderOutput, f.Name)
+			if err = os.WriteFile(path, f.Data, 0644); err != nil {
+				return err
+			}
+
+			log.Info("Wrote rendered file", "phase", "render", "backend", name, "file", path)
+		}
+	}
+
+	return nil
+}
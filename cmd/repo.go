@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// verifyCacheDomains checks an existing clone of cache_domains, which is kept across
+// container recreations when CACHE_DOMAINS_DIR is on a volume, with git fsck. A clone
+// that fails the check, or has no commit checked out, is cleared so that bootstrap
+// clones afresh instead of failing. CACHE_DOMAINS_VERIFY=false skips the check.
+func verifyCacheDomains() error {
+	if os.Getenv("CACHE_DOMAINS_VERIFY") == "false" {
+		return nil
+	}
+
+	if _, err := os.Stat(domainsPath + "/.git"); err != nil {
+		return nil
+	}
+
+	problem := ""
+
+	for _, args := range [][]string{{"rev-parse", "--verify", "--quiet", "HEAD^{commit}"}, {"fsck", "--no-progress", "--no-dangling"}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = domainsPath
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			problem = fmt.Sprintf("git %s: %s", args[0], lastLine(out, err))
+
+			break
+		}
+	}
+
+	if problem == "" {
+		log.Debug("Verified cache_domains clone", "phase", "bootstrap", "dir", domainsPath)
+		return nil
+	}
+
+	log.Warn("The cache_domains clone is corrupt, cloning it again", "phase", "bootstrap", "dir", domainsPath, "error", problem)
+	metrics.fetchErrors.Add(1)
+
+	return clearDirectory(domainsPath)
+}
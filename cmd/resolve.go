@@ -0,0 +1,482 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"dnstool/pkg/dnsgen"
+)
+
+var (
+	resolveClient string
+	resolveType   string
+	resolveJSON   bool
+)
+
+var policyZoneName = regexp.MustCompile(`zone\s+"([^"]+)"`)
+
+var resolveCmd = &cobra.Command{
+	Use:   "resolve <domain>",
+	Short: "Explain how the generated configuration answers a domain",
+	Long:  `Evaluate the generated response policy and cache zones offline, without named, showing the answer a client would get for a domain and the service, file and rule responsible, or why it is passed through or forwarded`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		result, err := whatIf(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if resolveJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err = enc.Encode(result); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+
+		result.print()
+	},
+}
+
+func init() {
+	resolveCmd.Flags().StringVar(&resolveClient, "client", "", "Address of the client asking, selecting its view and any client passthroughs")
+	resolveCmd.Flags().StringVar(&resolveType, "type", "A", "Record type asked for")
+	resolveCmd.Flags().BoolVar(&resolveJSON, "json", false, "Output as JSON")
+}
+
+// zoneRecord is a resource record read from a generated zone file, along with the
+// ;## heading it was written under.
+type zoneRecord struct {
+	Owner   string
+	Type    string
+	Data    string
+	File    string
+	Line    int
+	Section string
+}
+
+// resolveResult explains the answer to a lookup.
+type resolveResult struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Client  string   `json:"client,omitempty"`
+	View    string   `json:"view,omitempty"`
+	Action  string   `json:"action"`
+	Service string   `json:"service,omitempty"`
+	Rule    string   `json:"rule,omitempty"`
+	Zone    string   `json:"zone,omitempty"`
+	File    string   `json:"file,omitempty"`
+	Line    int      `json:"line,omitempty"`
+	Answer  []string `json:"answer,omitempty"`
+	Reasons []string `json:"reasons"`
+}
+
+// whatIf works out how the generated configuration answers name for the client, the way
+// BIND applies it: the first response policy zone with a matching trigger decides, a
+// client IP trigger taking precedence over the query name, an exact name over a wildcard
+// and a longer wildcard over a shorter one.
+func whatIf(name string) (resolveResult, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	r := resolveResult{Name: name, Type: strings.ToUpper(resolveType), Client: resolveClient, Reasons: make([]string, 0)}
+
+	var client net.IP
+	if resolveClient != "" {
+		if client = net.ParseIP(resolveClient); client == nil {
+			return r, fmt.Errorf("--client value: %s is not an IP address", resolveClient)
+		}
+	}
+
+	views, err := clientViews()
+	if err != nil {
+		return r, err
+	}
+
+	cacheZone := zonePath + servedDomain("") + ".db"
+	intercept := len(cleanIP(os.Getenv("CANARY_CLIENTS"))) == 0
+
+	if len(views) > 0 {
+		r.View = "default"
+
+		for _, v := range views {
+			if client != nil && matchesClient(v.Clients, client) {
+				r.View, intercept = v.Name, v.Intercept
+
+				if len(v.CacheIPs) > 0 {
+					cacheZone = viewZoneFile(cacheZone, v)
+				}
+
+				break
+			}
+		}
+
+		if client == nil {
+			r.Reasons = append(r.Reasons, "no --client given, so the default view applies")
+		}
+	}
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		return r, err
+	}
+
+	service, rule := newDomainIndex(services).lookup(name)
+
+	if !intercept {
+		r.Action = "forward"
+		r.Reasons = append(r.Reasons, "view "+r.View+" does not apply the response policy, so every name is resolved by the upstreams")
+
+		return r, nil
+	}
+
+	for _, zone := range policyZones() {
+		file := rpzZone
+		if zone != "rpz" {
+			file = zonePath + zone + ".db"
+		}
+
+		records, err := readZoneRecords(file, zone)
+		if err != nil {
+			return r, err
+		}
+
+		trigger, matched := policyMatch(records, zone, name, client)
+		if len(matched) == 0 {
+			continue
+		}
+
+		r.Rule, r.Zone, r.File, r.Line = trigger, zone, matched[0].File, matched[0].Line
+
+		// Client passthroughs are repeated under every service's heading, so only name
+		// triggers are attributed by the heading they were written under.
+		asked := name
+		if strings.HasSuffix(trigger, ".rpz-client-ip") {
+			r.Service, asked = service, "client "+resolveClient
+		} else if r.Service = matched[0].Section; !services.has(r.Service) {
+			r.Service = service
+		}
+
+		r.Reasons = append(r.Reasons, fmt.Sprintf("%s matches %s in response policy zone %s (%s:%d)", asked, trigger, zone, r.File, r.Line))
+
+		return r, applyPolicy(&r, matched, cacheZone)
+	}
+
+	if records, err := readZoneRecords(cacheZone, servedDomain("")); err == nil {
+		if answer := answerFrom(records, name, r.Type); len(answer) > 0 || strings.HasSuffix(name, "."+servedDomain("")) {
+			r.Action, r.File, r.Answer = "local", cacheZone, answer
+			r.Reasons = append(r.Reasons, name+" is in the cache zone "+servedDomain("")+", which is answered locally")
+
+			if len(answer) == 0 {
+				r.Reasons = append(r.Reasons, name+" has no "+r.Type+" record, so the answer is empty")
+			}
+
+			return r, nil
+		}
+	}
+
+	r.Action, r.Service = "forward", service
+	r.Reasons = append(r.Reasons, "no response policy matches "+name+", so it is resolved by the upstreams")
+
+	switch {
+	case service == "":
+	case serviceForwarders(service) != "":
+		r.Reasons = append(r.Reasons, fmt.Sprintf("cache_domains lists it for %s (%s), which FORWARD_%s sends to %s", service, rule, strings.ToUpper(service), serviceForwarders(service)))
+	default:
+		r.Reasons = append(r.Reasons, fmt.Sprintf("cache_domains lists it for %s (%s), which has no rewrites: the service is not enabled, or generation has not run since it was", service, rule))
+	}
+
+	return r, nil
+}
+
+// policyMatch returns the trigger in the records of a response policy zone that decides
+// the answer to name, and the records for it.
+func policyMatch(records []zoneRecord, zone, name string, client net.IP) (string, []zoneRecord) {
+	var (
+		best     string
+		bestBits = -1
+		wildcard string
+	)
+
+	for _, rec := range records {
+		trigger := strings.TrimSuffix(rec.Owner, "."+zone)
+
+		if rev, ok := strings.CutSuffix(trigger, ".rpz-client-ip"); ok {
+			if bits, n := clientTrigger(rev); n != nil && client != nil && n.Contains(client) && bits > bestBits {
+				best, bestBits = trigger, bits
+			}
+
+			continue
+		}
+
+		if bestBits >= 0 {
+			continue
+		}
+
+		if parent, ok := strings.CutPrefix(trigger, "*."); ok && strings.HasSuffix(name, "."+parent) && len(trigger) > len(wildcard) {
+			wildcard = trigger
+		}
+	}
+
+	if bestBits < 0 {
+		best = wildcard
+
+		for _, rec := range records {
+			if strings.TrimSuffix(rec.Owner, "."+zone) == name {
+				best = name
+				break
+			}
+		}
+	}
+
+	if best == "" {
+		return "", nil
+	}
+
+	matched := make([]zoneRecord, 0)
+
+	for _, rec := range records {
+		if strings.TrimSuffix(rec.Owner, "."+zone) == best {
+			matched = append(matched, rec)
+		}
+	}
+
+	return best, matched
+}
+
+// clientTrigger parses the prefix length and reversed address of an rpz-client-ip
+// trigger, such as 32.2.0.0.10 or 128.1.zz.db8.2001, into the network it matches.
+func clientTrigger(rev string) (int, *net.IPNet) {
+	n, ok := dnsgen.ClientIPNetwork(rev)
+	if !ok {
+		return 0, nil
+	}
+
+	bits, _ := n.Mask.Size()
+
+	return bits, n
+}
+
+// applyPolicy works out the answer from the policy records of the matched trigger.
+func applyPolicy(r *resolveResult, matched []zoneRecord, cacheZone string) error {
+	for _, rec := range matched {
+		if rec.Type != "CNAME" {
+			continue
+		}
+
+		switch target := strings.TrimSuffix(strings.ToLower(rec.Data), "."); target {
+		case "rpz-passthru":
+			r.Action = "passthru"
+			r.Reasons = append(r.Reasons, "the rule passes it through, so it is resolved by the upstreams unchanged")
+		case "":
+			r.Action = "nxdomain"
+			r.Reasons = append(r.Reasons, "the rule blocks it, answering that the name does not exist")
+		case "*":
+			r.Action = "nodata"
+			r.Reasons = append(r.Reasons, "the rule answers that the name has no records")
+		case "rpz-drop":
+			r.Action = "drop"
+			r.Reasons = append(r.Reasons, "the rule drops the query without an answer")
+		default:
+			r.Action, r.Answer = "rewrite", []string{"CNAME " + target}
+
+			if !strings.HasSuffix(target, "."+servedDomain("")) {
+				r.Reasons = append(r.Reasons, "the rule rewrites it to "+target+", which is resolved by the upstreams")
+				return nil
+			}
+
+			records, err := readZoneRecords(cacheZone, servedDomain(""))
+			if err != nil {
+				return err
+			}
+
+			r.Answer = append(r.Answer, answerFrom(records, target, r.Type)...)
+			r.Reasons = append(r.Reasons, "the rule rewrites it to "+target+", answered from "+cacheZone)
+
+			if len(r.Answer) == 1 {
+				r.Reasons = append(r.Reasons, target+" has no "+r.Type+" record, so the answer is empty")
+			}
+		}
+
+		return nil
+	}
+
+	r.Action, r.Answer = "rewrite", answerFrom(matched, matched[0].Owner, r.Type)
+	r.Reasons = append(r.Reasons, "the rule answers with its own records")
+
+	if len(r.Answer) == 0 {
+		r.Reasons = append(r.Reasons, "the rule has no "+r.Type+" record, so the answer is empty")
+	}
+
+	return nil
+}
+
+// answerFrom returns the records of type qtype owned by name, as type and data.
+func answerFrom(records []zoneRecord, name, qtype string) []string {
+	answer := make([]string, 0)
+
+	for _, rec := range records {
+		if rec.Owner == name && rec.Type == qtype {
+			answer = append(answer, rec.Type+" "+rec.Data)
+		}
+	}
+
+	return answer
+}
+
+// policyZones returns the response policy zones in the order the generated
+// response-policy statement lists them, or just the rpz zone when the template's
+// statement was left alone.
+func policyZones() []string {
+	for _, path := range []string{optionsConf(), zonesConf()} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		_, statement, ok := strings.Cut(string(content), "response-policy")
+		if !ok {
+			continue
+		}
+
+		statement, _, _ = strings.Cut(statement, "}")
+
+		zones := make([]string, 0)
+		for _, m := range policyZoneName.FindAllStringSubmatch(statement, -1) {
+			zones = append(zones, m[1])
+		}
+
+		if len(zones) > 0 {
+			return zones
+		}
+	}
+
+	return []string{"rpz"}
+}
+
+// readZoneRecords reads the records of the zone file at path, following $INCLUDE, with
+// owner names made absolute from origin.
+func readZoneRecords(path, origin string) ([]zoneRecord, error) {
+	return appendZoneRecords(make([]zoneRecord, 0), path, origin, 0)
+}
+
+func appendZoneRecords(records []zoneRecord, path, origin string, depth int) ([]zoneRecord, error) {
+	if depth > 8 {
+		return nil, fmt.Errorf("Zone file %s nests $INCLUDE too deeply", path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, section, parens := origin, "", 0
+
+	for i, line := range strings.Split(string(content), "\n") {
+		if heading, ok := strings.CutPrefix(line, ";## "); ok {
+			section = strings.TrimSpace(heading)
+			continue
+		}
+
+		data, _, _ := strings.Cut(line, ";")
+		fields := strings.Fields(data)
+
+		if !zoneLine(line, &parens) {
+			if parens == 0 && len(fields) > 1 {
+				switch strings.ToUpper(fields[0]) {
+				case "$ORIGIN":
+					origin = absoluteName(fields[1], origin)
+				case "$INCLUDE":
+					included := origin
+					if len(fields) > 2 {
+						included = absoluteName(fields[2], origin)
+					}
+
+					if records, err = appendZoneRecords(records, fields[1], included, depth+1); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			owner, fields = absoluteName(fields[0], origin), fields[1:]
+		}
+
+		for len(fields) > 0 && (strings.EqualFold(fields[0], "IN") || strings.Trim(fields[0], "0123456789") == "") {
+			fields = fields[1:]
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		records = append(records, zoneRecord{Owner: owner, Type: strings.ToUpper(fields[0]), Data: strings.Join(fields[1:], " "), File: path, Line: i + 1, Section: section})
+	}
+
+	return records, nil
+}
+
+// absoluteName returns a zone file name relative to origin as a lower case absolute
+// name without the trailing dot.
+func absoluteName(name, origin string) string {
+	name = strings.ToLower(name)
+
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	}
+
+	return name + "." + origin
+}
+
+func (r resolveResult) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Name:\t%s (%s)\n", r.Name, r.Type)
+
+	if r.Client != "" {
+		fmt.Fprintf(w, "Client:\t%s\n", r.Client)
+	}
+
+	if r.View != "" {
+		fmt.Fprintf(w, "View:\t%s\n", r.View)
+	}
+
+	fmt.Fprintf(w, "Outcome:\t%s\n", r.Action)
+
+	if r.Service != "" {
+		fmt.Fprintf(w, "Service:\t%s\n", r.Service)
+	}
+
+	if r.Rule != "" {
+		fmt.Fprintf(w, "Rule:\t%s (zone %s, %s:%d)\n", r.Rule, r.Zone, r.File, r.Line)
+	}
+
+	if len(r.Answer) > 0 {
+		fmt.Fprintf(w, "Answer:\t%s\n", strings.Join(r.Answer, "\n\t"))
+	}
+
+	_ = w.Flush()
+
+	fmt.Println()
+
+	for _, reason := range r.Reasons {
+		fmt.Println("  - " + reason)
+	}
+}
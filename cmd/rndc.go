@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// rndcArgs builds the common rndc arguments from RNDC_KEY, or the layout's key file,
+// RNDC_SERVER and RNDC_PORT.
+func rndcArgs(args ...string) []string {
+	var base []string
+
+	if key := rndcKey(); key != "" {
+		base = append(base, "-k", key)
+	}
+
+	if server := os.Getenv("RNDC_SERVER"); server != "" {
+		base = append(base, "-s", server)
+	}
+
+	if port := os.Getenv("RNDC_PORT"); port != "" {
+		base = append(base, "-p", port)
+	}
+
+	return append(base, args...)
+}
+
+// rndc runs a single rndc command and returns its combined output.
+func rndc(args ...string) (string, error) {
+	out, err := exec.Command("rndc", rndcArgs(args...)...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("rndc %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return string(out), nil
+}
+
+// reloadBIND asks the running named to pick up newly added zones and reload changed
+// ones, then verifies that the server and the generated zones are healthy.
+func reloadBIND() error {
+	log.Info("Reloading BIND configuration via rndc", "phase", "reload")
+
+	if _, err := rndc("reconfig"); err != nil {
+		return err
+	}
+
+	if _, err := rndc("reload"); err != nil {
+		return err
+	}
+
+	status, err := rndc("status")
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(status, "server is up and running") {
+		return fmt.Errorf("named is not running: %s", strings.TrimSpace(status))
+	}
+
+	for _, zone := range append([]string{dnsDomain()}, rpzZones(currentStatus().Services)...) {
+		args := []string{"zonestatus", zone}
+		if views, _ := clientViews(); len(views) > 0 {
+			args = append(args, "IN", "default")
+		}
+
+		if _, err = rndc(args...); err != nil {
+			return fmt.Errorf("Zone %s failed to load: %v", zone, err)
+		}
+	}
+
+	log.Info("BIND reloaded successfully", "phase", "reload")
+
+	return nil
+}
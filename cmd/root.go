@@ -4,16 +4,40 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// version is the release of dnstool, set at build time with
+// -ldflags "-X dnstool/cmd.version=<version>".
+var version = "dev"
+
 var rootCmd = &cobra.Command{
-	Use:   "dnstool",
-	Short: "dnstool is a utility to generate configuration for the lancache-dns container",
+	Use:     "dnstool",
+	Version: version,
+	Short:   "dnstool is a utility to generate configuration for the lancache-dns container",
 	Long: `A replacement utility for the configuration generator bash script:
 https://github.com/lancachenet/lancache-dns/blob/d626a74c02c7a8383eeaaab493fcdffe536aea95/overlay/hooks/entrypoint-pre.d/10_generate_config.sh
 utilised to generate configuration for lancache-dns containers`,
+	PersistentPreRun: func(_ *cobra.Command, _ []string) {
+		configureLogging()
+
+		if err := configurePaths(); err != nil {
+			log.Fatal(err)
+		}
+	},
 }
 
 func init() {
+	rootCmd.AddCommand(benchmarkCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(dohProxyCmd)
+	rootCmd.AddCommand(fixtureCmd)
 	rootCmd.AddCommand(generateCmd)
+	rootCmd.AddCommand(healthcheckCmd)
+	rootCmd.AddCommand(listDomainsCmd)
+	rootCmd.AddCommand(listServicesCmd)
+	rootCmd.AddCommand(resolveCmd)
+	rootCmd.AddCommand(exporterCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(serviceTestCmd)
+	rootCmd.AddCommand(serviceCmd)
 }
 
 func Execute() error {
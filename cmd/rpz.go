@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"dnstool/pkg/dnsgen"
+)
+
+// maxPolicyZones is the most zones BIND accepts in a response-policy statement.
+const maxPolicyZones = 64
+
+// rpzPerService reports whether each service is given its own response policy zone
+// rather than sharing the rpz zone.
+func rpzPerService() bool {
+	return os.Getenv("RPZ_PER_SERVICE") == "true"
+}
+
+// rpzServiceZone returns the name of the response policy zone holding the rewrites for
+// service.
+func rpzServiceZone(service string) string {
+	if !rpzPerService() {
+		return "rpz"
+	}
+
+	return dnsgen.ServiceRPZZone(service)
+}
+
+// rpzZones returns the response policy zones in the order they are consulted. The rpz
+// zone comes first so that client passthroughs and custom entries take precedence,
+// followed by passed through services so that no other service's rewrites catch them.
+func rpzZones(services []serviceStatus) []string {
+	zones := []string{"rpz"}
+
+	if !rpzPerService() {
+		return zones
+	}
+
+	for _, s := range services {
+		if s.Policy == "passthru" {
+			zones = append(zones, rpzServiceZone(s.Name))
+		}
+	}
+
+	for _, s := range services {
+		if s.Enabled || s.Policy == "block" {
+			zones = append(zones, rpzServiceZone(s.Name))
+		}
+	}
+
+	return zones
+}
+
+// rpzServiceZonesConfiguration returns the cache.conf stanzas serving the per-service
+// response policy zones.
+func rpzServiceZonesConfiguration(services []serviceStatus, transfer string) string {
+	var b strings.Builder
+
+	for _, zone := range rpzZones(services)[1:] {
+		fmt.Fprintf(&b, fmtUnqueriedZoneConf, zone, zonePath+zone+".db", transfer)
+	}
+
+	return b.String()
+}
+
+// writeRPZZone writes the RPZ SOA and NS records of the zone file at path to f, taking
+// the serial from the copy of the zone on disk.
+func writeRPZZone(f io.Writer, path string) error {
+	serial, err := nextSerial(path, time.Now())
+	if err != nil {
+		return err
+	}
+
+	soa, err := soaFor("RPZ_", dnsgen.RPZSOADefaults)
+	if err != nil {
+		return err
+	}
+
+	ttl, err := recordTTL("RPZ_TTL", "60")
+	if err != nil {
+		return err
+	}
+
+	return dnsgen.WriteRPZHeader(f, ttl, soa, serial)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var (
+	logSize     = regexp.MustCompile(`^(\d+[kKmMgG]?|unlimited|default)$`)
+	logVersions = regexp.MustCompile(`^(\d+|unlimited)$`)
+)
+
+// rpzLoggingConfiguration returns a logging statement sending RPZ rewrites to their own
+// rotated file when RPZ_LOG is enabled, so steered lookups can be seen without turning
+// on full query logging.
+func rpzLoggingConfiguration() (string, error) {
+	if os.Getenv("RPZ_LOG") != "true" {
+		return "", nil
+	}
+
+	file := "/var/log/named/rpz.log"
+	if os.Getenv("RPZ_LOG_FILE") != "" {
+		file = os.Getenv("RPZ_LOG_FILE")
+	}
+
+	size := "10m"
+	if os.Getenv("RPZ_LOG_SIZE") != "" {
+		size = os.Getenv("RPZ_LOG_SIZE")
+	}
+
+	if !logSize.MatchString(size) {
+		return "", fmt.Errorf("RPZ_LOG_SIZE value: %s is not a valid size", size)
+	}
+
+	versions := "5"
+	if os.Getenv("RPZ_LOG_VERSIONS") != "" {
+		versions = os.Getenv("RPZ_LOG_VERSIONS")
+	}
+
+	if !logVersions.MatchString(versions) {
+		return "", fmt.Errorf("RPZ_LOG_VERSIONS value: %s is not a valid number of versions", versions)
+	}
+
+	return fmt.Sprintf(fmtRPZLogging, file, versions, size), nil
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// scheduleWindow is a recurring period during which a scheduled service is intercepted.
+// A window ending at or before its start runs overnight into the next day.
+type scheduleWindow struct {
+	days       [7]bool
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseSchedule parses a semicolon separated list of windows such as
+// "mon-fri 18:00-08:00; sat,sun *", each a set of days followed by a time range.
+func parseSchedule(s string) ([]scheduleWindow, error) {
+	windows := make([]scheduleWindow, 0)
+
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Schedule window: %s must be days followed by a time range", entry)
+		}
+
+		var w scheduleWindow
+
+		for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+			if part == "*" {
+				w.days = [7]bool{true, true, true, true, true, true, true}
+				continue
+			}
+
+			from, to, isRange := strings.Cut(part, "-")
+			first, ok1 := weekdays[from]
+			last, ok2 := weekdays[to]
+
+			if !isRange {
+				last, ok2 = first, ok1
+			}
+
+			if !ok1 || !ok2 {
+				return nil, fmt.Errorf("Schedule days: %s is not a day or range of days", part)
+			}
+
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+
+		if fields[1] == "*" {
+			w.start, w.end = 0, 24*60
+		} else {
+			from, to, ok := strings.Cut(fields[1], "-")
+			start, err1 := scheduleMinute(from)
+			end, err2 := scheduleMinute(to)
+
+			if !ok || err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("Schedule times: %s must be HH:MM-HH:MM", fields[1])
+			}
+
+			w.start, w.end = start, end
+		}
+
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+func scheduleMinute(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls within the window.
+func (w scheduleWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	if w.end > w.start {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// scheduleActive reports whether service is within its SCHEDULE_<SERVICE> windows at
+// now. Services without a schedule are always active.
+func scheduleActive(service string, now time.Time) (bool, error) {
+	s := os.Getenv("SCHEDULE_" + strings.ToUpper(service))
+	if s == "" {
+		return true, nil
+	}
+
+	windows, err := parseSchedule(s)
+	if err != nil {
+		return false, fmt.Errorf("SCHEDULE_%s: %v", strings.ToUpper(service), err)
+	}
+
+	for _, w := range windows {
+		if w.contains(now) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// scheduledServices returns the services with a SCHEDULE_<SERVICE> variable.
+func scheduledServices() []string {
+	services := make([]string, 0)
+
+	for _, e := range os.Environ() {
+		key, _, _ := strings.Cut(e, "=")
+		if service, ok := strings.CutPrefix(key, "SCHEDULE_"); ok && service != "" {
+			services = append(services, service)
+		}
+	}
+
+	return services
+}
+
+// nextScheduleChange returns the first minute after now at which any scheduled service
+// starts or stops being intercepted, looking up to a week ahead.
+func nextScheduleChange(now time.Time) (time.Time, bool) {
+	services := scheduledServices()
+	if len(services) == 0 {
+		return time.Time{}, false
+	}
+
+	state := func(t time.Time) string {
+		var b strings.Builder
+
+		for _, s := range services {
+			active, _ := scheduleActive(s, t)
+			fmt.Fprint(&b, active)
+		}
+
+		return b.String()
+	}
+
+	current := state(now)
+	t := now.Truncate(time.Minute)
+
+	for i := 0; i < 7*24*60; i++ {
+		t = t.Add(time.Minute)
+		if state(t) != current {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// startScheduler regenerates the configuration whenever a scheduled service enters or
+// leaves one of its windows.
+func startScheduler() {
+	if len(scheduledServices()) == 0 {
+		return
+	}
+
+	go func() {
+		for {
+			next, ok := nextScheduleChange(time.Now())
+			if !ok {
+				return
+			}
+
+			log.Info("Next scheduled service change", "phase", "schedule", "time", next)
+			time.Sleep(time.Until(next))
+
+			requestRegeneration("schedule")
+		}
+	}()
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tsigKeyName returns the name of the TSIG key securing zone transfers, if configured.
+func tsigKeyName() string {
+	if os.Getenv("TSIG_KEY_SECRET") == "" {
+		return ""
+	}
+
+	if os.Getenv("TSIG_KEY_NAME") != "" {
+		return os.Getenv("TSIG_KEY_NAME")
+	}
+
+	return "lancache-transfer"
+}
+
+// tsigKeyConfiguration returns the key statement for TSIG_KEY_SECRET, if configured.
+func tsigKeyConfiguration() string {
+	name := tsigKeyName()
+	if name == "" {
+		return ""
+	}
+
+	algorithm := "hmac-sha256"
+	if os.Getenv("TSIG_ALGORITHM") != "" {
+		algorithm = os.Getenv("TSIG_ALGORITHM")
+	}
+
+	return fmt.Sprintf(fmtTSIGKey, name, algorithm, os.Getenv("TSIG_KEY_SECRET"))
+}
+
+// zoneTransferOptions returns the zone options allowing SECONDARY_DNS_SERVERS to
+// transfer the generated zones, notifying them of changes. When a TSIG key is
+// configured transfers are only allowed when signed with it.
+func zoneTransferOptions() (string, error) {
+	servers := cleanIP(os.Getenv("SECONDARY_DNS_SERVERS"))
+	if len(servers) == 0 {
+		return "", nil
+	}
+
+	if err := isIP(servers); err != nil {
+		return "", err
+	}
+
+	allow := strings.Join(servers, "; ") + ";"
+	notify := allow
+
+	if key := tsigKeyName(); key != "" {
+		allow = fmt.Sprintf("key \"%s\";", key)
+
+		entries := make([]string, 0, len(servers))
+		for _, s := range servers {
+			entries = append(entries, fmt.Sprintf("%s key \"%s\";", s, key))
+		}
+
+		notify = strings.Join(entries, " ")
+	}
+
+	return fmt.Sprintf("\t\tallow-transfer { %s };\n\t\talso-notify { %s };\n\t\tnotify explicit;\n", allow, notify), nil
+}
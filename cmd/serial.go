@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"dnstool/pkg/dnsgen"
+)
+
+var soaSerial = regexp.MustCompile(`SOA\s+\S+\s+\S+\s*\(\s*(\d+)`)
+
+// zoneSerial reads the SOA serial of an existing zone file, returning 0 if there is none.
+func zoneSerial(path string) uint32 {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	m := soaSerial.FindSubmatch(f)
+	if m == nil {
+		return 0
+	}
+
+	serial, err := strconv.ParseUint(string(m[1]), 10, 32)
+	if err != nil {
+		return 0
+	}
+
+	return uint32(serial)
+}
+
+// nextSerial returns a serial for the zone at path that is strictly greater than the
+// serial it currently has, so secondaries always pick up the change. SERIAL_FORMAT
+// selects unix (seconds since the epoch, the default), date (YYYYMMDDnn) or counter.
+func nextSerial(path string, now time.Time) (uint32, error) {
+	return dnsgen.NextSerial(zoneSerial(path), now, os.Getenv("SERIAL_FORMAT"))
+}
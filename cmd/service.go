@@ -0,0 +1,365 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"dnstool/pkg/dnsgen"
+)
+
+var serviceIP string
+
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Enable or disable a service at runtime",
+	Long:  `Change whether a service is cached without restarting the container: the change is saved to the runtime state file, as the API does, the service's records are patched into the generated zones, the generation hooks, notifications and audit log run as for a generation and BIND reloads them. Output rendered by generate render, such as dnsmasq or hosts files, is not rewritten. A daemon keeps the runtime state in memory, so while one is running use its REST or gRPC API instead`,
+}
+
+var serviceEnableCmd = &cobra.Command{
+	Use:   "enable <service>",
+	Short: "Cache a service, overriding DISABLE_<SERVICE>",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		if err := changeService(args[0], true); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var serviceDisableCmd = &cobra.Command{
+	Use:   "disable <service>",
+	Short: "Stop caching a service",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		if err := changeService(args[0], false); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	serviceCmd.AddCommand(serviceEnableCmd)
+	serviceCmd.AddCommand(serviceDisableCmd)
+
+	serviceEnableCmd.Flags().StringVar(&serviceIP, "ip", "", "Cache IPs to use, as in <SERVICE>CACHE_IP with any weights, defaulting to those of the environment")
+}
+
+// changeService records a runtime override enabling or disabling a service, then
+// applies it to the generated zones and reloads BIND.
+func changeService(name string, enable bool) error {
+	if err := loadEnvFile(); err != nil {
+		return err
+	}
+
+	if _, err := loadConfigSource(); err != nil {
+		return err
+	}
+
+	if err := loadRuntimeState(); err != nil {
+		return err
+	}
+
+	services, serviceFiles, err := identifyServices()
+	if err != nil {
+		return err
+	}
+
+	index := -1
+	for i, s := range services {
+		if strings.EqualFold(s, name) {
+			index = i
+		}
+	}
+
+	service := strings.ToLower(name)
+	if index < 0 {
+		return fmt.Errorf("%s is not a service in cache_domains", service)
+	}
+
+	o := serviceOverride{Enabled: &enable}
+	if enable {
+		if err = checkEnableIP(service, serviceIP); err != nil {
+			return err
+		}
+
+		o.IP = serviceIP
+	}
+
+	setServiceOverride(service, o)
+	clearPendingService(service)
+	if err = saveRuntimeState(); err != nil {
+		return err
+	}
+
+	log.Info("Saved runtime state", "phase", "service", "service", service, "enabled", enable, "file", stateFile())
+
+	action := "disable "
+	if enable {
+		action = "enable "
+	}
+
+	if reason := zonesUnpatchable(); reason != "" {
+		log.Info("Regenerating every zone as they cannot be patched", "phase", "service", "reason", reason)
+
+		dns, err := configuredUpstreams()
+		if err != nil {
+			return err
+		}
+
+		if err = regenerateLancacheDNS(dns, "service: "+action+service); err != nil {
+			return err
+		}
+
+		return reloadBIND()
+	}
+
+	if err = patchGeneration(services, services[index], serviceFiles[index], "service: "+action+service); err != nil {
+		return err
+	}
+
+	for _, zone := range []string{dnsDomain(), "rpz"} {
+		if _, err = rndc("reload", zone); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Reloaded the patched zones", "phase", "service", "service", service)
+
+	return nil
+}
+
+// zonesUnpatchable returns why the records of a single service cannot be patched into
+// the generated zones, or an empty string when they can: with per-service response
+// policy zones, views or split zones a change reaches beyond the service's own records.
+func zonesUnpatchable() string {
+	if rpzPerService() {
+		return "RPZ_PER_SERVICE is set"
+	}
+
+	if views, err := clientViews(); err != nil || len(views) > 0 {
+		return "client views are configured"
+	}
+
+	if os.Getenv("ZONE_SPLIT") == "true" {
+		return "ZONE_SPLIT is set"
+	}
+
+	for _, path := range []string{zonePath + dnsDomain() + ".db", rpzZone} {
+		if _, err := os.Stat(path); err != nil {
+			return path + " has not been generated"
+		}
+	}
+
+	return ""
+}
+
+// patchGeneration patches the zones for service as a generation of its own, as
+// regenerateLancacheDNS runs one: the generation hooks run around it and its outcome is
+// recorded, notified and audited, with the other services carried over as the last
+// successful generation enabled them.
+func patchGeneration(services []string, service string, serviceFiles []string, reason string) error {
+	if err := runHooks("PRE_GENERATE_HOOK", hookEnv("pre", reason, nil, nil)); err != nil {
+		return err
+	}
+
+	generated := []string{zonePath + dnsDomain() + ".db", rpzZone}
+
+	before := fileDigests(generated)
+	started := time.Now()
+
+	status, err := patchServiceZones(services, service, serviceFiles)
+	if err == nil {
+		was := lastEnabledServices()
+
+		for _, s := range services {
+			name := strings.ToLower(s)
+			if name == status.Name {
+				recordService(status)
+				continue
+			}
+
+			_, enabled := was[name]
+			recordService(serviceStatus{Name: name, Enabled: enabled, Domains: was[name]})
+		}
+	}
+
+	recordGeneration(started, err)
+	notifyGeneration(err)
+
+	changed := changedFiles(before, fileDigests(generated))
+	writeAudit(reason, currentStatus(), changed, err)
+
+	if err == nil {
+		rememberEnabledServices(currentStatus())
+	}
+
+	if herr := runHooks("POST_GENERATE_HOOK", hookEnv("post", reason, changed, err)); herr != nil {
+		log.Error("Post-generation hook failed", "phase", "hooks", "error", herr)
+	}
+
+	return err
+}
+
+// patchServiceZones plans a single service and splices its records into the cache zone
+// and its section into the rpz zone, written as the bind and rpz backends write them,
+// each with a new serial, leaving the records of every other service as they are.
+// services lists every service in generation order. The status recorded for the service
+// is returned.
+func patchServiceZones(services []string, service string, serviceFiles []string) (serviceStatus, error) {
+	useGenericCache := "false"
+	if os.Getenv("USE_GENERIC_CACHE") != "" {
+		useGenericCache = os.Getenv("USE_GENERIC_CACHE")
+	}
+
+	if err := checkGenericCache(useGenericCache, os.Getenv("LANCACHE_IP")); err != nil {
+		return serviceStatus{}, err
+	}
+
+	if err := refreshDockerCaches(); err != nil {
+		log.Warn("Failed to discover cache containers", "phase", "discovery", "error", err)
+	}
+
+	g, err := newGenerator(namedServices(services))
+	if err != nil {
+		return serviceStatus{}, err
+	}
+
+	o, status, err := planService(g, service, serviceFiles)
+	if err != nil {
+		return serviceStatus{}, err
+	}
+
+	order := map[string]int{}
+	for i, s := range services {
+		order[strings.ToLower(s)] = i + 1
+	}
+
+	var records, section bytes.Buffer
+	if err = dnsgen.WriteCacheRecords(&records, g.Config, o); err != nil {
+		return serviceStatus{}, err
+	}
+
+	if err = dnsgen.WriteRPZSection(&section, g.Config, o); err != nil {
+		return serviceStatus{}, err
+	}
+
+	service = o.Service
+
+	if err = patchZone(zonePath+dnsDomain()+".db", func(lines []string) []string {
+		return spliceCacheRecords(lines, service, order, zoneLines(records.Bytes()))
+	}); err != nil {
+		return serviceStatus{}, err
+	}
+
+	if err = patchZone(rpzZone, func(lines []string) []string {
+		return spliceRPZSection(lines, service, order, zoneLines(section.Bytes()))
+	}); err != nil {
+		return serviceStatus{}, err
+	}
+
+	log.Info("Patched the zones", "phase", "service", "service", service, "enabled", status.Enabled, "ips", strings.Join(status.IPs, " "), "domains", status.Domains)
+
+	return status, nil
+}
+
+// zoneLines splits zone file content into lines.
+func zoneLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// patchZone rewrites the zone file at path with the lines returned by patch and the next
+// serial, replacing it atomically.
+func patchZone(path string, patch func([]string) []string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	serial, err := nextSerial(path, time.Now())
+	if err != nil {
+		return err
+	}
+
+	patched := strings.Join(patch(zoneLines(content)), "\n") + "\n"
+
+	m := soaSerial.FindStringSubmatchIndex(patched)
+	if m == nil {
+		return fmt.Errorf("Zone file %s has no SOA serial", path)
+	}
+
+	w := &zoneWriter{path: path}
+	w.buf.WriteString(patched[:m[2]] + strconv.FormatUint(uint64(serial), 10) + patched[m[3]:])
+
+	return w.commit()
+}
+
+// spliceCacheRecords replaces the records of service in the cache zone with records, in
+// the place of the old ones or otherwise ahead of the first service generated after it.
+func spliceCacheRecords(lines []string, service string, order map[string]int, records []string) []string {
+	patched := make([]string, 0, len(lines)+len(records))
+	inserted := false
+
+	for _, line := range lines {
+		owner := ""
+		if line != "" && line[0] != ' ' && line[0] != '\t' && line[0] != ';' && line[0] != '$' {
+			owner = strings.Fields(line)[0]
+		}
+
+		if !inserted && (owner == service || order[owner] > order[service]) {
+			patched = append(patched, records...)
+			inserted = true
+		}
+
+		if owner != service {
+			patched = append(patched, line)
+		}
+	}
+
+	if !inserted {
+		patched = append(patched, records...)
+	}
+
+	return patched
+}
+
+// spliceRPZSection replaces the ;## section of service in the rpz zone with section, in
+// the place of the old one or otherwise ahead of the first section that follows it: that
+// of a service generated after it or one written once the services are done.
+func spliceRPZSection(lines []string, service string, order map[string]int, section []string) []string {
+	patched := make([]string, 0, len(lines)+len(section))
+	inserted, skipping := false, false
+
+	for _, line := range lines {
+		heading, isHeading := strings.CutPrefix(line, ";## ")
+		heading = strings.TrimSpace(heading)
+
+		if isHeading || strings.HasPrefix(line, "$INCLUDE") {
+			skipping = isHeading && heading == service
+
+			if !inserted && (skipping || !isHeading || order[heading] == 0 || order[heading] > order[service]) {
+				patched = append(patched, section...)
+				inserted = true
+			}
+		}
+
+		if !skipping {
+			patched = append(patched, line)
+		}
+	}
+
+	if !inserted {
+		patched = append(patched, section...)
+	}
+
+	return patched
+}
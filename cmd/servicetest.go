@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"dnstool/pkg/dnsgen"
+)
+
+var (
+	serviceTestServer   string
+	serviceTestDomain   string
+	serviceTestExpected string
+	serviceTestSample   int
+	serviceTestTimeout  time.Duration
+	serviceTestJSON     bool
+)
+
+var serviceTestCmd = &cobra.Command{
+	Use:   "test <service>",
+	Short: "Verify a service's domains resolve to its cache",
+	Long:  `Resolve a sample of the service's domains at the resolver, checking each is answered with the service's cache IP, and check the generated RPZ exempts the caches and PASSTHRU_IPS so that their own lookups bypass it, printing a report per domain and client`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		results, err := testService(strings.ToLower(args[0]))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if serviceTestJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err = enc.Encode(results); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "STATUS\tCHECK\tNAME\tDETAIL\n")
+
+			for _, r := range results {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", strings.ToUpper(r.Status), r.Check, r.Name, r.Detail)
+			}
+
+			_ = w.Flush()
+		}
+
+		for _, r := range results {
+			if r.Status == doctorFail {
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+func init() {
+	serviceTestCmd.Flags().StringVar(&serviceTestServer, "server", "", "Resolver to check, defaulting to 127.0.0.1 on BIND_PORT")
+	serviceTestCmd.Flags().StringVar(&serviceTestDomain, "domain", "", "Cache domain the resolver serves, defaulting to LANCACHE_DNSDOMAIN")
+	serviceTestCmd.Flags().StringVar(&serviceTestExpected, "expected-ip", "", "Cache IPs the domains must resolve to, defaulting to the service's cache IP in the environment")
+	serviceTestCmd.Flags().IntVar(&serviceTestSample, "sample", 20, "Number of domains to resolve, 0 for all")
+	serviceTestCmd.Flags().DurationVar(&serviceTestTimeout, "timeout", 2*time.Second, "Time to wait for each answer")
+	serviceTestCmd.Flags().BoolVar(&serviceTestJSON, "json", false, "Output as JSON")
+}
+
+// serviceTestResult is the outcome of resolving one domain or checking one client.
+type serviceTestResult struct {
+	Check  string `json:"check"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func testService(service string) ([]serviceTestResult, error) {
+	server, err := resolverTarget(serviceTestServer)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := servedDomain(serviceTestDomain)
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(services[service]) == 0 {
+		return nil, fmt.Errorf("%s is not a service in cache_domains", service)
+	}
+
+	expected, err := configuredCacheIPs(serviceTestExpected, service)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := queryDNS(server, dnsQuery{Name: service + "." + domain, Type: dnsmessage.TypeA, Timeout: serviceTestTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("%s did not answer: %w", server.address(), err)
+	}
+
+	if len(record.Addrs) == 0 {
+		return nil, fmt.Errorf("%s.%s has no address, %s is not cached or generation has not run", service, domain, service)
+	}
+
+	// Without cache IPs in the environment the domains must match the service's record.
+	if len(expected) == 0 {
+		for _, a := range record.Addrs {
+			expected[a] = true
+		}
+	}
+
+	log.Info("Testing service", "phase", "test", "service", service, "server", server.address())
+
+	results := make([]serviceTestResult, 0)
+
+	for _, name := range sampleDomains(services[service], serviceTestSample) {
+		results = append(results, testDomain(server, name, expected))
+	}
+
+	passthru, err := testPassthru(expected)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(results, passthru...), nil
+}
+
+// sampleDomains returns n domains spread evenly through domains, or all of them when n
+// is 0, with a name under each wildcard standing in for it.
+func sampleDomains(domains []string, n int) []string {
+	if n <= 0 || n > len(domains) {
+		n = len(domains)
+	}
+
+	names := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		d := domains[i*len(domains)/n]
+		if parent, ok := strings.CutPrefix(d, "*."); ok {
+			d = "dnstool-test." + parent
+		}
+
+		names = append(names, d)
+	}
+
+	return names
+}
+
+// testDomain resolves name, which must be answered with only expected addresses.
+func testDomain(server upstream, name string, expected map[string]bool) serviceTestResult {
+	r := serviceTestResult{Check: "domain", Name: name}
+
+	answer, err := queryDNS(server, dnsQuery{Name: name, Type: dnsmessage.TypeA, Timeout: serviceTestTimeout})
+
+	switch {
+	case err != nil:
+		r.Status, r.Detail = doctorFail, err.Error()
+	case len(answer.Addrs) == 0:
+		r.Status, r.Detail = doctorFail, fmt.Sprintf("not answered with an address (%s)", answer.RCode)
+	case !onlyCacheIPs(answer.Addrs, expected):
+		r.Status, r.Detail = doctorFail, "resolved to "+strings.Join(answer.Addrs, ", ")+", not the cache"
+	default:
+		r.Status, r.Detail = doctorPass, "resolved to "+strings.Join(answer.Addrs, ", ")
+	}
+
+	return r
+}
+
+// testPassthru checks the RPZ on disk exempts each cache and PASSTHRU_IPS client, so
+// that their lookups are answered by the upstreams rather than rewritten.
+func testPassthru(caches map[string]bool) ([]serviceTestResult, error) {
+	content, err := os.ReadFile(rpzZone)
+	if err != nil {
+		return nil, err
+	}
+
+	exempt := rpzPassthruClients(string(content))
+
+	clients := make([]string, 0)
+	for ip := range caches {
+		clients = append(clients, ip)
+	}
+
+	sort.Strings(clients)
+
+	clients = uniqueIPs(append(clients, cleanIP(os.Getenv("PASSTHRU_IPS"))...))
+
+	results := make([]serviceTestResult, 0, len(clients))
+
+	for _, ip := range clients {
+		r := serviceTestResult{Check: "passthru", Name: ip}
+
+		switch {
+		case exempt[net.ParseIP(ip).String()]:
+			r.Status, r.Detail = doctorPass, "bypasses the RPZ"
+		default:
+			r.Status, r.Detail = doctorFail, "has no rpz-client-ip passthrough in "+rpzZone
+		}
+
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// rpzPassthruClients returns the client addresses an RPZ zone exempts with
+// rpz-client-ip passthroughs.
+func rpzPassthruClients(zone string) map[string]bool {
+	clients := map[string]bool{}
+
+	for _, line := range strings.Split(zone, "\n") {
+		data, _, _ := strings.Cut(line, ";")
+
+		fields := strings.Fields(data)
+		if len(fields) < 3 || fields[len(fields)-1] != "rpz-passthru." {
+			continue
+		}
+
+		rev, ok := strings.CutSuffix(fields[0], ".rpz-client-ip")
+		if !ok {
+			continue
+		}
+
+		if n, ok := dnsgen.ClientIPNetwork(rev); ok {
+			if ones, bits := n.Mask.Size(); ones == bits {
+				clients[n.IP.String()] = true
+			}
+		}
+	}
+
+	return clients
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// smokeTesting is held while a smoke test runs, so that reloads in quick succession
+// don't start several at once.
+var smokeTesting sync.Mutex
+
+// startSmokeTest checks, when SMOKE_TEST is enabled, that the running named intercepts a
+// domain of every enabled service and still resolves other names, once it answers after
+// a generation. Failures are logged as errors, or with SMOKE_TEST_EXIT=true end dnstool
+// so that the container is restarted rather than serving a broken configuration.
+func startSmokeTest(reason string) {
+	if os.Getenv("SMOKE_TEST") != "true" {
+		return
+	}
+
+	go func() {
+		if !smokeTesting.TryLock() {
+			return
+		}
+		defer smokeTesting.Unlock()
+
+		checks, err := smokeTest()
+		if err == nil {
+			log.Info("Smoke test passed", "phase", "smoke", "reason", reason, "checks", checks)
+			return
+		}
+
+		log.Error("Smoke test failed, clients may not be downloading from the caches", "phase", "smoke", "reason", reason, "error", err)
+
+		if os.Getenv("SMOKE_TEST_EXIT") == "true" {
+			deregisterConsulService()
+			os.Exit(1)
+		}
+	}()
+}
+
+// smokeTest waits up to SMOKE_TEST_TIMEOUT for named to answer, then resolves a domain
+// of each service enabled by the last generation, which must be answered with only its
+// cache IPs, and UPSTREAM_CHECK_NAME. It returns the number of lookups checked.
+func smokeTest() (int, error) {
+	server, err := resolverTarget("")
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := time.Minute
+	if d, err := time.ParseDuration(os.Getenv("SMOKE_TEST_TIMEOUT")); err == nil && d > 0 {
+		timeout = d
+	}
+
+	domain := servedDomain("")
+
+	for deadline := time.Now().Add(timeout); ; time.Sleep(time.Second) {
+		_, err = queryDNS(server, dnsQuery{Name: domain, Type: dnsmessage.TypeSOA, Timeout: time.Second})
+		if err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("named did not answer at %s within %s: %w", server.address(), timeout, err)
+		}
+	}
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		return 0, err
+	}
+
+	checks := 0
+	failures := make([]string, 0)
+	caches := map[string]bool{}
+
+	// During a canary rollout lookups from the host itself are not intercepted.
+	canary := len(cleanIP(os.Getenv("CANARY_CLIENTS"))) > 0
+
+	for _, s := range currentStatus().Services {
+		if canary || !s.Enabled || len(s.IPs) == 0 || len(services[s.Name]) == 0 {
+			continue
+		}
+
+		expected := map[string]bool{}
+		for _, ip := range s.IPs {
+			expected[ip], caches[ip] = true, true
+		}
+
+		name := sampleDomains(services[s.Name], 1)[0]
+		checks++
+
+		answer, err := queryDNS(server, dnsQuery{Name: name, Type: dnsmessage.TypeA})
+
+		switch {
+		case err != nil:
+			failures = append(failures, name+": "+err.Error())
+		case len(answer.Addrs) == 0:
+			failures = append(failures, fmt.Sprintf("%s was not answered with an address (%s)", name, answer.RCode))
+		case !onlyCacheIPs(answer.Addrs, expected):
+			failures = append(failures, fmt.Sprintf("%s resolved to %s rather than the %s cache", name, strings.Join(answer.Addrs, ", "), s.Name))
+		}
+	}
+
+	external := upstreamCheckName()
+	checks++
+
+	answer, err := queryDNS(server, dnsQuery{Name: external, Type: dnsmessage.TypeA})
+
+	switch {
+	case err != nil:
+		failures = append(failures, external+": "+err.Error())
+	case answer.RCode != dnsmessage.RCodeSuccess:
+		failures = append(failures, fmt.Sprintf("%s was answered with %s, check the upstreams", external, answer.RCode))
+	default:
+		for _, a := range answer.Addrs {
+			if caches[a] {
+				failures = append(failures, fmt.Sprintf("%s resolved to the cache address %s", external, a))
+				break
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		return checks, fmt.Errorf("%d of %d lookups failed: %s", len(failures), checks, strings.Join(failures, "; "))
+	}
+
+	return checks, nil
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// snapshot is a bundled copy of cache_domains used when neither the network nor a
+// local clone is available, so that an isolated LAN still gets a working configuration.
+//
+//go:embed snapshot
+var snapshot embed.FS
+
+// extractSnapshot writes the embedded cache_domains snapshot to dest and drops a marker
+// file so that a later bootstrap knows the directory may be replaced by a real clone.
+func extractSnapshot(dest string) error {
+	log.Warn("Using embedded offline snapshot of cache_domains", "phase", "bootstrap")
+
+	if err := copyEmbedded(snapshot, "snapshot", dest); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dest, snapshotMarker), nil, 0644)
+}
+
+// copyEmbedded writes the tree under root in fsys to dest.
+func copyEmbedded(fsys embed.FS, root, dest string) error {
+	return fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		b, err := fsys.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(target, b, 0644)
+	})
+}
+
+// clearSnapshot removes a previously extracted snapshot so that git can clone into an
+// empty directory. Directories not created from the snapshot are left untouched.
+func clearSnapshot(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, snapshotMarker)); os.IsNotExist(err) {
+		return nil
+	}
+
+	return clearDirectory(dir)
+}
+
+// clearDirectory removes the contents of dir, leaving the directory itself in place as it
+// may be a mounted volume.
+func clearDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err = os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"dnstool/pkg/dnsgen"
+)
+
+// soaFor returns the SOA fields for a zone, taking SOA_<FIELD> for all zones and
+// <prefix>SOA_<FIELD> for the zone itself, falling back to the given defaults.
+func soaFor(prefix string, defaults dnsgen.SOA) (dnsgen.SOA, error) {
+	return dnsgen.SOAFromEnv(os.LookupEnv, prefix, defaults)
+}
+
+// recordTTL returns the default TTL for records of a zone from the given variable.
+func recordTTL(key, fallback string) (string, error) {
+	ttl := os.Getenv(key)
+	if ttl == "" {
+		return fallback, nil
+	}
+
+	if !dnsgen.ValidTime(ttl) {
+		return "", fmt.Errorf("%s value: %s is not a valid time", key, ttl)
+	}
+
+	return ttl, nil
+}
@@ -0,0 +1,328 @@
+package cmd
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// serviceOverride is a runtime change to a service made through the admin API. Unset
+// fields leave the environment configuration in effect.
+type serviceOverride struct {
+	Enabled *bool  `json:"enabled,omitempty"`
+	IP      string `json:"ip,omitempty"`
+}
+
+// customDomain is an additional domain intercepted for a service at runtime.
+type customDomain struct {
+	Domain  string `json:"domain"`
+	Service string `json:"service"`
+}
+
+// runtimeConfig holds changes made at runtime. It is persisted to the state file and
+// takes precedence over the environment when generating configuration: a service
+// override wins over DISABLE_<SERVICE> and <SERVICE>CACHE_IP, which in turn win over
+// LANCACHE_IP.
+type runtimeConfig struct {
+	Services      map[string]serviceOverride `json:"services"`
+	CustomDomains []customDomain             `json:"custom_domains"`
+	// KnownServices lists the cache_domains services seen by the last generation, so
+	// that services appearing upstream are announced once, across restarts.
+	KnownServices []string `json:"known_services,omitempty"`
+	// PendingServices lists new services held back by AUTO_ENABLE_NEW_SERVICES=approve
+	// until they are approved through the API.
+	PendingServices []string `json:"pending_services,omitempty"`
+	// EnabledServices maps each service enabled by the last successful generation to its
+	// number of domains, so that the audit log reports changes against it across
+	// restarts.
+	EnabledServices map[string]int `json:"enabled_services,omitempty"`
+	// RPZDigest hashes the records of the response policy zones announced last, so that
+	// only generations which change them are notified, across restarts.
+	RPZDigest string `json:"rpz_digest,omitempty"`
+	// NamedOptions lists the options block statements set by the last generation, so
+	// that those no longer configured are removed from named.conf.options.
+	NamedOptions []string `json:"named_options,omitempty"`
+}
+
+var runtimeState = struct {
+	sync.Mutex
+	runtimeConfig
+}{runtimeConfig: runtimeConfig{Services: map[string]serviceOverride{}}}
+
+// serviceOverrideFor returns the runtime override for a service, if any.
+func serviceOverrideFor(service string) (serviceOverride, bool) {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	o, ok := runtimeState.Services[strings.ToLower(service)]
+
+	return o, ok
+}
+
+// setServiceOverride records a runtime override for a service.
+func setServiceOverride(service string, o serviceOverride) {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	runtimeState.Services[strings.ToLower(service)] = o
+}
+
+// clearServiceOverride removes any runtime override for a service.
+func clearServiceOverride(service string) {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	delete(runtimeState.Services, strings.ToLower(service))
+}
+
+// customDomainsFor returns the runtime custom domains attached to a service.
+func customDomainsFor(service string) []string {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	var domains []string
+
+	for _, d := range runtimeState.CustomDomains {
+		if strings.EqualFold(d.Service, service) {
+			domains = append(domains, d.Domain)
+		}
+	}
+
+	return domains
+}
+
+// addCustomDomain attaches a domain to a service, replacing any existing entry for it.
+func addCustomDomain(domain, service string) {
+	removeCustomDomain(domain)
+
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	runtimeState.CustomDomains = append(runtimeState.CustomDomains, customDomain{
+		Domain:  strings.ToLower(domain),
+		Service: strings.ToLower(service),
+	})
+
+	sort.Slice(runtimeState.CustomDomains, func(i, j int) bool {
+		return runtimeState.CustomDomains[i].Domain < runtimeState.CustomDomains[j].Domain
+	})
+}
+
+// removeCustomDomain detaches a domain, reporting whether it was present.
+func removeCustomDomain(domain string) bool {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	for i, d := range runtimeState.CustomDomains {
+		if strings.EqualFold(d.Domain, domain) {
+			runtimeState.CustomDomains = append(runtimeState.CustomDomains[:i], runtimeState.CustomDomains[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// knownServices returns the services seen by the last generation, or nil before the
+// first.
+func knownServices() []string {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	return append([]string(nil), runtimeState.KnownServices...)
+}
+
+// setKnownServices records the services seen by a generation.
+func setKnownServices(services []string) {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	runtimeState.KnownServices = services
+}
+
+// setRPZDigest records the digest of the response policy zones notified, reporting
+// whether it differs from the one recorded before.
+func setRPZDigest(digest string) bool {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	if runtimeState.RPZDigest == digest {
+		return false
+	}
+
+	runtimeState.RPZDigest = digest
+
+	return true
+}
+
+// lastEnabledServices returns the services enabled by the last successful generation
+// with their number of domains.
+func lastEnabledServices() map[string]int {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	return maps.Clone(runtimeState.EnabledServices)
+}
+
+// setLastEnabledServices records the services enabled by a successful generation,
+// reporting whether they differ from those recorded before.
+func setLastEnabledServices(services map[string]int) bool {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	if runtimeState.EnabledServices != nil && maps.Equal(runtimeState.EnabledServices, services) {
+		return false
+	}
+
+	runtimeState.EnabledServices = services
+
+	return true
+}
+
+// ownedNamedOptions returns the options block statements set by the last generation.
+func ownedNamedOptions() []string {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	return append([]string(nil), runtimeState.NamedOptions...)
+}
+
+// setOwnedNamedOptions records the options block statements set by a generation,
+// reporting whether they differ from those recorded before.
+func setOwnedNamedOptions(names []string) bool {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	if slices.Equal(runtimeState.NamedOptions, names) {
+		return false
+	}
+
+	runtimeState.NamedOptions = names
+
+	return true
+}
+
+// isPendingService reports whether a service awaits approval.
+func isPendingService(service string) bool {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	return slices.Contains(runtimeState.PendingServices, strings.ToLower(service))
+}
+
+// addPendingService holds a service back until it is approved.
+func addPendingService(service string) {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	runtimeState.PendingServices = append(runtimeState.PendingServices, strings.ToLower(service))
+	sort.Strings(runtimeState.PendingServices)
+}
+
+// clearPendingService releases a service held back for approval, reporting whether it
+// was.
+func clearPendingService(service string) bool {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	i := slices.Index(runtimeState.PendingServices, strings.ToLower(service))
+	if i < 0 {
+		return false
+	}
+
+	runtimeState.PendingServices = slices.Delete(runtimeState.PendingServices, i, i+1)
+
+	return true
+}
+
+// runtimeSnapshot returns a copy of the runtime configuration.
+func runtimeSnapshot() runtimeConfig {
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	c := runtimeConfig{
+		Services:        make(map[string]serviceOverride, len(runtimeState.Services)),
+		CustomDomains:   append([]customDomain(nil), runtimeState.CustomDomains...),
+		KnownServices:   append([]string(nil), runtimeState.KnownServices...),
+		PendingServices: append([]string(nil), runtimeState.PendingServices...),
+		RPZDigest:       runtimeState.RPZDigest,
+		NamedOptions:    append([]string(nil), runtimeState.NamedOptions...),
+	}
+
+	for k, v := range runtimeState.Services {
+		c.Services[k] = v
+	}
+
+	c.EnabledServices = maps.Clone(runtimeState.EnabledServices)
+
+	return c
+}
+
+// stateFile returns the path runtime changes are persisted to.
+func stateFile() string {
+	if os.Getenv("STATE_FILE") != "" {
+		return os.Getenv("STATE_FILE")
+	}
+
+	return defaultStateFile
+}
+
+// loadRuntimeState restores runtime changes saved by a previous run.
+func loadRuntimeState() error {
+	b, err := os.ReadFile(stateFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var c runtimeConfig
+	if err = json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+
+	if c.Services == nil {
+		c.Services = map[string]serviceOverride{}
+	}
+
+	runtimeState.Lock()
+	defer runtimeState.Unlock()
+
+	runtimeState.runtimeConfig = c
+
+	log.Info("Loaded runtime state", "file", stateFile())
+
+	return nil
+}
+
+// stateSaving serialises saves of the runtime state, so that concurrent saves neither
+// share the temporary file nor rename an older snapshot over a newer one.
+var stateSaving sync.Mutex
+
+// saveRuntimeState atomically writes the runtime changes to the state file.
+func saveRuntimeState() error {
+	stateSaving.Lock()
+	defer stateSaving.Unlock()
+
+	b, err := json.MarshalIndent(runtimeSnapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := stateFile()
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
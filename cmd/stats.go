@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const bindLogTimeFormat = "02-Jan-2006 15:04:05.000"
+
+var (
+	statsQueryLog string
+	statsRPZLog   string
+	statsSince    time.Duration
+	statsTop      int
+	statsJSON     bool
+
+	queryLogLine = regexp.MustCompile(`client (?:@\S+ )?([^#\s]+)#\d+.*?: (?:view \S+: )?query: (\S+) `)
+	rpzLogLine   = regexp.MustCompile(`client (?:@\S+ )?([^#\s]+)#\d+.*?rpz \S+ \S+ rewrite ([^/\s]+)/`)
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Report query statistics from BIND logs",
+	Long:  `Parse BIND query and RPZ logs and report the most queried cached domains, hits per service and per-client breakdowns`,
+	Run: func(cmd *cobra.Command, _ []string) {
+		report, err := queryStats(statsQueryLog, statsRPZLog, statsSince)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if statsJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+
+			if err = enc.Encode(report.top(statsTop)); err != nil {
+				log.Fatal(err)
+			}
+
+			return
+		}
+
+		report.top(statsTop).print()
+	},
+}
+
+func init() {
+	statsCmd.Flags().StringVar(&statsQueryLog, "query-log", "", "Path to the BIND query log")
+	statsCmd.Flags().StringVar(&statsRPZLog, "rpz-log", "", "Path to the BIND RPZ log")
+	statsCmd.Flags().DurationVar(&statsSince, "since", 0, "Only include entries newer than this (e.g. 1h), 0 for all")
+	statsCmd.Flags().IntVar(&statsTop, "top", 10, "Number of entries to show per table")
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "Output as JSON")
+}
+
+// statsReport aggregates cached lookups by domain, service and client.
+type statsReport struct {
+	Total    int            `json:"total"`
+	Domains  map[string]int `json:"domains"`
+	Services map[string]int `json:"services"`
+	Clients  map[string]int `json:"clients"`
+}
+
+// queryStats parses the given logs, attributing each cached lookup to its service.
+// The RPZ log is preferred when given as it only contains intercepted lookups.
+func queryStats(queryLog, rpzLog string, since time.Duration) (statsReport, error) {
+	report := statsReport{Domains: map[string]int{}, Services: map[string]int{}, Clients: map[string]int{}}
+
+	path, pattern := rpzLog, rpzLogLine
+	if path == "" {
+		path, pattern = queryLog, queryLogLine
+	}
+
+	if path == "" {
+		return report, fmt.Errorf("One of --query-log or --rpz-log is required")
+	}
+
+	services, err := loadServiceDomains()
+	if err != nil {
+		return report, err
+	}
+
+	idx := newDomainIndex(services)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+
+	defer func(f *os.File) {
+		if err = f.Close(); err != nil {
+			log.Fatalf("error while closing resource %s: %v", f.Name(), err)
+		}
+	}(f)
+
+	cutoff := time.Time{}
+	if since > 0 {
+		cutoff = time.Now().Add(-since)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if !cutoff.IsZero() && len(line) >= len(bindLogTimeFormat) {
+			if t, err := time.ParseInLocation(bindLogTimeFormat, line[:len(bindLogTimeFormat)], time.Local); err == nil && t.Before(cutoff) {
+				continue
+			}
+		}
+
+		m := pattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		service, _ := idx.lookup(m[2])
+		if service == "" {
+			continue
+		}
+
+		report.Total++
+		report.Domains[m[2]]++
+		report.Services[service]++
+		report.Clients[m[1]]++
+	}
+
+	return report, scanner.Err()
+}
+
+// top trims each breakdown to its n largest entries.
+func (r statsReport) top(n int) statsReport {
+	return statsReport{Total: r.Total, Domains: topN(r.Domains, n), Services: topN(r.Services, n), Clients: topN(r.Clients, n)}
+}
+
+func (r statsReport) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Cached lookups:\t%d\n", r.Total)
+
+	for _, section := range []struct {
+		title  string
+		counts map[string]int
+	}{{"SERVICE", r.Services}, {"DOMAIN", r.Domains}, {"CLIENT", r.Clients}} {
+		fmt.Fprintf(w, "\n%s\tHITS\n", section.title)
+
+		for _, k := range sortedByCount(section.counts) {
+			fmt.Fprintf(w, "%s\t%d\n", k, section.counts[k])
+		}
+	}
+
+	_ = w.Flush()
+}
+
+func topN(counts map[string]int, n int) map[string]int {
+	keys := sortedByCount(counts)
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+
+	out := make(map[string]int, len(keys))
+	for _, k := range keys {
+		out[k] = counts[k]
+	}
+
+	return out
+}
+
+func sortedByCount(counts map[string]int) []string {
+	keys := sortedKeys(counts)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return counts[keys[i]] > counts[keys[j]]
+	})
+
+	return keys
+}
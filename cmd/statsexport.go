@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// startStatsExport periodically pushes per-service query statistics parsed from
+// STATS_LOG to InfluxDB (STATS_INFLUXDB_URL) and/or Graphite (STATS_GRAPHITE_ADDR).
+func startStatsExport() {
+	influxURL := os.Getenv("STATS_INFLUXDB_URL")
+	graphiteAddr := os.Getenv("STATS_GRAPHITE_ADDR")
+
+	if influxURL == "" && graphiteAddr == "" {
+		return
+	}
+
+	rpzLog := os.Getenv("STATS_LOG")
+	if rpzLog == "" {
+		log.Warn("STATS_LOG must be set to export query statistics")
+		return
+	}
+
+	interval := time.Minute
+	if d, err := time.ParseDuration(os.Getenv("STATS_PUSH_INTERVAL")); err == nil && d > 0 {
+		interval = d
+	}
+
+	log.Info("Exporting query statistics", "interval", interval)
+
+	go func() {
+		for range time.Tick(interval) {
+			report, err := queryStats("", rpzLog, interval)
+			if err != nil {
+				log.Error("Failed to collect query statistics", "file", rpzLog, "error", err)
+				continue
+			}
+
+			now := time.Now()
+
+			if influxURL != "" {
+				if err = pushInfluxDB(influxURL, report, now); err != nil {
+					log.Error("Failed to push statistics to InfluxDB", "error", err)
+				}
+			}
+
+			if graphiteAddr != "" {
+				if err = pushGraphite(graphiteAddr, report, now); err != nil {
+					log.Error("Failed to push statistics to Graphite", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// pushInfluxDB writes the report using the InfluxDB line protocol.
+func pushInfluxDB(url string, report statsReport, now time.Time) error {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "lancache_dns_hits total=%di %d\n", report.Total, now.UnixNano())
+
+	for _, service := range sortedKeys(report.Services) {
+		fmt.Fprintf(&b, "lancache_dns_service_hits,service=%s hits=%di %d\n", service, report.Services[service], now.UnixNano())
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, &b)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if token := os.Getenv("STATS_INFLUXDB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+
+	resp, err := fetchClient().Do(req)
+	if err != nil {
+		return err
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("InfluxDB returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// pushGraphite writes the report using the Graphite plaintext protocol.
+func pushGraphite(addr string, report statsReport, now time.Time) error {
+	prefix := "lancache.dns"
+	if os.Getenv("STATS_GRAPHITE_PREFIX") != "" {
+		prefix = strings.TrimSuffix(os.Getenv("STATS_GRAPHITE_PREFIX"), ".")
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "%s.hits %d %d\n", prefix, report.Total, now.Unix())
+
+	for _, service := range sortedKeys(report.Services) {
+		fmt.Fprintf(&b, "%s.service.%s.hits %d %d\n", prefix, service, report.Services[service], now.Unix())
+	}
+
+	_, err = conn.Write(b.Bytes())
+
+	return err
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+)
+
+// serviceStatus describes a service as processed by the most recent generation.
+type serviceStatus struct {
+	Name    string   `json:"name"`
+	Enabled bool     `json:"enabled"`
+	IPs     []string `json:"ips,omitempty"`
+	Domains int      `json:"domains"`
+	Policy  string   `json:"policy,omitempty"`
+
+	Weights map[string]int `json:"weights,omitempty"`
+}
+
+// generationStatus describes the most recent generation.
+type generationStatus struct {
+	Time     time.Time       `json:"time"`
+	Duration time.Duration   `json:"duration"`
+	Revision string          `json:"revision"`
+	Error    string          `json:"error,omitempty"`
+	Services []serviceStatus `json:"services"`
+}
+
+var lastGeneration = struct {
+	sync.Mutex
+	current generationStatus
+	pending []serviceStatus
+}{}
+
+// recordService notes the outcome for a service during the generation in progress.
+func recordService(s serviceStatus) {
+	lastGeneration.Lock()
+	defer lastGeneration.Unlock()
+
+	lastGeneration.pending = append(lastGeneration.pending, s)
+}
+
+// pendingServices returns the services recorded so far by the generation in progress.
+func pendingServices() []serviceStatus {
+	lastGeneration.Lock()
+	defer lastGeneration.Unlock()
+
+	return append([]serviceStatus(nil), lastGeneration.pending...)
+}
+
+// recordGeneration completes the generation in progress.
+func recordGeneration(started time.Time, err error) {
+	status := generationStatus{
+		Time:     started,
+		Duration: time.Since(started),
+		Revision: cacheDomainsRevision(),
+	}
+
+	if err != nil {
+		status.Error = err.Error()
+		metrics.generationFailures.Add(1)
+	} else {
+		metrics.generationSuccesses.Add(1)
+		metrics.lastSuccess.Store(time.Now().Unix())
+	}
+
+	lastGeneration.Lock()
+	defer lastGeneration.Unlock()
+
+	// A failed generation stops part way through, so the services of the last
+	// complete one are kept rather than those it had planned.
+	status.Services = lastGeneration.pending
+	if err != nil {
+		status.Services = lastGeneration.current.Services
+	}
+
+	lastGeneration.pending = nil
+	lastGeneration.current = status
+}
+
+// currentStatus returns the most recent generation status.
+func currentStatus() generationStatus {
+	lastGeneration.Lock()
+	defer lastGeneration.Unlock()
+
+	return lastGeneration.current
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	supervisorMinBackoff = time.Second
+	supervisorMaxBackoff = time.Minute
+	supervisorStableRun  = time.Minute
+)
+
+// superviseNamed starts named in the foreground and restarts it with exponential backoff
+// whenever it exits. SIGTERM and SIGINT are forwarded to named, after which dnstool exits.
+func superviseNamed() {
+	command := "named -u " + layout.User + " -g -c " + layout.MainConf
+	if os.Getenv("NAMED_COMMAND") != "" {
+		command = os.Getenv("NAMED_COMMAND")
+	}
+
+	args := strings.Fields(command)
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
+	backoff := supervisorMinBackoff
+
+	for {
+		log.Info("Starting named", "phase", "supervise", "command", command)
+
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		started := time.Now()
+
+		if err := cmd.Start(); err != nil {
+			log.Error("Failed to start named", "phase", "supervise", "error", err)
+		} else {
+			done := make(chan error, 1)
+			go func() {
+				done <- cmd.Wait()
+			}()
+
+			select {
+			case err := <-done:
+				log.Warn("named exited", "phase", "supervise", "error", err)
+			case sig := <-term:
+				log.Info("Stopping named", "phase", "supervise", "signal", sig.String())
+				_ = cmd.Process.Signal(sig)
+				<-done
+				deregisterConsulService()
+				os.Exit(0)
+			}
+		}
+
+		if time.Since(started) > supervisorStableRun {
+			backoff = supervisorMinBackoff
+		}
+
+		log.Info("Restarting named", "phase", "supervise", "backoff", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case sig := <-term:
+			log.Info("Exiting", "phase", "supervise", "signal", sig.String())
+			deregisterConsulService()
+			os.Exit(0)
+		}
+
+		backoff *= 2
+		if backoff > supervisorMaxBackoff {
+			backoff = supervisorMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"os"
+
+	"dnstool/pkg/dnsgen"
+)
+
+// httpsRecord returns the HTTPS record data advertised for intercepted domains. By
+// default none is published, so HTTPS (type 65) queries answer NODATA and clients
+// cannot learn alternate endpoints or ECH keys that would bypass the cache. With
+// HTTPS_RECORDS=svcb a record is published whose address hints point at the cache.
+func httpsRecord(ips []string) string {
+	if os.Getenv("HTTPS_RECORDS") != "svcb" {
+		return ""
+	}
+
+	return dnsgen.HTTPSRecord(ips)
+}
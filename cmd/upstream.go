@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"dnstool/pkg/dnsgen"
+)
+
+// upstream is a resolver that queries are forwarded to, optionally on a non-standard
+// port and optionally over DNS-over-TLS.
+type upstream struct {
+	IP   string
+	Port string
+	// TLS is set for DNS-over-TLS upstreams, holding the hostname the server
+	// certificate is verified against, or "-" when it is not verified.
+	TLS string
+	// Proxy is set for the embedded DNS-over-HTTPS proxy, which is served by dnstool
+	// itself and may not be running yet during generation.
+	Proxy bool
+}
+
+// configuredUpstreams returns the upstreams of UPSTREAM_DNS, which may be auto for the
+// nameservers the host was configured with, followed by the embedded DNS-over-HTTPS
+// proxy when UPSTREAM_DOH is set.
+func configuredUpstreams() ([]upstream, error) {
+	upstreamDNS := "8.8.8.8"
+	if os.Getenv("UPSTREAM_DNS") != "8.8.8.8" {
+		upstreamDNS = os.Getenv("UPSTREAM_DNS")
+	}
+
+	if upstreamDNS == "auto" {
+		servers, err := originalNameservers()
+		if err != nil {
+			return nil, err
+		}
+
+		log.Info("Using original nameservers as upstream", "upstream", strings.Join(servers, " "))
+		upstreamDNS = strings.Join(servers, " ")
+	}
+
+	dns, err := parseUpstreams(upstreamDNS)
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("UPSTREAM_DOH") != "" {
+		u, err := dohUpstream()
+		if err != nil {
+			return nil, err
+		}
+
+		dns = append(dns, u)
+	}
+
+	return dns, nil
+}
+
+// parseUpstreams parses UPSTREAM_DNS, accepting 192.168.1.5, 192.168.1.5#5353,
+// 192.168.1.5:5353 and [fd00::1]:5353 style entries separated by spaces or semicolons.
+// DNS-over-TLS upstreams are written as tls://1.1.1.1@cloudflare-dns.com.
+func parseUpstreams(servers string) ([]upstream, error) {
+	upstreams := make([]upstream, 0)
+
+	for _, s := range cleanIP(servers) {
+		tls := ""
+
+		if rest, ok := strings.CutPrefix(s, "tls://"); ok {
+			tls = "-"
+			if addr, host, ok := strings.Cut(rest, "@"); ok {
+				rest, tls = addr, host
+			}
+
+			s = rest
+		}
+
+		u := upstream{IP: s}
+
+		if host, port, ok := strings.Cut(s, "#"); ok {
+			u = upstream{IP: host, Port: port}
+		} else if host, port, err := net.SplitHostPort(s); err == nil {
+			u = upstream{IP: host, Port: port}
+		}
+
+		if err := isIP([]string{u.IP}); err != nil {
+			return nil, err
+		}
+
+		if u.Port != "" {
+			if p, err := net.LookupPort("udp", u.Port); err != nil || p <= 0 {
+				return nil, fmt.Errorf("Port for upstream DNS: %s is not valid", s)
+			}
+		}
+
+		u.TLS = tls
+
+		if u.TLS != "" && u.Port == "" {
+			u.Port = "853"
+		} else if u.TLS == "" && u.Port == "53" {
+			u.Port = ""
+		}
+
+		upstreams = append(upstreams, u)
+	}
+
+	return upstreams, nil
+}
+
+// forwarder returns the upstream as an entry of a named.conf forwarders list.
+func (u upstream) forwarder() string {
+	f := u.IP
+	if u.Port != "" {
+		f += " port " + u.Port
+	}
+
+	if u.TLS != "" {
+		f += " tls " + u.tlsName()
+	}
+
+	return f
+}
+
+// tlsName returns the name of the named.conf tls block used by a DNS-over-TLS upstream.
+func (u upstream) tlsName() string {
+	name := u.TLS
+	if name == "-" {
+		name = u.IP
+	}
+
+	return "dot-" + strings.NewReplacer(".", "-", ":", "-").Replace(name)
+}
+
+// tlsConfiguration returns the named.conf tls blocks required by DNS-over-TLS upstreams.
+func tlsConfiguration(upstreams []upstream) string {
+	var b strings.Builder
+
+	seen := map[string]bool{}
+
+	for _, u := range upstreams {
+		if u.TLS == "" || seen[u.tlsName()] {
+			continue
+		}
+
+		seen[u.tlsName()] = true
+
+		fmt.Fprintf(&b, "\ttls %s {\n", u.tlsName())
+
+		if u.TLS != "-" {
+			fmt.Fprintf(&b, "\t\tremote-hostname \"%s\";\n", u.TLS)
+		}
+
+		if ca := os.Getenv("UPSTREAM_TLS_CA_FILE"); ca != "" {
+			fmt.Fprintf(&b, "\t\tca-file \"%s\";\n", ca)
+		}
+
+		b.WriteString("\t};\n")
+	}
+
+	return b.String()
+}
+
+// forwarderList joins upstreams for substitution into a named.conf forwarders list.
+func forwarderList(upstreams []upstream) string {
+	f := make([]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		f = append(f, u.forwarder())
+	}
+
+	return strings.Join(f, "; ")
+}
+
+// originalNameservers returns the nameservers the container started with. The original
+// resolv.conf is preserved alongside it the first time it is about to be replaced, so
+// that later runs still see the DHCP or runtime provided resolvers.
+func originalNameservers() ([]string, error) {
+	resolvConf := resolvConfPath()
+
+	current, err := os.ReadFile(resolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	original := current
+	if bytes.HasPrefix(current, []byte(resolvConfHeader)) {
+		if original, err = os.ReadFile(resolvConf + resolvConfOriginal); err != nil {
+			return nil, fmt.Errorf("UPSTREAM_DNS=auto: %s has already been replaced and no copy of the original exists", resolvConf)
+		}
+	} else if err = os.WriteFile(resolvConf+resolvConfOriginal, current, 0644); err != nil {
+		return nil, err
+	}
+
+	servers := make([]string, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(original))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		// Skip ourselves and other local resolvers; forwarding to them could loop.
+		if ip := net.ParseIP(fields[1]); ip == nil || ip.IsLoopback() && !isDockerResolver(ip) {
+			continue
+		}
+
+		servers = append(servers, fields[1])
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("UPSTREAM_DNS=auto: no usable nameservers found in the original %s", resolvConf)
+	}
+
+	return servers, scanner.Err()
+}
+
+// isDockerResolver reports whether ip is 127.0.0.11, the embedded DNS server of Docker's
+// user-defined networks. It is reached through a loopback address but is answered by the
+// Docker daemon, so forwarding to it does not loop back to this resolver.
+func isDockerResolver(ip net.IP) bool {
+	return ip.Equal(net.IPv4(127, 0, 0, 11))
+}
+
+// checkUpstreamLoops refuses upstreams that would forward queries back to this
+// resolver: loopback addresses other than the Docker resolver, the cache IPs, or any
+// address of this host, unless they are on a port other than 53 where another resolver
+// may be listening.
+func checkUpstreamLoops(dns []upstream) error {
+	own := map[string]string{}
+
+	cacheIPs, _, _ := dnsgen.WeightedAddresses(os.Getenv("LANCACHE_IP"))
+	for _, ip := range cacheIPs {
+		own[ip] = "LANCACHE_IP"
+	}
+
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				own[n.IP.String()] = "an address of this host"
+			}
+		}
+	}
+
+	for _, u := range dns {
+		if u.Proxy || (u.Port != "" && u.Port != "53") {
+			continue
+		}
+
+		ip := net.ParseIP(u.IP)
+		if ip == nil {
+			continue
+		}
+
+		if ip.IsLoopback() && !isDockerResolver(ip) || ip.IsUnspecified() {
+			return fmt.Errorf("Upstream DNS: %s is a loopback address and would forward queries back to this resolver", u.IP)
+		}
+
+		if reason, ok := own[ip.String()]; ok {
+			return fmt.Errorf("Upstream DNS: %s is %s and would forward queries back to this resolver", u.IP, reason)
+		}
+	}
+
+	return nil
+}
@@ -12,6 +12,29 @@ func cleanIP(servers string) []string {
 	return strings.Fields(s)
 }
 
+// uniqueIPs drops repeated addresses, keeping the first spelling of each, so that a cache
+// listed twice yields a single record.
+func uniqueIPs(ips []string) []string {
+	seen := make(map[string]bool, len(ips))
+	unique := make([]string, 0, len(ips))
+
+	for _, ip := range ips {
+		key := ip
+		if parsed := net.ParseIP(ip); parsed != nil {
+			key = parsed.String()
+		}
+
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		unique = append(unique, ip)
+	}
+
+	return unique
+}
+
 // isIP checks if IP(s) specified are valid IP addresses.
 func isIP(ip []string) error {
 	for _, s := range ip {
@@ -39,18 +62,11 @@ func isPrivateIP(ip []string) error {
 	return nil
 }
 
-// reverseIPv4 reverses IP segments/octets for building PTR like addresses.
-func reverseIPv4(address string) string {
-	s := strings.Split(address, ".")
-	for i := 0; i < len(s)/2; i++ {
-		j := len(s) - i - 1
-		s[i], s[j] = s[j], s[i]
-	}
-
-	ip := net.ParseIP(strings.Join(s, ".")).To4()
-	if ip == nil {
-		return ""
+// addressRRType returns the address record type, A or AAAA, for ip.
+func addressRRType(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "AAAA"
 	}
 
-	return ip.String()
+	return "A"
 }
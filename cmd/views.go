@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"dnstool/pkg/dnsgen"
+)
+
+// dnsView is a class of clients served by its own BIND view. CacheIPs overrides where
+// the view's clients are steered, and Intercept is false for views that resolve
+// everything normally.
+type dnsView struct {
+	Name      string
+	Clients   []string
+	CacheIPs  []string
+	Intercept bool
+}
+
+// clientViews returns the canary view for CANARY_CLIENTS, then the views from VIEWS and
+// the sites from SITE_MAP, in the order BIND matches them. VIEWS is a semicolon separated list of name=subnet[,subnet...]
+// entries, with VIEW_<NAME>_INTERCEPT=false disabling interception for a view and
+// VIEW_<NAME>_CACHE_IP steering it to its own caches.
+func clientViews() ([]dnsView, error) {
+	views := make([]dnsView, 0)
+
+	if canary := cleanIP(os.Getenv("CANARY_CLIENTS")); len(canary) > 0 {
+		if err := isIP(canary); err != nil {
+			return nil, err
+		}
+
+		views = append(views, dnsView{Name: "canary", Clients: canary, Intercept: true})
+	}
+
+	for _, entry := range cleanIP(os.Getenv("VIEWS")) {
+		name, subnets, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("VIEWS entry: %s must be name=subnet", entry)
+		}
+
+		name = strings.ToLower(name)
+		if name == "default" || name == "canary" || strings.HasPrefix(name, "site") || strings.HasPrefix(name, "ecs-") {
+			return nil, fmt.Errorf("VIEWS name: %s is reserved", name)
+		}
+
+		v := dnsView{Name: name, Clients: strings.Split(subnets, ","), Intercept: true}
+
+		for _, c := range v.Clients {
+			if _, _, err := net.ParseCIDR(c); err != nil && net.ParseIP(c) == nil {
+				return nil, fmt.Errorf("VIEWS subnet: %s is not a valid network", c)
+			}
+		}
+
+		key := "VIEW_" + strings.ToUpper(name) + "_"
+
+		switch strings.ToLower(os.Getenv(key + "INTERCEPT")) {
+		case "", "true":
+		case "false":
+			v.Intercept = false
+		default:
+			return nil, fmt.Errorf("%sINTERCEPT must be true or false", key)
+		}
+
+		if ips := os.Getenv(key + "CACHE_IP"); ips != "" {
+			v.CacheIPs = uniqueIPs(cleanIP(strings.ReplaceAll(ips, ",", " ")))
+			if err := isPrivateIP(v.CacheIPs); err != nil {
+				return nil, err
+			}
+		}
+
+		views = append(views, v)
+	}
+
+	sites, err := siteViews()
+	if err != nil {
+		return nil, err
+	}
+
+	views = append(views, sites...)
+
+	// During a canary rollout everyone else resolves normally, sites included.
+	if len(views) > 0 && views[0].Name == "canary" {
+		for i := range views[1:] {
+			views[i+1].Intercept = false
+		}
+	}
+
+	if os.Getenv("RPZ_FLATTEN") == "true" {
+		for _, v := range views {
+			if len(v.CacheIPs) > 0 {
+				return nil, fmt.Errorf("View %s cannot have its own caches with RPZ_FLATTEN as the RPZ is shared by every view", v.Name)
+			}
+		}
+	}
+
+	return views, nil
+}
+
+// siteViews parses SITE_MAP, a semicolon separated list of subnet=ip[,ip...] entries
+// steering clients in each subnet to the cache IPs of their site.
+func siteViews() ([]dnsView, error) {
+	entries := cleanIP(os.Getenv("SITE_MAP"))
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	views := make([]dnsView, 0, len(entries))
+
+	for i, entry := range entries {
+		subnet, ips, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("SITE_MAP entry: %s must be subnet=ip", entry)
+		}
+
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return nil, fmt.Errorf("SITE_MAP subnet: %s is not a valid network", subnet)
+		}
+
+		v := dnsView{Name: "site" + strconv.Itoa(i+1), Clients: []string{subnet}, CacheIPs: strings.Split(ips, ","), Intercept: true}
+		if err := isPrivateIP(v.CacheIPs); err != nil {
+			return nil, err
+		}
+
+		views = append(views, v)
+	}
+
+	return views, nil
+}
+
+// viewZoneFile returns the path of the cache zone served to a view.
+func viewZoneFile(cacheZone string, v dnsView) string {
+	return strings.TrimSuffix(cacheZone, ".db") + "." + v.Name + ".db"
+}
+
+// generateSiteZones writes a copy of the cache zone for each view with its own caches,
+// with every enabled service pointed at the view's cache IPs.
+func generateSiteZones(lancacheDNSDomain, cacheZone string) error {
+	views, err := clientViews()
+	if err != nil {
+		return err
+	}
+
+	sites := make([]dnsView, 0, len(views))
+	for _, v := range views {
+		if v.Intercept && len(v.CacheIPs) > 0 {
+			sites = append(sites, v)
+		}
+	}
+
+	if len(sites) == 0 {
+		return nil
+	}
+
+	b, err := readZoneFile(cacheZone)
+	if err != nil {
+		return err
+	}
+
+	enabled := map[string]bool{}
+	for _, s := range pendingServices() {
+		if s.Enabled {
+			enabled[s.Name] = true
+		}
+	}
+
+	// Drop the address and HTTPS records of enabled services, keeping everything else.
+	kept := make([]string, 0)
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && enabled[fields[0]] && fields[1] == "IN" {
+			continue
+		}
+
+		kept = append(kept, line)
+	}
+
+	for _, site := range sites {
+		ips, err := cacheAddresses(site.CacheIPs)
+		if err != nil {
+			return err
+		}
+
+		if ips = healthyAddresses(ips); len(ips) == 0 {
+			log.Warn("Every cache for the site is down, falling back to the default caches", "phase", "generate", "site", site.Name)
+
+			if _, err = createZoneFile(viewZoneFile(cacheZone, site)).Write(b); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		records := append([]string(nil), kept...)
+
+		for _, s := range pendingServices() {
+			if !s.Enabled {
+				continue
+			}
+
+			for _, ip := range ips {
+				records = append(records, s.Name+` IN `+addressRRType(ip)+` `+ip+`;`)
+			}
+
+			if rr := httpsRecord(ips); rr != "" {
+				records = append(records, s.Name+` IN `+rr+`;`)
+			}
+		}
+
+		log.Info("Steering site to its caches", "phase", "generate", "site", site.Name, "clients", strings.Join(site.Clients, ","), "ip", strings.Join(ips, ","))
+
+		if _, err = fmt.Fprintln(createZoneFile(viewZoneFile(cacheZone, site)), strings.Join(records, "\n")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// generateSitePassthru exempts the cache IPs of every view from the RPZ so that the
+// caches themselves resolve the real origin addresses.
+func generateSitePassthru() error {
+	sites, err := clientViews()
+	if err != nil || len(sites) == 0 {
+		return err
+	}
+
+	f := appendZoneFile(rpzZone)
+
+	if _, err = fmt.Fprintln(f, `;## Site caches`); err != nil {
+		return err
+	}
+
+	for _, site := range sites {
+		for _, ip := range site.CacheIPs {
+			if trigger := dnsgen.ClientIPTrigger(ip); trigger != "" {
+				if _, err = fmt.Fprintln(f, trigger+`.rpz-client-ip      CNAME rpz-passthru.;`); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// viewsConfiguration wraps the generated zones in a default view and adds a view for
+// each class of clients. Intercepting views serve their own copy of the cache zone, or
+// the default one, alongside the same response policy zone files as the default view.
+// Once views are in use BIND requires every zone to be in one, so any zones named.conf
+// defines outside cache.conf must be moved into a view. With ECS_PROXY_LISTEN set, the
+// ecs-intercept and ecs-passthru views answer the ECS proxy for its clients.
+func viewsConfiguration(views []dnsView, lancacheDNSDomain, cacheZone, zones, forward, policy string) string {
+	var b strings.Builder
+
+	if os.Getenv("ECS_PROXY_LISTEN") != "" {
+		views = append([]dnsView{
+			{Name: "ecs-intercept", Clients: []string{ecsInterceptSource}, Intercept: true},
+			{Name: "ecs-passthru", Clients: []string{ecsPassthruSource}},
+		}, views...)
+	}
+
+	for _, v := range views {
+		fmt.Fprintf(&b, "\tview \"%s\" {\n\t\tmatch-clients { %s; };\n", v.Name, strings.Join(v.Clients, "; "))
+
+		if v.Intercept {
+			file := cacheZone
+			if len(v.CacheIPs) > 0 {
+				file = viewZoneFile(cacheZone, v)
+			}
+
+			fmt.Fprintf(&b, "\t\tresponse-policy %s;\n", policy)
+			fmt.Fprintf(&b, "\t\tzone \"%s\" {\n\t\t\ttype master;\n\t\t\tfile \"%s\";\n\t\t};\n", lancacheDNSDomain, file)
+
+			for _, zone := range rpzZones(pendingServices()) {
+				b.WriteString(indentConf(fmt.Sprintf(fmtUnqueriedZoneConf, zone, zonePath+zone+".db", "")))
+			}
+		}
+
+		b.WriteString(indentConf(forward))
+		b.WriteString("\t};\n")
+	}
+
+	b.WriteString("\tview \"default\" {\n\t\tmatch-clients { any; };\n")
+
+	// During a canary rollout only the canary clients are intercepted.
+	if len(cleanIP(os.Getenv("CANARY_CLIENTS"))) == 0 {
+		fmt.Fprintf(&b, "\t\tresponse-policy %s;\n", policy)
+	}
+
+	b.WriteString(indentConf(zones + forward))
+	b.WriteString("\t};\n")
+
+	return b.String()
+}
+
+// indentConf indents each non-empty line of a configuration fragment by one tab.
+func indentConf(conf string) string {
+	lines := strings.Split(conf, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = "\t" + line
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long to wait for a burst of filesystem events to settle before
+// triggering a regeneration.
+const watchDebounce = 2 * time.Second
+
+// watchConfiguration watches the custom zone, the cache_domains directory and any
+// additional paths listed in WATCH_PATHS, requesting a regeneration when they change.
+func watchConfiguration() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch parent directories and filter by name, as editors and git commonly replace
+	// files rather than writing them in place.
+	files := map[string]bool{customZone: true}
+	dirs := map[string]bool{filepath.Dir(customZone): true, domainsPath: true}
+
+	for _, p := range strings.Fields(strings.ReplaceAll(os.Getenv("WATCH_PATHS"), ";", " ")) {
+		p = filepath.Clean(p)
+
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			dirs[p] = true
+			continue
+		}
+
+		files[p] = true
+		dirs[filepath.Dir(p)] = true
+	}
+
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return err
+		}
+
+		log.Info("Watching for changes", "phase", "watch", "file", dir)
+	}
+
+	go func() {
+		var timer *time.Timer
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if !watchRelevant(event.Name, files, dirs) {
+					continue
+				}
+
+				if timer != nil {
+					timer.Stop()
+				}
+
+				name := event.Name
+				timer = time.AfterFunc(watchDebounce, func() {
+					requestRegeneration("changed: " + name)
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				log.Error("Filesystem watch error", "phase", "watch", "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// watchRelevant reports whether an event on name should trigger a regeneration. Files
+// inside watched directories count unless they belong to git or were generated by us.
+func watchRelevant(name string, files, dirs map[string]bool) bool {
+	name = filepath.Clean(name)
+	if files[name] {
+		return true
+	}
+
+	if strings.Contains(name, string(filepath.Separator)+".git") {
+		return false
+	}
+
+	dir := filepath.Dir(name)
+	if dir == filepath.Clean(zonePath) {
+		return false
+	}
+
+	return dirs[dir]
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxWebhookBody bounds the size of accepted webhook payloads.
+const maxWebhookBody = 1 << 20
+
+func init() {
+	httpMux.HandleFunc("/webhook", handleWebhook)
+}
+
+// handleWebhook accepts GitHub and GitLab push webhooks, validating them against
+// WEBHOOK_SECRET, and triggers a fetch and regeneration of the configuration.
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		http.Error(w, "webhooks are not enabled", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if !validWebhook(r, body, secret) {
+		log.Warn("Rejected webhook with invalid signature", "remote", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		event = r.Header.Get("X-Gitlab-Event")
+	}
+
+	if event != "push" && event != "Push Hook" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	log.Info("Received webhook", "event", event, "remote", r.RemoteAddr)
+	requestRefresh("webhook")
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validWebhook checks a GitHub X-Hub-Signature-256 HMAC or a GitLab X-Gitlab-Token.
+func validWebhook(r *http.Request, body []byte, secret string) bool {
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+		return hmac.Equal([]byte(strings.ToLower(sig)), []byte(expected))
+	}
+
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+
+	return false
+}
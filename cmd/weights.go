@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+	"os"
+	"strings"
+)
+
+// rfc1918 are the client networks split between weighted caches when LAN_SUBNETS is unset.
+var rfc1918 = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// weightedSortlist returns a sortlist statement sharing clients between the caches of
+// each weighted service. DNS can't hold duplicate records, so instead the client
+// networks are split into blocks and each block is given a preferred cache, with the
+// number of blocks preferring a cache proportional to its weight. LAN_SUBNETS should
+// list the client ranges as tightly as possible for an even split.
+func weightedSortlist(services []serviceStatus) string {
+	type weightedSet struct {
+		ips     []string
+		weights []int
+		total   int
+	}
+
+	sets := make([]weightedSet, 0)
+	seen := map[string]bool{}
+
+	for _, s := range services {
+		if !s.Enabled || len(s.Weights) == 0 || len(s.IPs) < 2 || seen[strings.Join(s.IPs, ",")] {
+			continue
+		}
+
+		seen[strings.Join(s.IPs, ",")] = true
+
+		set := weightedSet{ips: s.IPs}
+		for _, ip := range s.IPs {
+			w := s.Weights[ip]
+			if w == 0 {
+				w = 1
+			}
+
+			set.weights = append(set.weights, w)
+			set.total += w
+		}
+
+		sets = append(sets, set)
+	}
+
+	if len(sets) == 0 {
+		return ""
+	}
+
+	// Use a few more blocks than the total weight so that the split is close to it.
+	k := 0
+	for _, set := range sets {
+		k = max(k, bits.Len(uint(set.total-1))+2)
+	}
+
+	k = min(k, 8)
+	blocks := 1 << k
+
+	// Assign blocks to the caches of each set in proportion to their weights, using a
+	// smooth weighted round robin so that a partly used client range still gets a mix.
+	preferred := make([][]string, blocks)
+
+	for _, set := range sets {
+		current := make([]int, len(set.ips))
+
+		for block := range preferred {
+			best := 0
+
+			for i, w := range set.weights {
+				current[i] += w
+				if current[i] > current[best] {
+					best = i
+				}
+			}
+
+			current[best] -= set.total
+
+			ordered := append([]string{set.ips[best]}, append(append([]string(nil), set.ips[:best]...), set.ips[best+1:]...)...)
+			preferred[block] = append(preferred[block], ordered...)
+		}
+	}
+
+	networks := cleanIP(os.Getenv("LAN_SUBNETS"))
+	if len(networks) == 0 {
+		networks = rfc1918
+	}
+
+	var b strings.Builder
+
+	b.WriteString("{")
+
+	for _, network := range networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil || ipnet.IP.To4() == nil {
+			continue
+		}
+
+		ones, _ := ipnet.Mask.Size()
+		split := min(k, 32-ones)
+
+		for i := 0; i < 1<<split; i++ {
+			base := uint32(ipnet.IP[0])<<24 | uint32(ipnet.IP[1])<<16 | uint32(ipnet.IP[2])<<8 | uint32(ipnet.IP[3])
+			base += uint32(i) << (32 - ones - split)
+
+			ip := net.IPv4(byte(base>>24), byte(base>>16), byte(base>>8), byte(base))
+			fmt.Fprintf(&b, " { %s/%d; { %s; }; };", ip, ones+split, strings.Join(preferred[i<<(k-split)], "; "))
+		}
+	}
+
+	b.WriteString(" }")
+
+	return b.String()
+}
@@ -0,0 +1,340 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"dnstool/pkg/dnsgen"
+)
+
+// zoneManifest lists, within the zone directory, the zone files written by the last
+// generation.
+const zoneManifest = ".dnstool-zones"
+
+// zoneWriterLimit is the size beyond which a zone file being generated is moved from
+// memory to a temporary file alongside it, bounding memory use with very large domain
+// sets.
+const zoneWriterLimit = 4 << 20
+
+// zoneWriter owns a zone file being generated. The content is held in memory, or in a
+// temporary file once it grows large, until the writer is either committed, replacing
+// the zone file in one step, or discarded; no descriptor outlives the generation. created
+// is set when the file was started afresh rather than appended to.
+type zoneWriter struct {
+	path    string
+	created bool
+	buf     bytes.Buffer
+	spill   *os.File
+	w       *bufio.Writer
+}
+
+func (b *zoneWriter) Write(p []byte) (int, error) {
+	if b.spill == nil && b.buf.Len()+len(p) > zoneWriterLimit {
+		if err := b.spillToDisk(); err != nil {
+			return 0, err
+		}
+	}
+
+	if b.spill != nil {
+		return b.w.Write(p)
+	}
+
+	return b.buf.Write(p)
+}
+
+// Grow reserves room for n more bytes, up to zoneWriterLimit.
+func (b *zoneWriter) Grow(n int) {
+	if b.spill == nil {
+		b.buf.Grow(min(n, zoneWriterLimit-b.buf.Len()))
+	}
+}
+
+// spillToDisk moves the content to a temporary file in the directory of the zone, so
+// that it can later be renamed into place.
+func (b *zoneWriter) spillToDisk() error {
+	f, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	b.spill, b.w = f, bufio.NewWriterSize(f, 64<<10)
+
+	if _, err = b.w.Write(b.buf.Bytes()); err != nil {
+		return err
+	}
+
+	b.buf = bytes.Buffer{}
+
+	return nil
+}
+
+// reader returns the content from the start.
+func (b *zoneWriter) reader() (io.Reader, error) {
+	if b.spill == nil {
+		return bytes.NewReader(b.buf.Bytes()), nil
+	}
+
+	if err := b.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	if _, err := b.spill.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return b.spill, nil
+}
+
+// writeTo copies the content to w.
+func (b *zoneWriter) writeTo(w io.Writer) error {
+	r, err := b.reader()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+
+	return err
+}
+
+// commit replaces the zone file with the content atomically.
+func (b *zoneWriter) commit() error {
+	if b.spill == nil {
+		tmp := b.path + ".tmp"
+		if err := os.WriteFile(tmp, b.buf.Bytes(), 0644); err != nil {
+			return err
+		}
+
+		return os.Rename(tmp, b.path)
+	}
+
+	if err := b.w.Flush(); err != nil {
+		return err
+	}
+
+	if err := b.spill.Chmod(0644); err != nil {
+		return err
+	}
+
+	if err := b.spill.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(b.spill.Name(), b.path)
+}
+
+// discard releases the content, removing any temporary file.
+func (b *zoneWriter) discard() {
+	if b.spill != nil {
+		_ = b.spill.Close()
+		_ = os.Remove(b.spill.Name())
+		b.spill = nil
+	}
+}
+
+// zoneSet holds the zone files being generated until they are written out.
+type zoneSet struct {
+	sync.Mutex
+	pending map[string]*zoneWriter
+}
+
+func newZoneSet() *zoneSet {
+	return &zoneSet{pending: map[string]*zoneWriter{}}
+}
+
+// zoneFiles holds the zone files of the generation in progress, so that each is written
+// to disk once, in full, when generation succeeds and left untouched when it fails part
+// way through.
+var zoneFiles = newZoneSet()
+
+// create starts the zone file at path afresh, discarding anything generated for it.
+func (z *zoneSet) create(path string) *zoneWriter {
+	z.Lock()
+	defer z.Unlock()
+
+	if b, ok := z.pending[path]; ok {
+		b.discard()
+	}
+
+	b := &zoneWriter{path: path, created: true}
+	z.pending[path] = b
+
+	return b
+}
+
+// append returns the zone file at path for appending, creating it if need be.
+func (z *zoneSet) append(path string) *zoneWriter {
+	z.Lock()
+	defer z.Unlock()
+
+	b, ok := z.pending[path]
+	if !ok {
+		b = &zoneWriter{path: path}
+		z.pending[path] = b
+	}
+
+	return b
+}
+
+// paths returns the paths of the zone files in z in sorted order.
+func (z *zoneSet) paths() []string {
+	paths := make([]string, 0, len(z.pending))
+	for path := range z.pending {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+// discard drops every zone file in z.
+func (z *zoneSet) discard() {
+	z.Lock()
+	defer z.Unlock()
+
+	z.reset()
+}
+
+// reset discards every zone file in z. The caller must hold the lock.
+func (z *zoneSet) reset() {
+	for _, b := range z.pending {
+		b.discard()
+	}
+
+	z.pending = map[string]*zoneWriter{}
+}
+
+// createZoneFile starts the zone file at path afresh in the generation in progress.
+func createZoneFile(path string) *zoneWriter {
+	return zoneFiles.create(path)
+}
+
+// appendZoneFile returns the zone file at path in the generation in progress for
+// appending, creating it if need be.
+func appendZoneFile(path string) *zoneWriter {
+	return zoneFiles.append(path)
+}
+
+// readZoneFile returns the generated content of the zone file at path, or its content
+// on disk when it has not been generated.
+func readZoneFile(path string) ([]byte, error) {
+	zoneFiles.Lock()
+	defer zoneFiles.Unlock()
+
+	b, ok := zoneFiles.pending[path]
+	if !ok {
+		return os.ReadFile(path)
+	}
+
+	var content bytes.Buffer
+	if err := b.writeTo(&content); err != nil {
+		return nil, err
+	}
+
+	return content.Bytes(), nil
+}
+
+// flushZoneFiles writes every generated zone file to disk, replacing each atomically so
+// that named never loads a partly written zone, and returns the paths written. Oversized
+// zones are reported, or split, first.
+func flushZoneFiles() ([]string, error) {
+	zoneFiles.Lock()
+	defer zoneFiles.Unlock()
+
+	if err := zoneFiles.guardZoneFiles(); err != nil {
+		return nil, err
+	}
+
+	written := zoneFiles.paths()
+
+	for _, path := range written {
+		if err := zoneFiles.pending[path].commit(); err != nil {
+			return nil, err
+		}
+
+		delete(zoneFiles.pending, path)
+	}
+
+	return written, nil
+}
+
+// pruneZoneFiles removes the zone files written by the previous generation but not by
+// this one, such as those of services that have been disabled or dropped from
+// cache_domains, then records the files written in the manifest of the zone directory.
+// Until there is a manifest, the per-service RPZ zones of the services of cache_domains,
+// left by versions without one, are removed too. The custom zone and any other file in
+// the zone directory belong to the user and are never removed.
+func pruneZoneFiles(written []string) error {
+	manifest := zonePath + zoneManifest
+
+	owned := map[string]bool{customZone: true}
+	for _, path := range written {
+		owned[path] = true
+	}
+
+	previous, err := os.ReadFile(manifest)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	stale := strings.Fields(string(previous))
+
+	// Without a manifest only the zones of known services are taken to be dnstool's, as
+	// the zone directory may hold other response policy zones.
+	if os.IsNotExist(err) {
+		services, _, err := identifyServices()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range services {
+			stale = append(stale, zonePath+dnsgen.ServiceRPZZone(s)+".db")
+		}
+	}
+
+	for _, path := range stale {
+		if owned[path] {
+			continue
+		}
+
+		owned[path] = true
+
+		if err = os.Remove(path); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		log.Info("Removed stale zone file", "phase", "finalise", "file", path)
+	}
+
+	tmp := manifest + ".tmp"
+	if err = os.WriteFile(tmp, []byte(strings.Join(written, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, manifest)
+}
+
+// writtenZoneFiles returns the zone files recorded in the manifest of the zone directory
+// as written by the last generation, or none when there is no manifest.
+func writtenZoneFiles() []string {
+	b, err := os.ReadFile(zonePath + zoneManifest)
+	if err != nil {
+		return nil
+	}
+
+	return strings.Fields(string(b))
+}
+
+// discardZoneFiles drops the zone files of an abandoned generation.
+func discardZoneFiles() {
+	zoneFiles.discard()
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultZoneMaxRecords = 250000
+	defaultZoneMaxSize    = 32 << 20
+)
+
+// zoneLimits returns ZONE_MAX_RECORDS and ZONE_MAX_SIZE, in bytes, either of which can
+// be set to 0 to disable it.
+func zoneLimits() (int, int, error) {
+	limits := []int{defaultZoneMaxRecords, defaultZoneMaxSize}
+
+	for i, key := range []string{"ZONE_MAX_RECORDS", "ZONE_MAX_SIZE"} {
+		if os.Getenv(key) == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(os.Getenv(key))
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("%s value: %s is not a number", key, os.Getenv(key))
+		}
+
+		limits[i] = n
+	}
+
+	return limits[0], limits[1], nil
+}
+
+// exceeds reports whether a zone of records and size is over the limits.
+func exceeds(records, size, maxRecords, maxSize int) bool {
+	return (maxRecords > 0 && records > maxRecords) || (maxSize > 0 && size > maxSize)
+}
+
+// zoneLine classifies a line of a zone file, tracking the parenthesis depth of multi-line
+// records across calls. record is set on the first line of each resource record.
+func zoneLine(line string, depth *int) (record bool) {
+	data, _, _ := strings.Cut(line, ";")
+
+	record = *depth == 0 && strings.TrimSpace(data) != "" && !strings.HasPrefix(data, "$")
+	*depth += strings.Count(data, "(") - strings.Count(data, ")")
+
+	return record
+}
+
+// guardZoneFiles warns about generated zones over ZONE_MAX_RECORDS or ZONE_MAX_SIZE,
+// which make named slow to load them. With ZONE_SPLIT=true such zones are split into
+// parts within the limits, included from the zone file. The caller must hold the lock.
+func (z *zoneSet) guardZoneFiles() error {
+	maxRecords, maxSize, err := zoneLimits()
+	if err != nil || (maxRecords == 0 && maxSize == 0) {
+		return err
+	}
+
+	for _, path := range z.paths() {
+		records, size, err := z.pending[path].measure()
+		if err != nil {
+			return err
+		}
+
+		if !exceeds(records, size, maxRecords, maxSize) {
+			continue
+		}
+
+		if os.Getenv("ZONE_SPLIT") != "true" {
+			log.Warn("Zone exceeds the configured size, set ZONE_SPLIT=true to split it", "phase", "finalise", "file", path, "records", records, "bytes", size, "max_records", maxRecords, "max_bytes", maxSize)
+			continue
+		}
+
+		parts, err := z.split(path, maxRecords, maxSize)
+		if err != nil {
+			return err
+		}
+
+		log.Warn("Split oversized zone", "phase", "finalise", "file", path, "records", records, "bytes", size, "parts", parts)
+	}
+
+	return nil
+}
+
+// measure returns the number of records and bytes in the zone.
+func (b *zoneWriter) measure() (int, int, error) {
+	r, err := b.reader()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	records, size, depth := 0, 0, 0
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, zoneWriterLimit)
+
+	for scanner.Scan() {
+		size += len(scanner.Bytes()) + 1
+
+		if zoneLine(scanner.Text(), &depth) {
+			records++
+		}
+	}
+
+	return records, size, scanner.Err()
+}
+
+// split keeps as many records in the zone file at path as the limits allow, moving the
+// rest to numbered parts included at its end. Each part opens with the $ORIGIN and $TTL
+// in effect where it starts. split returns the number of parts written. The caller must
+// hold the lock.
+func (z *zoneSet) split(path string, maxRecords, maxSize int) (n int, err error) {
+	b := z.pending[path]
+
+	r, err := b.reader()
+	if err != nil {
+		return 0, err
+	}
+
+	main := &zoneWriter{path: path, created: b.created}
+	w := main
+
+	defer func() {
+		if err != nil {
+			main.discard()
+		}
+	}()
+
+	records, size, depth := 0, 0, 0
+	directives := map[string]string{}
+
+	var parts []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, zoneWriterLimit)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		record := zoneLine(line, &depth)
+		if record && exceeds(records+1, size+len(line)+1, maxRecords, maxSize) && records > 0 {
+			part := fmt.Sprintf("%s.part%d.db", strings.TrimSuffix(path, ".db"), len(parts)+1)
+			parts = append(parts, part)
+
+			w = &zoneWriter{path: part, created: true}
+			z.pending[part] = w
+			records, size = 0, 0
+
+			for _, d := range []string{"$ORIGIN", "$TTL"} {
+				if directives[d] == "" {
+					continue
+				}
+
+				if _, err = fmt.Fprintln(w, directives[d]); err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		for _, d := range []string{"$ORIGIN", "$TTL"} {
+			if strings.HasPrefix(line, d) {
+				directives[d] = line
+			}
+		}
+
+		if record {
+			records++
+		}
+
+		size += len(line) + 1
+
+		if _, err = fmt.Fprintln(w, line); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, part := range parts {
+		if _, err = fmt.Fprintln(main, "$INCLUDE "+part); err != nil {
+			return 0, err
+		}
+	}
+
+	b.discard()
+	z.pending[path] = main
+
+	return len(parts), nil
+}
@@ -0,0 +1,102 @@
+package dnsgen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// File is a file rendered by a backend, named relative to the output directory.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Backend renders the planned services in one output format. Backends are registered by
+// name, so that a format is added by registering it, from the init function of a package
+// compiled into the tool, without changing how generation plans the services.
+type Backend interface {
+	// Name is the name the backend is registered and selected by.
+	Name() string
+
+	// Render returns the files holding services, as planned by a Generator, under
+	// settings.
+	Render(services []Outcome, settings Config) ([]File, error)
+}
+
+// StreamingBackend is a Backend that can also write its files one at a time to the
+// writers returned by create, so that large zones need not be held in memory. size is an
+// estimate of the length of the file, for the writer to reserve room.
+type StreamingBackend interface {
+	Backend
+
+	RenderTo(services []Outcome, settings Config, create func(name string, size int) io.Writer) error
+}
+
+// renderFiles renders the files of a streaming backend in memory, as Render returns them.
+func renderFiles(b StreamingBackend, services []Outcome, settings Config) ([]File, error) {
+	files := make([]File, 0)
+	buffers := make([]*bytes.Buffer, 0)
+
+	err := b.RenderTo(services, settings, func(name string, size int) io.Writer {
+		buf := bytes.NewBuffer(make([]byte, 0, size))
+		files = append(files, File{Name: name})
+		buffers = append(buffers, buf)
+
+		return buf
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, buf := range buffers {
+		files[i].Data = buf.Bytes()
+	}
+
+	return files, nil
+}
+
+var backends = struct {
+	sync.RWMutex
+	byName map[string]Backend
+}{byName: map[string]Backend{}}
+
+// Register makes a backend available by its name. As with database/sql drivers it
+// panics when the name is already taken.
+func Register(b Backend) {
+	backends.Lock()
+	defer backends.Unlock()
+
+	if _, dup := backends.byName[b.Name()]; dup {
+		panic(fmt.Sprintf("dnsgen: backend %s is registered twice", b.Name()))
+	}
+
+	backends.byName[b.Name()] = b
+}
+
+// Lookup returns the backend registered as name.
+func Lookup(name string) (Backend, bool) {
+	backends.RLock()
+	defer backends.RUnlock()
+
+	b, ok := backends.byName[name]
+
+	return b, ok
+}
+
+// Backends returns the names of the registered backends in sorted order.
+func Backends() []string {
+	backends.RLock()
+	defer backends.RUnlock()
+
+	names := make([]string, 0, len(backends.byName))
+	for name := range backends.byName {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
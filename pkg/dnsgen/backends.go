@@ -0,0 +1,173 @@
+package dnsgen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+func init() {
+	Register(bindBackend{})
+	Register(rpzBackend{})
+	Register(dnsmasqBackend{})
+	Register(hostsBackend{})
+}
+
+// bindBackend renders the cache zone along with the zone statements serving it and the
+// rpz zone, to be included in named.conf.
+type bindBackend struct{}
+
+func (bindBackend) Name() string { return "bind" }
+
+func (b bindBackend) Render(services []Outcome, settings Config) ([]File, error) {
+	return renderFiles(b, services, settings)
+}
+
+func (bindBackend) RenderTo(services []Outcome, settings Config, create func(string, int) io.Writer) error {
+	cacheZoneFile := settings.Domain + ".db"
+
+	size := 0
+	for _, o := range services {
+		size += len(o.IPs) * (len(o.Service) + 32)
+	}
+
+	if err := writeCacheZone(create(cacheZoneFile, size), settings, services, settings.serial(cacheZoneFile)); err != nil {
+		return err
+	}
+
+	statements := ZoneStatements(settings.Domain, path.Join(settings.ZoneDir, cacheZoneFile), "", path.Join(settings.ZoneDir, "rpz.db"), "")
+
+	_, err := io.WriteString(create("cache.conf", len(statements)), statements)
+
+	return err
+}
+
+// rpzBackend renders the response policy zone rewriting the domains of each service,
+// and with PerServiceRPZ the zone of each service rewritten.
+type rpzBackend struct{}
+
+func (rpzBackend) Name() string { return "rpz" }
+
+func (b rpzBackend) Render(services []Outcome, settings Config) ([]File, error) {
+	return renderFiles(b, services, settings)
+}
+
+func (rpzBackend) RenderTo(services []Outcome, settings Config, create func(string, int) io.Writer) error {
+	size := 0
+	if !settings.PerServiceRPZ {
+		for _, o := range services {
+			size += rewritesSize(settings, o)
+		}
+	}
+
+	if err := writeRPZZone(create("rpz.db", size), settings, services, settings.serial("rpz.db")); err != nil {
+		return err
+	}
+
+	if !settings.PerServiceRPZ {
+		return nil
+	}
+
+	for _, o := range services {
+		if rpzPolicies(settings, o) == nil {
+			continue
+		}
+
+		name := ServiceRPZZone(o.Service) + ".db"
+		if err := WriteServiceRPZZone(create(name, rewritesSize(settings, o)), settings, o, settings.serial(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewritesSize estimates the length of the rewrites of a service in an rpz zone.
+func rewritesSize(cfg Config, o Outcome) int {
+	size := 0
+	for _, d := range o.Domains {
+		size += len(d)
+	}
+
+	return (size + len(o.Domains)*(len(o.Service)+len(cfg.Domain)+16)) * max(1, len(rpzPolicies(cfg, o)))
+}
+
+// dnsmasqBackend renders a dnsmasq configuration answering the domains of each enabled
+// service with its caches. dnsmasq matches a domain and every name beneath it, so a
+// wildcard is written as its parent domain, which is then answered as well.
+type dnsmasqBackend struct{}
+
+func (dnsmasqBackend) Name() string { return "dnsmasq" }
+
+func (dnsmasqBackend) Render(services []Outcome, _ Config) ([]File, error) {
+	var b bytes.Buffer
+
+	fmt.Fprintln(&b, "# Lancache domains, generated by dnstool")
+
+	for _, o := range services {
+		if rpzPolicies(Config{}, o) == nil {
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n# %s (%s)\n", o.Service, o.Policy)
+
+		for _, d := range o.Domains {
+			d = strings.TrimPrefix(d, "*.")
+
+			switch o.Policy {
+			case PolicyBlock:
+				fmt.Fprintf(&b, "address=/%s/\n", d)
+			case PolicyPassthru:
+				fmt.Fprintf(&b, "server=/%s/#\n", d)
+			default:
+				for _, ip := range o.IPs {
+					fmt.Fprintf(&b, "address=/%s/%s\n", d, ip)
+				}
+			}
+		}
+	}
+
+	return []File{{Name: "lancache.dnsmasq.conf", Data: b.Bytes()}}, nil
+}
+
+// hostsBackend renders a hosts file mapping the domains of each enabled service to its
+// caches, for resolvers that can load one. A hosts file holds only exact names, so
+// wildcards are listed as comments for handling elsewhere, and blocked domains are
+// answered with the unspecified address.
+type hostsBackend struct{}
+
+func (hostsBackend) Name() string { return "hosts" }
+
+func (hostsBackend) Render(services []Outcome, _ Config) ([]File, error) {
+	var b bytes.Buffer
+
+	fmt.Fprintln(&b, "# Lancache domains, generated by dnstool")
+
+	for _, o := range services {
+		if o.Policy != PolicyEnabled && o.Policy != PolicyBlock {
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n# %s (%s)\n", o.Service, o.Policy)
+
+		for _, d := range o.Domains {
+			if strings.HasPrefix(d, "*.") {
+				fmt.Fprintf(&b, "# %s cannot be expressed in a hosts file\n", d)
+				continue
+			}
+
+			if o.Policy == PolicyBlock {
+				fmt.Fprintf(&b, "0.0.0.0 %s\n", d)
+				continue
+			}
+
+			for _, ip := range o.IPs {
+				fmt.Fprintf(&b, "%s %s\n", ip, d)
+			}
+		}
+	}
+
+	return []File{{Name: "lancache.hosts", Data: b.Bytes()}}, nil
+}
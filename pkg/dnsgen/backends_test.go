@@ -0,0 +1,144 @@
+package dnsgen
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testOutcomes are one service of each policy a backend writes.
+var testOutcomes = []Outcome{
+	{Service: "steam", Policy: PolicyEnabled, IPs: []string{"10.0.0.10"}, Domains: []string{"lancache.steamcontent.com", "*.steamcontent.com"}},
+	{Service: "blizzard", Policy: PolicyBlock, Domains: []string{"dist.blizzard.com"}},
+	{Service: "riot", Policy: PolicyPassthru, Domains: []string{"riotgamespatcher-a.akamaihd.net"}},
+	{Service: "origin", Policy: PolicyDisabled},
+}
+
+func TestBackends(t *testing.T) {
+	if got, want := Backends(), []string{"bind", "dnsmasq", "hosts", "rpz"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, ok := Lookup("unbound"); ok {
+		t.Error("unbound is not a registered backend")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering bind twice did not panic")
+		}
+	}()
+
+	Register(bindBackend{})
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		backend string
+		cfg     Config
+		files   []string
+
+		// contains and omits hold, for each file, content it must and must not have.
+		contains map[string][]string
+		omits    map[string][]string
+	}{
+		{
+			backend: "bind",
+			files:   []string{"cache.lancache.net.db", "cache.conf"},
+			contains: map[string][]string{
+				"cache.lancache.net.db": {"$ORIGIN cache.lancache.net.", "steam IN A 10.0.0.10;"},
+				"cache.conf":            {`zone "cache.lancache.net"`, "/zones/cache.lancache.net.db", "/zones/rpz.db"},
+			},
+			omits: map[string][]string{"cache.lancache.net.db": {"blizzard", "riot", "origin"}},
+		},
+		{
+			backend: "rpz",
+			files:   []string{"rpz.db"},
+			contains: map[string][]string{"rpz.db": {
+				"lancache.steamcontent.com IN CNAME steam.cache.lancache.net.;",
+				"*.steamcontent.com IN CNAME steam.cache.lancache.net.;",
+				"dist.blizzard.com IN CNAME .;",
+				"riotgamespatcher-a.akamaihd.net IN CNAME rpz-passthru.;",
+				"32.10.0.0.10.rpz-client-ip",
+			}},
+			omits: map[string][]string{"rpz.db": {"origin"}},
+		},
+		{
+			backend: "rpz",
+			cfg:     Config{PerServiceRPZ: true},
+			files:   []string{"rpz.db", "rpz-steam.db", "rpz-blizzard.db", "rpz-riot.db"},
+			contains: map[string][]string{
+				"rpz.db":          {";## steam", "32.10.0.0.10.rpz-client-ip"},
+				"rpz-steam.db":    {"lancache.steamcontent.com IN CNAME steam.cache.lancache.net.;"},
+				"rpz-blizzard.db": {"dist.blizzard.com IN CNAME .;"},
+				"rpz-riot.db":     {"riotgamespatcher-a.akamaihd.net IN CNAME rpz-passthru.;"},
+			},
+			omits: map[string][]string{"rpz.db": {"steamcontent.com", "blizzard", "riot"}},
+		},
+		{
+			backend: "dnsmasq",
+			files:   []string{"lancache.dnsmasq.conf"},
+			contains: map[string][]string{"lancache.dnsmasq.conf": {
+				"address=/lancache.steamcontent.com/10.0.0.10",
+				"address=/steamcontent.com/10.0.0.10",
+				"address=/dist.blizzard.com/\n",
+				"server=/riotgamespatcher-a.akamaihd.net/#",
+			}},
+			omits: map[string][]string{"lancache.dnsmasq.conf": {"origin"}},
+		},
+		{
+			backend: "hosts",
+			files:   []string{"lancache.hosts"},
+			contains: map[string][]string{"lancache.hosts": {
+				"10.0.0.10 lancache.steamcontent.com",
+				"# *.steamcontent.com cannot be expressed in a hosts file",
+				"0.0.0.0 dist.blizzard.com",
+			}},
+			omits: map[string][]string{"lancache.hosts": {"riot", "origin"}},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.backend
+		if tt.cfg.PerServiceRPZ {
+			name += " per service"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			b, ok := Lookup(tt.backend)
+			if !ok {
+				t.Fatalf("%s is not registered", tt.backend)
+			}
+
+			cfg := tt.cfg
+			cfg.Domain, cfg.ZoneDir, cfg.CacheTTL, cfg.RPZTTL = "cache.lancache.net", "/zones", "600", "60"
+			cfg.CacheSOA, cfg.RPZSOA, cfg.NS = CacheSOADefaults, RPZSOADefaults, "localhost."
+
+			files, err := b.Render(testOutcomes, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := make([]string, 0, len(files))
+			for _, f := range files {
+				names = append(names, f.Name)
+
+				for _, want := range tt.contains[f.Name] {
+					if !strings.Contains(string(f.Data), want) {
+						t.Errorf("%s is missing %q:\n%s", f.Name, want, f.Data)
+					}
+				}
+
+				for _, unwanted := range tt.omits[f.Name] {
+					if strings.Contains(string(f.Data), unwanted) {
+						t.Errorf("%s has %q:\n%s", f.Name, unwanted, f.Data)
+					}
+				}
+			}
+
+			if !slices.Equal(names, tt.files) {
+				t.Errorf("got files %v, want %v", names, tt.files)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package dnsgen
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// LookupFunc looks up an environment variable, as os.LookupEnv does.
+type LookupFunc func(key string) (string, bool)
+
+// ServiceConfig is the configuration of a single service.
+type ServiceConfig struct {
+	// CacheIP is <SERVICE>CACHE_IP, the caches serving the service. HasCacheIP records
+	// whether it was set at all, which enables the service without a generic cache.
+	CacheIP    string
+	HasCacheIP bool
+
+	// Disabled is DISABLE_<SERVICE>, leaving the service out of a generic cache.
+	Disabled bool
+
+	// Block is BLOCK_<SERVICE>, answering the service's domains with NXDOMAIN.
+	Block bool
+
+	// Passthru is PASSTHRU_<SERVICE>, exempting the service's domains from rewrites.
+	Passthru bool
+
+	// Forward is FORWARD_<SERVICE>, the upstreams the service's domains are forwarded
+	// to instead of being rewritten.
+	Forward string
+
+	// The remaining fields are runtime inputs that do not come from the environment.
+
+	// DiscoveredIP lists the caches found for the service by container discovery, used
+	// when CacheIP is not set.
+	DiscoveredIP string
+
+	// Enabled, when set, overrides whether the service is enabled, and IP its caches,
+	// as a runtime override does.
+	Enabled *bool
+	IP      string
+
+	// Pending holds back a service that would be enabled until it is approved.
+	Pending bool
+}
+
+// Config is the configuration generation is driven by, as set in the environment of the
+// lancache-dns container.
+type Config struct {
+	// Domain is LANCACHE_DNSDOMAIN, the zone holding a record per cached service.
+	Domain string
+
+	// GenericCache is USE_GENERIC_CACHE, enabling every service not disabled.
+	GenericCache bool
+
+	// CacheIP is LANCACHE_IP, the caches of services without their own.
+	CacheIP string
+
+	// NS is LANCACHE_DNS_NS, the name server of the cache zone.
+	NS string
+
+	// Flatten is RPZ_FLATTEN, rewriting domains straight to the cache addresses rather
+	// than to a CNAME in the cache zone.
+	Flatten bool
+
+	// HTTPSRecords is HTTPS_RECORDS=svcb, publishing an HTTPS record for each enabled
+	// service whose address hints point at its caches.
+	HTTPSRecords bool
+
+	// PerServiceRPZ is RPZ_PER_SERVICE, giving each service a response policy zone of
+	// its own.
+	PerServiceRPZ bool
+
+	// CacheTTL and RPZTTL are CACHE_RECORD_TTL and RPZ_TTL, the default TTLs of the
+	// cache zone and the response policy zone.
+	CacheTTL string
+	RPZTTL   string
+
+	// CacheSOA and RPZSOA are the SOA fields from CACHE_SOA_*, RPZ_SOA_* and SOA_*.
+	CacheSOA SOA
+	RPZSOA   SOA
+
+	// SerialFormat is SERIAL_FORMAT: unix, date or counter.
+	SerialFormat string
+
+	// PassthruIPs is PASSTHRU_IPS, clients whose lookups are never rewritten.
+	PassthruIPs []string
+
+	// Services holds the configuration of each service, keyed by its name.
+	Services map[string]ServiceConfig
+
+	// Serial is the SOA serial of the zones rendered by backends. Serials overrides it
+	// for the zone files named, as when each zone follows on from its copy on disk.
+	Serial  uint32
+	Serials map[string]uint32
+
+	// CacheRecords are written to the cache zone after its NS record, ahead of the
+	// records of the services.
+	CacheRecords []string
+
+	// ZoneDir is the directory zone statements name the zone files in. When empty the
+	// files are named alone, for named to find relative to its directory option.
+	ZoneDir string
+
+	// Active reports whether a service is within its schedule. When nil every service
+	// is.
+	Active func(service string) (bool, error)
+
+	// Addresses narrows the caches of an enabled service to those it may be answered
+	// with, as SUPPRESS_AAAA does, and Healthy to those passing their health checks.
+	// Either may be nil to keep every cache.
+	Addresses func(ips []string) ([]string, error)
+	Healthy   func(ips []string) []string
+}
+
+// ConfigFromEnv reads the configuration from the environment through lookup, typically
+// os.LookupEnv, including the per-service variables of each of services.
+func ConfigFromEnv(lookup LookupFunc, services []Service) (Config, error) {
+	cfg := Config{
+		Domain:        getenv(lookup, "LANCACHE_DNSDOMAIN"),
+		GenericCache:  getenv(lookup, "USE_GENERIC_CACHE") == "true",
+		CacheIP:       getenv(lookup, "LANCACHE_IP"),
+		NS:            "localhost.",
+		Flatten:       getenv(lookup, "RPZ_FLATTEN") == "true",
+		HTTPSRecords:  getenv(lookup, "HTTPS_RECORDS") == "svcb",
+		PerServiceRPZ: getenv(lookup, "RPZ_PER_SERVICE") == "true",
+		SerialFormat:  getenv(lookup, "SERIAL_FORMAT"),
+		PassthruIPs:   splitList(getenv(lookup, "PASSTHRU_IPS")),
+		Services:      map[string]ServiceConfig{},
+	}
+
+	for _, ip := range cfg.PassthruIPs {
+		if net.ParseIP(ip) == nil {
+			return Config{}, fmt.Errorf("IP address: %s is not valid", ip)
+		}
+	}
+
+	if cfg.Domain == "" {
+		cfg.Domain = "cache.lancache.net"
+	}
+
+	if ns := getenv(lookup, "LANCACHE_DNS_NS"); ns != "" {
+		cfg.NS = FQDN(ns)
+	}
+
+	var err error
+
+	if cfg.CacheTTL, err = ttlFromEnv(lookup, "CACHE_RECORD_TTL", "600"); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.RPZTTL, err = ttlFromEnv(lookup, "RPZ_TTL", "60"); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.CacheSOA, err = SOAFromEnv(lookup, "CACHE_", CacheSOADefaults); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.RPZSOA, err = SOAFromEnv(lookup, "RPZ_", RPZSOADefaults); err != nil {
+		return Config{}, err
+	}
+
+	for _, s := range services {
+		name := strings.ToUpper(s.Name)
+		ip, ok := lookup(name + "CACHE_IP")
+
+		cfg.Services[strings.ToLower(s.Name)] = ServiceConfig{
+			CacheIP:    ip,
+			HasCacheIP: ok,
+			Disabled:   getenv(lookup, "DISABLE_"+name) == "true",
+			Block:      getenv(lookup, "BLOCK_"+name) == "true",
+			Passthru:   getenv(lookup, "PASSTHRU_"+name) == "true",
+			Forward:    getenv(lookup, "FORWARD_"+name),
+		}
+	}
+
+	return cfg, nil
+}
+
+// getenv returns the value of key, or an empty string when it is unset.
+func getenv(lookup LookupFunc, key string) string {
+	v, _ := lookup(key)
+	return v
+}
+
+// ttlFromEnv returns the TTL set in key, or fallback when it is unset.
+func ttlFromEnv(lookup LookupFunc, key, fallback string) (string, error) {
+	ttl := getenv(lookup, key)
+	if ttl == "" {
+		return fallback, nil
+	}
+
+	if !ValidTime(ttl) {
+		return "", fmt.Errorf("%s value: %s is not a valid time", key, ttl)
+	}
+
+	return ttl, nil
+}
+
+// serial returns the serial of the zone file named name.
+func (cfg Config) serial(name string) uint32 {
+	if serial, ok := cfg.Serials[name]; ok {
+		return serial
+	}
+
+	return cfg.Serial
+}
+
+// splitList splits a list of addresses separated by spaces or semicolons.
+func splitList(s string) []string {
+	return strings.Fields(strings.ReplaceAll(s, ";", " "))
+}
@@ -0,0 +1,99 @@
+// Package dnsgen generates the lancache-dns zones from cache_domains: it parses the
+// container's environment, loads the cache_domains services and renders the cache zone,
+// the response policy zone and the BIND zone statements to any io.Writer, so that other
+// tools and tests can embed generation rather than running dnstool itself.
+package dnsgen
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// CacheDomainsFile is the index of cache_domains, listing each service with its files.
+const CacheDomainsFile = "cache_domains.json"
+
+// CacheFile is the layout of cache_domains.json.
+type CacheFile struct {
+	CacheDomains []struct {
+		Name         string   `json:"name"`
+		Description  string   `json:"description"`
+		DomainFiles  []string `json:"domain_files"`
+		Notes        string   `json:"notes,omitempty"`
+		MixedContent bool     `json:"mixed_content,omitempty"`
+	} `json:"cache_domains"`
+}
+
+// Service is a service of cache_domains together with the domains in its files.
+type Service struct {
+	Name        string
+	Description string
+	DomainFiles []string
+	Domains     []string
+}
+
+// LoadCacheDomains reads cache_domains.json and every domain file it lists from fsys,
+// typically os.DirFS of a cache_domains checkout, returning the services in file order.
+func LoadCacheDomains(fsys fs.FS) ([]Service, error) {
+	f, err := fs.ReadFile(fsys, CacheDomainsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var cacheData CacheFile
+	if err = json.Unmarshal(f, &cacheData); err != nil {
+		return nil, err
+	}
+
+	services := make([]Service, 0, len(cacheData.CacheDomains))
+
+	for _, s := range cacheData.CacheDomains {
+		service := Service{Name: s.Name, Description: s.Description, DomainFiles: s.DomainFiles, Domains: make([]string, 0)}
+
+		for _, file := range s.DomainFiles {
+			d, err := readDomainFile(fsys, file)
+			if err != nil {
+				return nil, err
+			}
+
+			service.Domains = append(service.Domains, d...)
+		}
+
+		services = append(services, service)
+	}
+
+	return services, nil
+}
+
+func readDomainFile(fsys fs.FS, name string) ([]string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return ReadDomains(f)
+}
+
+// ReadDomains returns the domains of a cache_domains domain file, lower cased, skipping
+// blank lines and comments.
+func ReadDomains(r io.Reader) ([]string, error) {
+	domains := make([]string, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		domains = append(domains, strings.ToLower(line))
+	}
+
+	return domains, scanner.Err()
+}
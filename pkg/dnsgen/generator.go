@@ -0,0 +1,458 @@
+package dnsgen
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Policies a service can be generated with.
+const (
+	PolicyEnabled  = "enabled"
+	PolicyDisabled = "disabled"
+	PolicyBlock    = "block"
+	PolicyPassthru = "passthru"
+	PolicyForward  = "forward"
+	PolicyPending  = "pending"
+)
+
+// Reasons a service that would be enabled is left disabled.
+const (
+	ReasonInactive = "inactive"
+	ReasonDown     = "down"
+)
+
+// Outcome is how a service is generated: its policy and, when enabled, the cache
+// addresses its domains are rewritten to with any weights they were given. Reason says
+// why a service that would be enabled is not: it is outside its schedule or none of its
+// caches is healthy.
+type Outcome struct {
+	Service string
+	Policy  string
+	IPs     []string
+	Weights map[string]int
+	Domains []string
+	Reason  string
+}
+
+// Generator renders the zones for a set of services under a configuration.
+type Generator struct {
+	Config   Config
+	Services []Service
+}
+
+// New returns a Generator for services configured by cfg.
+func New(cfg Config, services []Service) *Generator {
+	return &Generator{Config: cfg, Services: services}
+}
+
+// Plan returns the outcome of each service, in service order.
+func (g *Generator) Plan() ([]Outcome, error) {
+	outcomes := make([]Outcome, 0, len(g.Services))
+
+	for _, s := range g.Services {
+		o, err := g.PlanService(s)
+		if err != nil {
+			return nil, err
+		}
+
+		outcomes = append(outcomes, o)
+	}
+
+	return outcomes, nil
+}
+
+// PlanService returns the outcome of a single service. A blocked service takes
+// precedence over one forwarded, which takes precedence over one passed through, which
+// in turn takes precedence over enabling it. An enabled service is served by the caches
+// of its runtime override, its own, those discovered for it or otherwise LANCACHE_IP,
+// each of which must be a private address.
+func (g *Generator) PlanService(s Service) (Outcome, error) {
+	name := strings.ToLower(s.Name)
+	sc := g.Config.Services[name]
+	o := Outcome{Service: name, Policy: PolicyDisabled}
+
+	switch {
+	case sc.Block:
+		o.Policy, o.Domains = PolicyBlock, s.Domains
+		return o, nil
+	case sc.Forward != "":
+		o.Policy = PolicyForward
+		return o, nil
+	case sc.Passthru:
+		o.Policy, o.Domains = PolicyPassthru, s.Domains
+		return o, nil
+	}
+
+	enabled := !sc.Disabled
+	if !g.Config.GenericCache {
+		enabled = sc.HasCacheIP || sc.DiscoveredIP != ""
+	}
+
+	if sc.Enabled != nil {
+		enabled = *sc.Enabled
+	}
+
+	if !enabled {
+		return o, nil
+	}
+
+	if sc.Pending {
+		o.Policy = PolicyPending
+		return o, nil
+	}
+
+	if g.Config.Active != nil {
+		active, err := g.Config.Active(name)
+		if err != nil {
+			return Outcome{}, err
+		}
+
+		if !active {
+			o.Reason = ReasonInactive
+			return o, nil
+		}
+	}
+
+	ip := g.Config.CacheIP
+	switch {
+	case sc.IP != "":
+		ip = sc.IP
+	case sc.CacheIP != "":
+		ip = sc.CacheIP
+	case sc.DiscoveredIP != "":
+		ip = sc.DiscoveredIP
+	}
+
+	if ip == "" {
+		return Outcome{}, fmt.Errorf("Could not find IP for requested service: %s", name)
+	}
+
+	ips, weights, err := cacheAddresses(ip)
+	if err != nil {
+		return Outcome{}, err
+	}
+
+	if g.Config.Addresses != nil {
+		if ips, err = g.Config.Addresses(ips); err != nil {
+			return Outcome{}, err
+		}
+	}
+
+	if g.Config.Healthy != nil {
+		if ips = g.Config.Healthy(ips); len(ips) == 0 {
+			o.Reason = ReasonDown
+			return o, nil
+		}
+	}
+
+	o.Policy, o.IPs, o.Weights, o.Domains = PolicyEnabled, ips, weights, s.Domains
+
+	return o, nil
+}
+
+// WriteCacheZone writes the cache zone, holding an address record for each cache of
+// every enabled service.
+func (g *Generator) WriteCacheZone(w io.Writer, serial uint32) error {
+	outcomes, err := g.Plan()
+	if err != nil {
+		return err
+	}
+
+	return writeCacheZone(w, g.Config, outcomes, serial)
+}
+
+// WriteRPZZone writes the response policy zone: the rewrites of each enabled, blocked or
+// passed through service, with the caches of an enabled service and PASSTHRU_IPS exempt
+// so that their own lookups are answered by the upstreams. With PerServiceRPZ the
+// rewrites of each service are written to its own zone by WriteServiceRPZZone instead.
+func (g *Generator) WriteRPZZone(w io.Writer, serial uint32) error {
+	outcomes, err := g.Plan()
+	if err != nil {
+		return err
+	}
+
+	return writeRPZZone(w, g.Config, outcomes, serial)
+}
+
+// WriteZoneStatements writes the BIND zone statements serving the cache zone from
+// cacheZoneFile and the response policy zone from rpzZoneFile.
+func (g *Generator) WriteZoneStatements(w io.Writer, cacheZoneFile, rpzZoneFile string) error {
+	_, err := io.WriteString(w, ZoneStatements(g.Config.Domain, cacheZoneFile, "", rpzZoneFile, ""))
+
+	return err
+}
+
+// Render plans the services and renders them with the named backend.
+func (g *Generator) Render(backend string) ([]File, error) {
+	b, ok := Lookup(backend)
+	if !ok {
+		return nil, fmt.Errorf("Output backend: %s is not registered", backend)
+	}
+
+	outcomes, err := g.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Render(outcomes, g.Config)
+}
+
+func writeCacheZone(w io.Writer, cfg Config, outcomes []Outcome, serial uint32) error {
+	if err := WriteCacheZoneHeader(w, cfg.Domain, cfg.CacheTTL, cfg.CacheSOA, serial, cfg.NS); err != nil {
+		return err
+	}
+
+	for _, rr := range cfg.CacheRecords {
+		if _, err := fmt.Fprintln(w, rr); err != nil {
+			return err
+		}
+	}
+
+	for _, o := range outcomes {
+		if err := WriteCacheRecords(w, cfg, o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteCacheRecords writes the records of an enabled service to the cache zone: an
+// address record for each of its caches and, with HTTPSRecords set, an HTTPS record
+// hinting at them. Other services have none.
+func WriteCacheRecords(w io.Writer, cfg Config, o Outcome) error {
+	if o.Policy != PolicyEnabled {
+		return nil
+	}
+
+	for _, ip := range o.IPs {
+		if _, err := fmt.Fprintln(w, o.Service+" IN "+addressType(ip)+" "+ip+";"); err != nil {
+			return err
+		}
+	}
+
+	if !cfg.HTTPSRecords {
+		return nil
+	}
+
+	_, err := fmt.Fprintln(w, o.Service+" IN "+HTTPSRecord(o.IPs)+";")
+
+	return err
+}
+
+func writeRPZZone(w io.Writer, cfg Config, outcomes []Outcome, serial uint32) error {
+	if err := WriteRPZHeader(w, cfg.RPZTTL, cfg.RPZSOA, serial); err != nil {
+		return err
+	}
+
+	for _, o := range outcomes {
+		if err := WriteRPZSection(w, cfg, o); err != nil {
+			return err
+		}
+	}
+
+	if len(cfg.PassthruIPs) == 0 {
+		return nil
+	}
+
+	if _, err := fmt.Fprintln(w, ";## Additional RPZ passthroughs"); err != nil {
+		return err
+	}
+
+	return writeClientPassthrus(w, cfg.PassthruIPs)
+}
+
+// WriteRPZSection writes the section of a service in the rpz zone: its heading, the
+// client passthroughs of its caches and the rewrites of its domains. With PerServiceRPZ
+// the rewrites are left to the zone of the service, and only an enabled service has a
+// section.
+func WriteRPZSection(w io.Writer, cfg Config, o Outcome) error {
+	if rpzPolicies(cfg, o) == nil || cfg.PerServiceRPZ && o.Policy != PolicyEnabled {
+		return nil
+	}
+
+	if _, err := fmt.Fprintln(w, ";## "+o.Service); err != nil {
+		return err
+	}
+
+	if err := writeClientPassthrus(w, o.IPs); err != nil {
+		return err
+	}
+
+	if cfg.PerServiceRPZ {
+		return nil
+	}
+
+	return writeServiceRewrites(w, cfg, o)
+}
+
+// WriteServiceRPZZone writes the response policy zone of a service with PerServiceRPZ
+// set, holding the rewrites of its domains.
+func WriteServiceRPZZone(w io.Writer, cfg Config, o Outcome, serial uint32) error {
+	if err := WriteRPZHeader(w, cfg.RPZTTL, cfg.RPZSOA, serial); err != nil {
+		return err
+	}
+
+	return writeServiceRewrites(w, cfg, o)
+}
+
+// ServiceRPZZone returns the name of the response policy zone of service with
+// PerServiceRPZ set.
+func ServiceRPZZone(service string) string {
+	return "rpz-" + strings.ToLower(service)
+}
+
+func writeServiceRewrites(w io.Writer, cfg Config, o Outcome) error {
+	rewrites := rpzPolicies(cfg, o)
+
+	for _, d := range o.Domains {
+		if err := WriteRewrites(w, d, rewrites); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rpzPolicies returns the record data the domains of a service are rewritten to, or nil
+// when they are not rewritten.
+func rpzPolicies(cfg Config, o Outcome) []string {
+	switch o.Policy {
+	case PolicyBlock:
+		return []string{"CNAME ."}
+	case PolicyPassthru:
+		return []string{"CNAME rpz-passthru."}
+	case PolicyEnabled:
+		return rpzRewrites(cfg, o)
+	default:
+		return nil
+	}
+}
+
+// rpzRewrites returns the record data the domains of an enabled service are rewritten to.
+func rpzRewrites(cfg Config, o Outcome) []string {
+	if !cfg.Flatten {
+		return []string{"CNAME " + o.Service + "." + cfg.Domain + "."}
+	}
+
+	rewrites := make([]string, 0, len(o.IPs)+1)
+	for _, ip := range o.IPs {
+		rewrites = append(rewrites, addressType(ip)+" "+ip)
+	}
+
+	if cfg.HTTPSRecords {
+		rewrites = append(rewrites, HTTPSRecord(o.IPs))
+	}
+
+	return rewrites
+}
+
+// HTTPSRecord returns the data of an HTTPS record whose address hints point at ips.
+func HTTPSRecord(ips []string) string {
+	var v4, v6 []string
+
+	for _, ip := range ips {
+		if addressType(ip) == "A" {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	rr := "HTTPS 1 ."
+
+	if len(v4) > 0 {
+		rr += " ipv4hint=" + strings.Join(v4, ",")
+	}
+
+	if len(v6) > 0 {
+		rr += " ipv6hint=" + strings.Join(v6, ",")
+	}
+
+	return rr
+}
+
+// writeClientPassthrus writes an rpz-client-ip passthrough for each address in ips.
+func writeClientPassthrus(w io.Writer, ips []string) error {
+	for _, ip := range ips {
+		trigger := ClientIPTrigger(ip)
+		if trigger == "" {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, "%s.rpz-client-ip      CNAME rpz-passthru.;\n", trigger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cacheAddresses returns the addresses of a list of caches, each of which must be a
+// private address, with the weights of those given one as in 10.0.0.5*3.
+func cacheAddresses(list string) ([]string, map[string]int, error) {
+	ips, weights, err := WeightedAddresses(list)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, ip := range ips {
+		if !net.ParseIP(ip).IsPrivate() {
+			return nil, nil, fmt.Errorf("IP address: %s is not a valid private address (RFC 1918/4193)", ip)
+		}
+	}
+
+	return ips, weights, nil
+}
+
+// WeightedAddresses strips the optional *weight suffix from each address of a list
+// separated by spaces, semicolons or commas, as in 10.0.0.5*3,10.0.0.6*1, returning the
+// addresses and, when any weight was given, the weight of each address. An address given
+// more than once is returned once, with the weights it was given added together.
+func WeightedAddresses(list string) ([]string, map[string]int, error) {
+	ips := make([]string, 0)
+	seen := map[string]bool{}
+
+	var weights map[string]int
+
+	for _, entry := range splitList(strings.ReplaceAll(list, ",", " ")) {
+		ip, w, weighted := strings.Cut(entry, "*")
+
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, nil, fmt.Errorf("IP address: %s is not valid", ip)
+		}
+
+		if weighted {
+			n, err := strconv.Atoi(w)
+			if err != nil || n < 1 {
+				return nil, nil, fmt.Errorf("Cache IP weight: %s is not a positive number", entry)
+			}
+
+			if weights == nil {
+				weights = map[string]int{}
+			}
+
+			weights[ip] += n
+		}
+
+		if !seen[parsed.String()] {
+			seen[parsed.String()] = true
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips, weights, nil
+}
+
+// addressType returns the address record type, A or AAAA, for ip.
+func addressType(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "AAAA"
+	}
+
+	return "A"
+}
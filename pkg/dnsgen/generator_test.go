@@ -0,0 +1,276 @@
+package dnsgen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestPlanService(t *testing.T) {
+	enabled, disabled := true, false
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		sc      ServiceConfig
+		policy  string
+		ips     []string
+		reason  string
+		wantErr bool
+
+		// noCacheIP leaves LANCACHE_IP unset rather than 10.0.0.10.
+		noCacheIP bool
+	}{
+		{name: "generic cache", cfg: Config{GenericCache: true}, policy: PolicyEnabled, ips: []string{"10.0.0.10"}},
+		{name: "generic cache disabled", cfg: Config{GenericCache: true}, sc: ServiceConfig{Disabled: true}, policy: PolicyDisabled},
+		{name: "no cache ip", policy: PolicyDisabled},
+		{name: "own cache ip", sc: ServiceConfig{CacheIP: "10.0.0.20", HasCacheIP: true}, policy: PolicyEnabled, ips: []string{"10.0.0.20"}},
+		{name: "discovered", sc: ServiceConfig{DiscoveredIP: "10.0.0.30"}, policy: PolicyEnabled, ips: []string{"10.0.0.30"}},
+		{name: "own cache ip over discovered", sc: ServiceConfig{CacheIP: "10.0.0.20", HasCacheIP: true, DiscoveredIP: "10.0.0.30"}, policy: PolicyEnabled, ips: []string{"10.0.0.20"}},
+		{name: "override ip", sc: ServiceConfig{CacheIP: "10.0.0.20", HasCacheIP: true, Enabled: &enabled, IP: "10.0.0.40"}, policy: PolicyEnabled, ips: []string{"10.0.0.40"}},
+		{name: "override enabled", sc: ServiceConfig{Enabled: &enabled}, policy: PolicyEnabled, ips: []string{"10.0.0.10"}},
+		{name: "override disabled", cfg: Config{GenericCache: true}, sc: ServiceConfig{Enabled: &disabled}, policy: PolicyDisabled},
+		{name: "block", cfg: Config{GenericCache: true}, sc: ServiceConfig{Block: true, Forward: "192.0.2.1", Passthru: true}, policy: PolicyBlock},
+		{name: "block over override", sc: ServiceConfig{Block: true, Enabled: &enabled}, policy: PolicyBlock},
+		{name: "forward", cfg: Config{GenericCache: true}, sc: ServiceConfig{Forward: "192.0.2.1", Passthru: true}, policy: PolicyForward},
+		{name: "passthru", cfg: Config{GenericCache: true}, sc: ServiceConfig{Passthru: true}, policy: PolicyPassthru},
+		{name: "pending", cfg: Config{GenericCache: true}, sc: ServiceConfig{Pending: true}, policy: PolicyPending},
+		{name: "pending disabled", cfg: Config{GenericCache: true}, sc: ServiceConfig{Pending: true, Disabled: true}, policy: PolicyDisabled},
+		{name: "weighted", sc: ServiceConfig{CacheIP: "10.0.0.5*3 10.0.0.6", HasCacheIP: true}, policy: PolicyEnabled, ips: []string{"10.0.0.5", "10.0.0.6"}},
+		{name: "public cache ip", sc: ServiceConfig{CacheIP: "192.0.2.10", HasCacheIP: true}, wantErr: true},
+		{name: "no ip at all", cfg: Config{GenericCache: true}, noCacheIP: true, wantErr: true},
+		{
+			name:   "inactive",
+			cfg:    Config{GenericCache: true, Active: func(string) (bool, error) { return false, nil }},
+			policy: PolicyDisabled,
+			reason: ReasonInactive,
+		},
+		{
+			name:    "schedule error",
+			cfg:     Config{GenericCache: true, Active: func(string) (bool, error) { return false, errors.New("bad schedule") }},
+			wantErr: true,
+		},
+		{
+			name:   "every cache down",
+			cfg:    Config{GenericCache: true, Healthy: func([]string) []string { return nil }},
+			policy: PolicyDisabled,
+			reason: ReasonDown,
+		},
+		{
+			name:   "some caches down",
+			sc:     ServiceConfig{CacheIP: "10.0.0.5 10.0.0.6", HasCacheIP: true},
+			cfg:    Config{Healthy: func(ips []string) []string { return ips[1:] }},
+			policy: PolicyEnabled,
+			ips:    []string{"10.0.0.6"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			if !tt.noCacheIP {
+				cfg.CacheIP = "10.0.0.10"
+			}
+
+			cfg.Services = map[string]ServiceConfig{"steam": tt.sc}
+
+			o, err := New(cfg, nil).PlanService(Service{Name: "Steam", Domains: []string{"lancache.steamcontent.com"}})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got outcome %+v, want an error", o)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if o.Service != "steam" || o.Policy != tt.policy || !slices.Equal(o.IPs, tt.ips) || o.Reason != tt.reason {
+				t.Errorf("got %s %s %v %q, want steam %s %v %q", o.Service, o.Policy, o.IPs, o.Reason, tt.policy, tt.ips, tt.reason)
+			}
+
+			// Only the services whose domains are rewritten carry them.
+			rewritten := tt.policy == PolicyEnabled || tt.policy == PolicyBlock || tt.policy == PolicyPassthru
+			if got := len(o.Domains) > 0; got != rewritten {
+				t.Errorf("got domains %v for policy %s", o.Domains, o.Policy)
+			}
+		})
+	}
+}
+
+func TestPlan(t *testing.T) {
+	services := []Service{{Name: "steam"}, {Name: "blizzard"}, {Name: "riot"}}
+
+	cfg := Config{GenericCache: true, CacheIP: "10.0.0.10", Services: map[string]ServiceConfig{
+		"blizzard": {Block: true},
+		"riot":     {Disabled: true},
+	}}
+
+	outcomes, err := New(cfg, services).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(outcomes))
+	for _, o := range outcomes {
+		got = append(got, o.Service+" "+o.Policy)
+	}
+
+	if want := []string{"steam enabled", "blizzard block", "riot disabled"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWriteCacheRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		o    Outcome
+		want string
+	}{
+		{
+			name: "enabled",
+			o:    Outcome{Service: "steam", Policy: PolicyEnabled, IPs: []string{"10.0.0.10", "fd00::10"}},
+			want: "steam IN A 10.0.0.10;\nsteam IN AAAA fd00::10;\n",
+		},
+		{
+			name: "https records",
+			cfg:  Config{HTTPSRecords: true},
+			o:    Outcome{Service: "steam", Policy: PolicyEnabled, IPs: []string{"10.0.0.10", "fd00::10"}},
+			want: "steam IN A 10.0.0.10;\nsteam IN AAAA fd00::10;\nsteam IN HTTPS 1 . ipv4hint=10.0.0.10 ipv6hint=fd00::10;\n",
+		},
+		{name: "disabled", o: Outcome{Service: "steam", Policy: PolicyDisabled}},
+		{name: "block", o: Outcome{Service: "steam", Policy: PolicyBlock, Domains: []string{"example.com"}}},
+		{name: "passthru", o: Outcome{Service: "steam", Policy: PolicyPassthru, Domains: []string{"example.com"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := WriteCacheRecords(&b, tt.cfg, tt.o); err != nil {
+				t.Fatal(err)
+			}
+
+			if b.String() != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteRPZSection(t *testing.T) {
+	domains := []string{"example.com", "*.example.net"}
+
+	tests := []struct {
+		name string
+		cfg  Config
+		o    Outcome
+		want string
+	}{
+		{
+			name: "enabled",
+			o:    Outcome{Service: "steam", Policy: PolicyEnabled, IPs: []string{"10.0.0.10"}, Domains: domains},
+			want: ";## steam\n32.10.0.0.10.rpz-client-ip      CNAME rpz-passthru.;\n" +
+				"example.com IN CNAME steam.cache.lancache.net.;\n*.example.net IN CNAME steam.cache.lancache.net.;\n",
+		},
+		{
+			name: "ipv6 cache",
+			o:    Outcome{Service: "steam", Policy: PolicyEnabled, IPs: []string{"fd00::39"}, Domains: domains[:1]},
+			want: ";## steam\n128.39.zz.fd00.rpz-client-ip      CNAME rpz-passthru.;\nexample.com IN CNAME steam.cache.lancache.net.;\n",
+		},
+		{
+			name: "flattened",
+			cfg:  Config{Flatten: true},
+			o:    Outcome{Service: "steam", Policy: PolicyEnabled, IPs: []string{"10.0.0.10"}, Domains: domains[:1]},
+			want: ";## steam\n32.10.0.0.10.rpz-client-ip      CNAME rpz-passthru.;\nexample.com IN A 10.0.0.10;\n",
+		},
+		{
+			name: "block",
+			o:    Outcome{Service: "steam", Policy: PolicyBlock, Domains: domains[:1]},
+			want: ";## steam\nexample.com IN CNAME .;\n",
+		},
+		{
+			name: "passthru",
+			o:    Outcome{Service: "steam", Policy: PolicyPassthru, Domains: domains[:1]},
+			want: ";## steam\nexample.com IN CNAME rpz-passthru.;\n",
+		},
+		{name: "disabled", o: Outcome{Service: "steam", Policy: PolicyDisabled}},
+		{name: "forward", o: Outcome{Service: "steam", Policy: PolicyForward}},
+		{
+			name: "per service enabled",
+			cfg:  Config{PerServiceRPZ: true},
+			o:    Outcome{Service: "steam", Policy: PolicyEnabled, IPs: []string{"10.0.0.10"}, Domains: domains},
+			want: ";## steam\n32.10.0.0.10.rpz-client-ip      CNAME rpz-passthru.;\n",
+		},
+		{
+			name: "per service block",
+			cfg:  Config{PerServiceRPZ: true},
+			o:    Outcome{Service: "steam", Policy: PolicyBlock, Domains: domains},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Domain = "cache.lancache.net"
+
+			var b bytes.Buffer
+			if err := WriteRPZSection(&b, cfg, tt.o); err != nil {
+				t.Fatal(err)
+			}
+
+			if b.String() != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkGenerate plans and writes the cache and rpz zones of a synthetic
+// cache_domains of 120 services with 1000 domains each, the size reached by merged
+// blocklists and custom lists.
+func BenchmarkGenerate(b *testing.B) {
+	services := make([]Service, 120)
+	for i := range services {
+		s := Service{Name: fmt.Sprintf("service%03d", i), Domains: make([]string, 1000)}
+		for j := range s.Domains {
+			if j%10 == 0 {
+				s.Domains[j] = fmt.Sprintf("*.cdn%04d.%s.example.com", j, s.Name)
+			} else {
+				s.Domains[j] = fmt.Sprintf("content%04d.%s.example.com", j, s.Name)
+			}
+		}
+
+		services[i] = s
+	}
+
+	cfg, err := ConfigFromEnv(func(key string) (string, bool) {
+		env := map[string]string{"USE_GENERIC_CACHE": "true", "LANCACHE_IP": "10.0.0.10 10.0.0.11"}
+		v, ok := env[key]
+
+		return v, ok
+	}, services)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	g := New(cfg, services)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for range b.N {
+		if err = g.WriteCacheZone(io.Discard, 1); err != nil {
+			b.Fatal(err)
+		}
+
+		if err = g.WriteRPZZone(io.Discard, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
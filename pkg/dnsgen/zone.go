@@ -0,0 +1,239 @@
+package dnsgen
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fmtCacheZoneHeader = `$ORIGIN %s. 
+$TTL    %s
+@       IN  SOA %s %s (
+             %d
+             %s	
+             %s
+             %s
+             %s )
+@       IN  NS  %s
+
+
+`
+
+	fmtRPZHeader = `$TTL %s
+@            IN    SOA  %s %s  (
+                          %d   ; serial 
+                          %s  ; refresh 
+                          %s  ; retry 
+                          %s  ; expiry 
+                          %s) ; minimum 
+                  IN    NS    localhost.`
+
+	fmtZoneStatements = `	zone "%s" {
+		type master;
+		file "%s";
+%s	};
+	zone "rpz" {
+		type master;
+		file "%s";
+		allow-query { none; };
+%s	};`
+)
+
+// SOA holds the SOA fields of a generated zone, other than the serial.
+type SOA struct {
+	MName   string
+	RName   string
+	Refresh string
+	Retry   string
+	Expire  string
+	Minimum string
+}
+
+var (
+	// CacheSOADefaults are the SOA fields of the cache zone unless configured otherwise.
+	CacheSOADefaults = SOA{MName: "localhost.", RName: "dns.lancache.net.", Refresh: "604800", Retry: "600", Expire: "600", Minimum: "600"}
+
+	// RPZSOADefaults are the SOA fields of the response policy zones unless configured
+	// otherwise.
+	RPZSOADefaults = SOA{MName: "localhost.", RName: "root.localhost.", Refresh: "3H", Retry: "1H", Expire: "1W", Minimum: "1H"}
+
+	timeValue = regexp.MustCompile(`^(\d+[smhdwSMHDW]?)+$`)
+)
+
+// ValidTime reports whether v is a BIND time value, such as 600, 3H or 1w2d.
+func ValidTime(v string) bool {
+	return timeValue.MatchString(v)
+}
+
+// SOAFromEnv returns the SOA fields for a zone, taking SOA_<FIELD> for all zones and
+// <prefix>SOA_<FIELD> for the zone itself, falling back to the given defaults.
+func SOAFromEnv(lookup LookupFunc, prefix string, defaults SOA) (SOA, error) {
+	get := func(field, fallback string) string {
+		if v := getenv(lookup, prefix+"SOA_"+field); v != "" {
+			return v
+		}
+
+		if v := getenv(lookup, "SOA_"+field); v != "" {
+			return v
+		}
+
+		return fallback
+	}
+
+	soa := SOA{
+		MName:   FQDN(get("MNAME", defaults.MName)),
+		RName:   FQDN(strings.Replace(get("RNAME", defaults.RName), "@", ".", 1)),
+		Refresh: get("REFRESH", defaults.Refresh),
+		Retry:   get("RETRY", defaults.Retry),
+		Expire:  get("EXPIRE", defaults.Expire),
+		Minimum: get("MINIMUM", defaults.Minimum),
+	}
+
+	for field, v := range map[string]string{"REFRESH": soa.Refresh, "RETRY": soa.Retry, "EXPIRE": soa.Expire, "MINIMUM": soa.Minimum} {
+		if !ValidTime(v) {
+			return soa, fmt.Errorf("SOA %s value: %s is not a valid time", field, v)
+		}
+	}
+
+	return soa, nil
+}
+
+// FQDN makes a name fully qualified.
+func FQDN(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+
+	return name + "."
+}
+
+// ClientIPTrigger returns the rpz-client-ip trigger matching the single address ip,
+// without the .rpz-client-ip suffix: 32 and the reversed octets of an IPv4 address, or
+// 128 and the reversed groups of an IPv6 address with its longest run of zero groups
+// written as zz, as in 128.1.zz.db8.2001. It returns an empty string when ip is not an
+// address.
+func ClientIPTrigger(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	if v4 := addr.To4(); v4 != nil {
+		return fmt.Sprintf("32.%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	groups := strings.Split(strings.Trim(strings.Replace(addr.String(), "::", ":zz:", 1), ":"), ":")
+	for i, j := 0, len(groups)-1; i < j; i, j = i+1, j-1 {
+		groups[i], groups[j] = groups[j], groups[i]
+	}
+
+	return "128." + strings.Join(groups, ".")
+}
+
+// ClientIPNetwork parses an rpz-client-ip trigger, without the .rpz-client-ip suffix,
+// into the network it matches.
+func ClientIPNetwork(trigger string) (*net.IPNet, bool) {
+	prefix, rest, ok := strings.Cut(trigger, ".")
+	if !ok {
+		return nil, false
+	}
+
+	bits, err := strconv.Atoi(prefix)
+	if err != nil {
+		return nil, false
+	}
+
+	labels := strings.Split(rest, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	size, address := 32, strings.Join(labels, ".")
+	if net.ParseIP(address).To4() == nil {
+		size, address = 128, strings.Join(labels, ":")
+		if strings.Count(address, "zz") == 1 {
+			address = strings.Replace(address, "zz", "", 1)
+			if strings.HasPrefix(address, ":") {
+				address = ":" + address
+			}
+
+			if strings.HasSuffix(address, ":") {
+				address += ":"
+			}
+		}
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil || bits < 0 || bits > size || (size == 32) != (ip.To4() != nil) {
+		return nil, false
+	}
+
+	mask := net.CIDRMask(bits, size)
+
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, true
+}
+
+// NextSerial returns a serial strictly greater than previous, so that secondaries always
+// pick up the change. format selects unix (seconds since the epoch, the default), date
+// (YYYYMMDDnn) or counter.
+func NextSerial(previous uint32, now time.Time, format string) (uint32, error) {
+	var candidate uint32
+
+	switch format {
+	case "", "unix":
+		candidate = uint32(now.Unix())
+	case "date":
+		date, _ := strconv.ParseUint(now.Format("20060102"), 10, 32)
+		candidate = uint32(date * 100)
+	case "counter":
+		candidate = 1
+	default:
+		return 0, fmt.Errorf("SERIAL_FORMAT must be one of unix, date or counter, not %s", format)
+	}
+
+	if candidate <= previous {
+		candidate = previous + 1
+	}
+
+	return candidate, nil
+}
+
+// WriteCacheZoneHeader writes the $ORIGIN, $TTL, SOA and NS records opening the cache
+// zone for domain.
+func WriteCacheZoneHeader(w io.Writer, domain, ttl string, soa SOA, serial uint32, ns string) error {
+	_, err := fmt.Fprintf(w, fmtCacheZoneHeader, domain, ttl, soa.MName, soa.RName, serial,
+		soa.Refresh, soa.Retry, soa.Expire, soa.Minimum, ns)
+
+	return err
+}
+
+// WriteRPZHeader writes the $TTL, SOA and NS records opening a response policy zone.
+func WriteRPZHeader(w io.Writer, ttl string, soa SOA, serial uint32) error {
+	_, err := fmt.Fprintf(w, fmtRPZHeader+"\n", ttl, soa.MName, soa.RName, serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+
+	return err
+}
+
+// WriteRewrites writes the policy records rewriting domain to each of rewrites.
+func WriteRewrites(w io.Writer, domain string, rewrites []string) error {
+	for _, rewrite := range rewrites {
+		for _, s := range []string{domain, " IN ", rewrite, ";\n"} {
+			if _, err := io.WriteString(w, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ZoneStatements returns the zone statements serving the cache zone for domain from
+// cacheZoneFile and the rpz zone from rpzZoneFile, each followed by its extra options.
+func ZoneStatements(domain, cacheZoneFile, cacheOptions, rpzZoneFile, rpzOptions string) string {
+	return fmt.Sprintf(fmtZoneStatements+"\n", domain, cacheZoneFile, cacheOptions, rpzZoneFile, rpzOptions)
+}